@@ -1,39 +1,132 @@
+// Command bcrypt hashes and checks passwords the way the app does, with
+// bcrypt or argon2id, and helps pick settings for either.
+//
+//	bcrypt hash [-algo bcrypt|argon2id] [settings] <password>
+//	bcrypt compare <password> <hash>
+//	bcrypt benchmark [-algo bcrypt|argon2id]
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
+	"time"
 
-	"golang.org/x/crypto/bcrypt"
+	"lenslocked/models"
 )
 
 func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
 	switch os.Args[1] {
 	case "hash":
-		hash(os.Args[2])
-	case "compare":
-		compare(os.Args[2], os.Args[3])
+		hash(os.Args[2:])
+	case "compare", "verify":
+		compare(os.Args[2:])
+	case "benchmark":
+		benchmark(os.Args[2:])
 	default:
 		fmt.Printf("invalid command %v\n", os.Args[1])
+		usage()
 	}
 }
 
-func hash(password string) {
-	hashedBytes, err := bcrypt.GenerateFromPassword(
-		[]byte(password), bcrypt.DefaultCost)
+func usage() {
+	fmt.Println("usage: bcrypt hash [-algo bcrypt|argon2id] [-cost n] [-memory kib] [-time n] [-threads n] <password>")
+	fmt.Println("       bcrypt compare <password> <hash>")
+	fmt.Println("       bcrypt benchmark [-algo bcrypt|argon2id]")
+	os.Exit(2)
+}
+
+// hasherFlags adds the flags that pick a hasher and its settings.
+func hasherFlags(fs *flag.FlagSet) func() models.PasswordHasher {
+	algo := fs.String("algo", "bcrypt", "bcrypt or argon2id")
+	cost := fs.Int("cost", 0, "bcrypt cost (default 10)")
+	memory := fs.Uint("memory", 0, "argon2id memory in KiB (default 19456)")
+	t := fs.Uint("time", 0, "argon2id iterations (default 2)")
+	threads := fs.Uint("threads", 0, "argon2id threads (default 1)")
+	return func() models.PasswordHasher {
+		switch *algo {
+		case "bcrypt":
+			return models.BcryptHasher{Cost: *cost}
+		case "argon2id":
+			return models.Argon2idHasher{
+				Memory:  uint32(*memory),
+				Time:    uint32(*t),
+				Threads: uint8(*threads),
+			}
+		}
+		fmt.Printf("invalid algorithm %v\n", *algo)
+		os.Exit(2)
+		return nil
+	}
+}
+
+func hash(args []string) {
+	fs := flag.NewFlagSet("hash", flag.ExitOnError)
+	hasher := hasherFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+	password := fs.Arg(0)
+	hash, err := hasher().Hash(password)
 	if err != nil {
-		fmt.Printf("error hashing %v\n", password)
-		return
+		fmt.Printf("error hashing %v: %v\n", password, err)
+		os.Exit(1)
 	}
-	// convert the returned byte slice of numbers into a string
-	hash := string(hashedBytes)
 	fmt.Println(hash)
 }
 
-func compare(password, hash string) {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+func compare(args []string) {
+	if len(args) != 2 {
+		usage()
+	}
+	password, hash := args[0], args[1]
+	err := models.ComparePassword(hash, password)
 	if err != nil {
 		fmt.Printf("Invalid password: %v\n", password)
+		os.Exit(1)
 	}
 	fmt.Println("Password is correct!")
 }
+
+// benchmark times hashing with a range of settings. Signing in should take
+// a noticeable fraction of a second on the server, not more.
+func benchmark(args []string) {
+	fs := flag.NewFlagSet("benchmark", flag.ExitOnError)
+	algo := fs.String("algo", "bcrypt", "bcrypt or argon2id")
+	fs.Parse(args)
+	var hashers []models.PasswordHasher
+	switch *algo {
+	case "bcrypt":
+		for cost := 10; cost <= 14; cost++ {
+			hashers = append(hashers, models.BcryptHasher{Cost: cost})
+		}
+	case "argon2id":
+		for _, memory := range []uint32{19 * 1024, 46 * 1024, 64 * 1024} {
+			for _, t := range []uint32{1, 2, 3} {
+				hashers = append(hashers, models.Argon2idHasher{
+					Memory: memory,
+					Time:   t,
+				})
+			}
+		}
+	default:
+		fmt.Printf("invalid algorithm %v\n", *algo)
+		os.Exit(2)
+	}
+	const rounds = 3
+	for _, hasher := range hashers {
+		start := time.Now()
+		for i := 0; i < rounds; i++ {
+			_, err := hasher.Hash("correct horse battery staple")
+			if err != nil {
+				fmt.Printf("error hashing: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		fmt.Printf("%+v\t%v\n", hasher, (time.Since(start) / rounds).Round(time.Millisecond))
+	}
+}
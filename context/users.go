@@ -8,7 +8,9 @@ import (
 type key string
 
 const (
-	userKey key = "user"
+	userKey         key = "user"
+	apiTokenKey     key = "api_token"
+	impersonatorKey key = "impersonator"
 )
 
 func WithUser(ctx context.Context, user *models.User) context.Context {
@@ -23,3 +25,37 @@ func User(ctx context.Context) *models.User {
 	}
 	return user
 }
+
+// WithAPIToken records that the request was authenticated with the API token
+// instead of a session.
+func WithAPIToken(ctx context.Context, token *models.APIToken) context.Context {
+	return context.WithValue(ctx, apiTokenKey, token)
+}
+
+// APIToken returns the API token the request was made with, or nil for
+// requests made with a session or by anonymous users.
+func APIToken(ctx context.Context) *models.APIToken {
+	val := ctx.Value(apiTokenKey)
+	token, ok := val.(*models.APIToken)
+	if !ok {
+		return nil
+	}
+	return token
+}
+
+// WithImpersonator records the admin who is impersonating the user set with
+// WithUser.
+func WithImpersonator(ctx context.Context, admin *models.User) context.Context {
+	return context.WithValue(ctx, impersonatorKey, admin)
+}
+
+// Impersonator returns the admin impersonating the current user, or nil if
+// nobody is.
+func Impersonator(ctx context.Context) *models.User {
+	val := ctx.Value(impersonatorKey)
+	admin, ok := val.(*models.User)
+	if !ok {
+		return nil
+	}
+	return admin
+}
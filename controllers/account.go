@@ -0,0 +1,203 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"lenslocked/context"
+	"lenslocked/errors"
+	"lenslocked/models"
+)
+
+// ExportData downloads a ZIP file with everything we store about the
+// current user, including their images.
+func (u Users) ExportData(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="lenslocked-data.zip"`)
+	err := u.AccountService.Export(user, w)
+	if err != nil {
+		// the download has started, all we can do is log why it broke off
+		fmt.Println(err)
+	}
+}
+
+type deleteAccountData struct {
+	// DeleteAfter is when the account will be deleted, nil unless the user
+	// asked for it.
+	DeleteAfter *time.Time
+	// SignedOut is set right after deletion was requested, which signs the
+	// user out everywhere.
+	SignedOut bool
+}
+
+func (u Users) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var data deleteAccountData
+	var err error
+	data.DeleteAfter, err = u.AccountService.DeletionScheduled(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	u.Templates.DeleteAccount.Execute(w, r, data)
+}
+
+// ProcessDeleteAccount schedules the deletion of the current user's account
+// once they entered their password, and signs them out everywhere. Signing
+// in again during the grace period lets them cancel it.
+func (u Users) ProcessDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var data deleteAccountData
+	err := u.confirmPassword(r, user, r.FormValue("password"), "That password is wrong.")
+	if err != nil {
+		u.Templates.DeleteAccount.Execute(w, r, data, err)
+		return
+	}
+	deleteAfter, err := u.AccountService.ScheduleDeletion(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = u.SessionService.DeleteAll(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	deleteCookie(w, CookieSession)
+	err = u.EmailService.AccountDeletionScheduled(user.Email, deleteAfter, u.BaseURL+"/signin")
+	if err != nil {
+		fmt.Println(err)
+	}
+	data.DeleteAfter = &deleteAfter
+	data.SignedOut = true
+	u.Templates.DeleteAccount.Execute(w, r, data)
+}
+
+func (u Users) CancelDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	err := u.AccountService.CancelDeletion(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me/delete", http.StatusFound)
+}
+
+type accountData struct {
+	Email         string
+	EmailVerified bool
+	Profile       *models.Profile
+	// DeleteAfter is when the account will be deleted, nil unless the user
+	// asked for it.
+	DeleteAfter *time.Time
+}
+
+func (u Users) renderAccount(w http.ResponseWriter, r *http.Request, profile *models.Profile, errs ...error) {
+	user := context.User(r.Context())
+	data := accountData{
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified(),
+		Profile:       profile,
+	}
+	var err error
+	data.DeleteAfter, err = u.AccountService.DeletionScheduled(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	u.Templates.Account.Execute(w, r, data, errs...)
+}
+
+// UpdateProfile saves the username, display name and bio of the current
+// user.
+func (u Users) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	profile, err := u.ProfileService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	profile.Username = r.FormValue("username")
+	profile.DisplayName = r.FormValue("display_name")
+	profile.Bio = r.FormValue("bio")
+	err = u.ProfileService.Update(profile)
+	if err != nil {
+		var pubErr interface{ Public() string }
+		if errors.As(err, &pubErr) {
+			u.renderAccount(w, r, profile, err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+// UploadAvatar replaces the current user's avatar with the uploaded image.
+func (u Users) UploadAvatar(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	profile, err := u.ProfileService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = r.ParseMultipartForm(MaxUploadMemory)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusBadRequest)
+		return
+	}
+	file, fileHeader, err := r.FormFile("avatar")
+	if err != nil {
+		u.renderAccount(w, r, profile, errors.Public(err, "Choose an image to upload."))
+		return
+	}
+	defer file.Close()
+	err = u.ProfileService.SetAvatar(profile, fileHeader.Filename, file)
+	if err != nil {
+		var fileErr models.FileError
+		if errors.As(err, &fileErr) {
+			u.renderAccount(w, r, profile, errors.Public(err,
+				"Only png, gif, and jpg images can be used as your avatar."))
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+func (u Users) DeleteAvatar(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	err := u.ProfileService.DeleteAvatar(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+// Avatar serves the current user's avatar, which they may not have a public
+// profile to show on yet.
+func (u Users) Avatar(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	profile, err := u.ProfileService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	serveAvatar(w, r, u.ProfileService, profile)
+}
@@ -0,0 +1,201 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"lenslocked/context"
+	"lenslocked/errors"
+	"lenslocked/models"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Admin is the admin area at /admin, where admins manage other people's
+// accounts. Everything done here ends up in the audit log.
+type Admin struct {
+	Templates struct {
+		Dashboard Template
+		User      Template
+	}
+	AdminService         *models.AdminService
+	AuditLogService      *models.AuditLogService
+	GalleryService       *models.GalleryService
+	SessionService       *models.SessionService
+	PasswordResetService *models.PasswordResetService
+	EmailService         *models.EmailService
+	// BaseURL is prepended to the links sent by email, eg
+	// "https://www.lenslocked.com".
+	BaseURL string
+}
+
+// Dashboard searches users by email address or username and shows the
+// latest entries of the audit log.
+func (a Admin) Dashboard(w http.ResponseWriter, r *http.Request) {
+	admin := context.User(r.Context())
+	var data struct {
+		Query string
+		Users []models.User
+		Audit []models.AuditEntry
+	}
+	data.Query = r.FormValue("q")
+	var err error
+	data.Users, err = a.AdminService.SearchUsers(data.Query)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if data.Query != "" {
+		err = a.AuditLogService.Record(admin, models.AuditSearchUsers, nil, data.Query)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+	}
+	data.Audit, err = a.AuditLogService.Recent()
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	a.Templates.Dashboard.Execute(w, r, data)
+}
+
+// User shows a user's account with their galleries and sessions, and what
+// admins did to it before.
+func (a Admin) User(w http.ResponseWriter, r *http.Request) {
+	admin := context.User(r.Context())
+	user, err := a.userByID(w, r)
+	if err != nil {
+		return
+	}
+	var data struct {
+		User      *models.User
+		Self      bool
+		Galleries []models.Gallery
+		Sessions  []models.Session
+		Audit     []models.AuditEntry
+	}
+	data.User = user
+	data.Self = user.ID == admin.ID
+	data.Galleries, err = a.GalleryService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Sessions, err = a.SessionService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = a.AuditLogService.Record(admin, models.AuditViewUser, user, "")
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Audit, err = a.AuditLogService.ByTargetUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	a.Templates.User.Execute(w, r, data)
+}
+
+func (a Admin) Suspend(w http.ResponseWriter, r *http.Request) {
+	a.act(w, r, models.AuditSuspendUser, func(user *models.User) error {
+		return a.AdminService.Suspend(user.ID)
+	})
+}
+
+func (a Admin) Unsuspend(w http.ResponseWriter, r *http.Request) {
+	a.act(w, r, models.AuditUnsuspendUser, func(user *models.User) error {
+		return a.AdminService.Unsuspend(user.ID)
+	})
+}
+
+// ForcePasswordReset removes the user's password, signs them out everywhere
+// and emails them a link to choose a new one.
+func (a Admin) ForcePasswordReset(w http.ResponseWriter, r *http.Request) {
+	a.act(w, r, models.AuditForcePasswordReset, func(user *models.User) error {
+		err := a.AdminService.ForcePasswordReset(user.ID)
+		if err != nil {
+			return err
+		}
+		pwReset, err := a.PasswordResetService.Create(user.Email)
+		if err != nil {
+			return err
+		}
+		vals := url.Values{
+			"token": {pwReset.Token},
+		}
+		return a.EmailService.PasswordResetRequired(user.Email, a.BaseURL+"/reset-pw?"+vals.Encode())
+	})
+}
+
+func (a Admin) GrantAdmin(w http.ResponseWriter, r *http.Request) {
+	a.act(w, r, models.AuditGrantAdmin, func(user *models.User) error {
+		return a.AdminService.SetAdmin(user.ID, true)
+	})
+}
+
+func (a Admin) RevokeAdmin(w http.ResponseWriter, r *http.Request) {
+	a.act(w, r, models.AuditRevokeAdmin, func(user *models.User) error {
+		return a.AdminService.SetAdmin(user.ID, false)
+	})
+}
+
+// act takes the action on the user in the URL, records it in the audit log
+// and goes back to the user's page. Admins can't take actions on their own
+// account, so nobody locks themselves out by accident.
+func (a Admin) act(w http.ResponseWriter, r *http.Request, action models.AuditAction, fn func(user *models.User) error) {
+	admin := context.User(r.Context())
+	user, err := a.userByID(w, r)
+	if err != nil {
+		return
+	}
+	if user.ID == admin.ID {
+		http.Error(w, "You can't do this to your own account", http.StatusBadRequest)
+		return
+	}
+	// recorded first, so even an action that fails halfway is on record
+	err = a.AuditLogService.Record(admin, action, user, "")
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = fn(user)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusFound)
+}
+
+func (a Admin) userByID(w http.ResponseWriter, r *http.Request) (*models.User, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return nil, err
+	}
+	user, err := a.AdminService.User(id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return nil, err
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return nil, err
+	}
+	return user, nil
+}
@@ -0,0 +1,132 @@
+package controllers
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"lenslocked/models"
+
+	"github.com/gorilla/csrf"
+)
+
+// tokenDB is a database/sql driver that answers every query with a single
+// API token of a signed up user, which is all SetTokenUser asks for.
+type tokenDB struct{}
+
+func (tokenDB) Connect(context.Context) (driver.Conn, error) { return tokenDB{}, nil }
+func (tokenDB) Driver() driver.Driver                        { return nil }
+func (tokenDB) Prepare(query string) (driver.Stmt, error)    { return tokenDB{}, nil }
+func (tokenDB) Close() error                                 { return nil }
+func (tokenDB) Begin() (driver.Tx, error)                    { return nil, driver.ErrSkip }
+func (tokenDB) NumInput() int                                { return -1 }
+
+func (tokenDB) Exec(args []driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+
+func (tokenDB) Query(args []driver.Value) (driver.Rows, error) {
+	return &tokenRows{}, nil
+}
+
+type tokenRows struct {
+	done bool
+}
+
+func (rows *tokenRows) Columns() []string {
+	return []string{"id", "name", "scopes", "expires_at", "created_at", "last_used_at",
+		"id", "email", "password_hash", "email_verified_at", "is_admin", "suspended_at"}
+}
+
+func (rows *tokenRows) Close() error { return nil }
+
+func (rows *tokenRows) Next(dest []driver.Value) error {
+	if rows.done {
+		return io.EOF
+	}
+	rows.done = true
+	now := time.Now()
+	values := []driver.Value{int64(1), "script", "galleries:write", nil, now, now,
+		int64(1), "jon@example.com", "", now, false, nil}
+	copy(dest, values)
+	return nil
+}
+
+// testTokenRouter puts the middleware in front of handler in the same order
+// main does.
+func testTokenRouter(handler http.Handler) http.Handler {
+	umw := UserMiddleware{
+		APITokenService: &models.APITokenService{
+			DB: sql.OpenDB(tokenDB{}),
+		},
+	}
+	csrfMw := csrf.Protect([]byte("01234567890123456789012345678901"),
+		csrf.Secure(false), csrf.Path("/"))
+	return umw.SetTokenUser(csrfMw(umw.SetUser(handler)))
+}
+
+// The CSRF check is skipped for API tokens only because browsers don't let
+// other sites set the Authorization header, which no longer holds once CORS
+// headers allow it.
+func TestSetTokenUserSendsNoCORSHeaders(t *testing.T) {
+	router := testTokenRouter(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	tests := map[string]*http.Request{
+		"bearer POST": func() *http.Request {
+			r := httptest.NewRequest(http.MethodPost, "/galleries", strings.NewReader("title=Holiday"))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("Authorization", "Bearer some-token")
+			r.Header.Set("Origin", "https://evil.test")
+			return r
+		}(),
+		"preflight": func() *http.Request {
+			r := httptest.NewRequest(http.MethodOptions, "/galleries", nil)
+			r.Header.Set("Origin", "https://evil.test")
+			r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			r.Header.Set("Access-Control-Request-Headers", "authorization")
+			return r
+		}(),
+	}
+	for name, r := range tests {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			for header := range w.Header() {
+				if strings.HasPrefix(http.CanonicalHeaderKey(header), "Access-Control-Allow-") {
+					t.Errorf("response has the CORS header %s: %q", header, w.Header().Get(header))
+				}
+			}
+		})
+	}
+
+	t.Run("bearer POST skips the CSRF check", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/galleries", nil)
+		r.Header.Set("Authorization", "Bearer some-token")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+		}
+	})
+}
+
+func TestCookiePOSTWithoutCSRFTokenFails(t *testing.T) {
+	router := testTokenRouter(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("handler ran for a POST without a CSRF token")
+	}))
+	r := httptest.NewRequest(http.MethodPost, "/galleries", strings.NewReader("title=Holiday"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: CookieSession, Value: "some-session"})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,55 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+
+	"lenslocked/context"
+)
+
+func (u Users) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Changed bool
+	}
+	u.Templates.ChangePassword.Execute(w, r, data)
+}
+
+// ProcessChangePassword sets a new password once the user entered their
+// current one. Every other session of the user is signed out, and they get
+// an email about the change.
+func (u Users) ProcessChangePassword(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var data struct {
+		Changed bool
+	}
+	err := u.confirmPassword(r, user, r.FormValue("current_password"), "Your current password is wrong.")
+	if err != nil {
+		u.Templates.ChangePassword.Execute(w, r, data, err)
+		return
+	}
+	err = u.UserService.UpdatePassword(user.ID, r.FormValue("password"))
+	if err != nil {
+		// violations of the password policy are public errors
+		u.Templates.ChangePassword.Execute(w, r, data, err)
+		return
+	}
+	token, err := readCookie(r, CookieSession)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = u.SessionService.DeleteOthers(user.ID, token)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = u.EmailService.PasswordChanged(user.Email, u.BaseURL+"/forgot-pw")
+	if err != nil {
+		// the password is changed either way
+		fmt.Println(err)
+	}
+	data.Changed = true
+	u.Templates.ChangePassword.Execute(w, r, data)
+}
@@ -0,0 +1,27 @@
+package controllers
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"time"
+)
+
+// serveContent writes the contents of a stored file to the response. Contents
+// that can seek (local files, in-memory objects) go through
+// http.ServeContent so range and conditional requests keep working, anything
+// else is streamed as is.
+func serveContent(w http.ResponseWriter, r *http.Request, name string, modTime time.Time, contents io.Reader) {
+	if rs, ok := contents.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, name, modTime, rs)
+		return
+	}
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	io.Copy(w, contents)
+}
@@ -3,10 +3,20 @@ package controllers
 import (
 	"fmt"
 	"net/http"
+	"time"
 )
 
 const (
 	CookieSession = "session"
+	// CookieTwoFactor holds the user that still has to enter their two
+	// factor code to sign in.
+	CookieTwoFactor = "two_factor"
+	// CookieWebAuthn holds the challenge of a passkey registration or sign
+	// in that is in progress.
+	CookieWebAuthn = "webauthn"
+	// CookieOIDC holds the state of a sign in with an external identity
+	// provider that is in progress.
+	CookieOIDC = "oidc"
 )
 
 func newCookie(name, value string) *http.Cookie {
@@ -24,6 +34,15 @@ func setCookie(w http.ResponseWriter, name, value string) {
 	http.SetCookie(w, cookie)
 }
 
+// setSessionCookie stores the session token in a cookie that expires
+// together with the session.
+func setSessionCookie(w http.ResponseWriter, token string, expiresAt time.Time) {
+	cookie := newCookie(CookieSession, token)
+	cookie.Expires = expiresAt
+	cookie.MaxAge = int(time.Until(expiresAt).Seconds())
+	http.SetCookie(w, cookie)
+}
+
 func readCookie(r *http.Request, name string) (string, error) {
 	c, err := r.Cookie(name)
 	if err != nil {
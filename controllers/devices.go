@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"lenslocked/context"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Devices lists the sessions of the current user, one for every device they
+// are signed in on.
+func (u Users) Devices(w http.ResponseWriter, r *http.Request) {
+	type Device struct {
+		ID         int
+		UserAgent  string
+		IPAddress  string
+		CreatedAt  time.Time
+		LastSeenAt time.Time
+		Current    bool
+	}
+	var data struct {
+		Devices []Device
+	}
+	user := context.User(r.Context())
+	sessions, err := u.SessionService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	var currentHash string
+	if token, err := readCookie(r, CookieSession); err == nil {
+		currentHash = u.SessionService.Hash(token)
+	}
+	for _, session := range sessions {
+		data.Devices = append(data.Devices, Device{
+			ID:         session.ID,
+			UserAgent:  session.UserAgent,
+			IPAddress:  session.IPAddress,
+			CreatedAt:  session.CreatedAt,
+			LastSeenAt: session.LastSeenAt,
+			Current:    session.TokenHash == currentHash,
+		})
+	}
+	u.Templates.Devices.Execute(w, r, data)
+}
+
+// RevokeDevice signs the current user out on a single device.
+func (u Users) RevokeDevice(w http.ResponseWriter, r *http.Request) {
+	sessionID, err := strconv.Atoi(chi.URLParam(r, "sessionID"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	user := context.User(r.Context())
+	err = u.SessionService.Revoke(user.ID, sessionID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	// revoking the session of this device signs the user out right away,
+	// in which case RequireUser sends them to the sign in page
+	http.Redirect(w, r, "/users/me/devices", http.StatusFound)
+}
+
+// SignOutEverywhere deletes every session of the current user, including the
+// one the request was made with.
+func (u Users) SignOutEverywhere(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	err := u.SessionService.DeleteAll(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	deleteCookie(w, CookieSession)
+	http.Redirect(w, r, "/signin", http.StatusFound)
+}
+
+// clientIP returns the address the request came from, without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,186 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"lenslocked/context"
+	"lenslocked/errors"
+	"lenslocked/models"
+)
+
+func (u Users) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var data struct {
+		Email    string
+		NewEmail string
+		Sent     bool
+	}
+	data.Email = user.Email
+	u.Templates.ChangeEmail.Execute(w, r, data)
+}
+
+// ProcessChangeEmail emails a confirmation link to the new address once the
+// user entered their password. The old address is told about the change,
+// with a link to revert it.
+func (u Users) ProcessChangeEmail(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var data struct {
+		Email    string
+		NewEmail string
+		Sent     bool
+	}
+	data.Email = user.Email
+	data.NewEmail = strings.ToLower(strings.TrimSpace(r.FormValue("email")))
+	err := u.confirmPassword(r, user, r.FormValue("password"), "That password is wrong.")
+	if err != nil {
+		u.Templates.ChangeEmail.Execute(w, r, data, err)
+		return
+	}
+	if data.NewEmail == user.Email {
+		err = errors.Public(fmt.Errorf("change email: same address"), "That is already your email address.")
+		u.Templates.ChangeEmail.Execute(w, r, data, err)
+		return
+	}
+	_, err = u.UserService.ByEmail(data.NewEmail)
+	if err == nil {
+		err = errors.Public(models.ErrEmailTaken, "That email address is already associated with an account.")
+		u.Templates.ChangeEmail.Execute(w, r, data, err)
+		return
+	}
+	if !errors.Is(err, models.ErrNotFound) {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	change, err := u.EmailChangeService.Create(user.ID, user.Email, data.NewEmail)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	vals := url.Values{
+		"token": {change.Token},
+	}
+	err = u.EmailService.ConfirmEmailChange(change.NewEmail, u.BaseURL+"/email-change/confirm?"+vals.Encode())
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	vals = url.Values{
+		"token": {change.RevertToken},
+	}
+	err = u.EmailService.EmailChangeRequested(change.OldEmail, change.NewEmail, u.BaseURL+"/email-change/revert?"+vals.Encode())
+	if err != nil {
+		// the change can't be applied without the new address anyway
+		fmt.Println(err)
+	}
+	data.Sent = true
+	u.Templates.ChangeEmail.Execute(w, r, data)
+}
+
+type emailChangeData struct {
+	Token  string
+	Revert bool
+	// Done is set once the change was confirmed or reverted, with the
+	// account's email address now.
+	Done  bool
+	Email string
+	// SignedOut is set when reverting a change signed the user out
+	// everywhere.
+	SignedOut bool
+}
+
+// EmailChange shows the confirm button for the token in a confirmation
+// link, so the link itself doesn't change anything when opened.
+func (u Users) EmailChange(w http.ResponseWriter, r *http.Request) {
+	u.Templates.EmailChange.Execute(w, r, emailChangeData{
+		Token: r.FormValue("token"),
+	})
+}
+
+// ConfirmEmailChange applies the change the new address confirmed.
+func (u Users) ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	data := emailChangeData{
+		Token: r.FormValue("token"),
+	}
+	change, err := u.EmailChangeService.Consume(data.Token)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			err = errors.Public(err, "That link is invalid or has expired.")
+		case errors.Is(err, models.ErrEmailTaken):
+			err = errors.Public(err, "That email address is already associated with an account.")
+		default:
+			fmt.Println(err)
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+		data.Token = ""
+		u.Templates.EmailChange.Execute(w, r, data, err)
+		return
+	}
+	data.Token = ""
+	data.Done = true
+	data.Email = change.NewEmail
+	u.Templates.EmailChange.Execute(w, r, data)
+}
+
+func (u Users) RevertEmailChange(w http.ResponseWriter, r *http.Request) {
+	u.Templates.EmailChange.Execute(w, r, emailChangeData{
+		Token:  r.FormValue("token"),
+		Revert: true,
+	})
+}
+
+// ProcessRevertEmailChange cancels a change the old address didn't ask
+// for. If it was applied already, the old address is restored and the user
+// is signed out everywhere, as someone else had access to their account.
+func (u Users) ProcessRevertEmailChange(w http.ResponseWriter, r *http.Request) {
+	data := emailChangeData{
+		Token:  r.FormValue("token"),
+		Revert: true,
+	}
+	change, err := u.EmailChangeService.Revert(data.Token)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			err = errors.Public(err, "That link is invalid or has expired.")
+			data.Token = ""
+			u.Templates.EmailChange.Execute(w, r, data, err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Token = ""
+	data.Done = true
+	data.Email = change.OldEmail
+	if change.ConfirmedAt != nil {
+		err = u.UserService.UpdateEmail(change.UserID, change.OldEmail)
+		if err != nil {
+			if errors.Is(err, models.ErrEmailTaken) {
+				err = errors.Public(err, "Your old email address is now used by another account. Please contact support.")
+				data.Done = false
+				u.Templates.EmailChange.Execute(w, r, data, err)
+				return
+			}
+			fmt.Println(err)
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+		err = u.SessionService.DeleteAll(change.UserID)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+		deleteCookie(w, CookieSession)
+		data.SignedOut = true
+	}
+	u.Templates.EmailChange.Execute(w, r, data)
+}
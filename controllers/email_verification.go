@@ -0,0 +1,152 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"lenslocked/context"
+	"lenslocked/errors"
+	"lenslocked/models"
+)
+
+// Action names something a signed in user can do that may require a
+// verified email address. Which actions are open to unverified users is
+// configured with UserMiddleware.UnverifiedActions.
+type Action string
+
+const (
+	ActionCreateGallery Action = "create_gallery"
+	ActionEditGallery   Action = "edit_gallery"
+	ActionDeleteGallery Action = "delete_gallery"
+	ActionUploadImages  Action = "upload_images"
+	ActionShareGallery  Action = "share_gallery"
+)
+
+// DefaultUnverifiedActions lets new users set up galleries before they
+// confirm their email address, but not publish or share anything.
+var DefaultUnverifiedActions = []Action{
+	ActionCreateGallery,
+	ActionEditGallery,
+	ActionDeleteGallery,
+}
+
+// Valid reports whether a is one of the known actions.
+func (a Action) Valid() bool {
+	switch a {
+	case ActionCreateGallery, ActionEditGallery, ActionDeleteGallery,
+		ActionUploadImages, ActionShareGallery:
+		return true
+	}
+	return false
+}
+
+// RequireVerified only lets users through who verified their email address,
+// unless action is one of the UnverifiedActions. Unverified users are sent
+// to the page asking them to check their email. It must be used after
+// RequireUser.
+func (umw UserMiddleware) RequireVerified(action Action) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := context.User(r.Context())
+			if actionAllowed(user, umw.UnverifiedActions, action) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			http.Redirect(w, r, "/verify-email", http.StatusFound)
+		})
+	}
+}
+
+// actionAllowed reports whether the user may take the action, which they can
+// once they verified their email address or if it is one of the unverified
+// actions. Nil unverified actions mean DefaultUnverifiedActions.
+func actionAllowed(user *models.User, unverified []Action, action Action) bool {
+	if user.EmailVerified() {
+		return true
+	}
+	if unverified == nil {
+		unverified = DefaultUnverifiedActions
+	}
+	for _, a := range unverified {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyEmail shows the confirm button for the token in a verification link.
+// Without a token, signed in users are told to check their email instead.
+func (u Users) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Token    string
+		Email    string
+		Verified bool
+	}
+	data.Token = r.FormValue("token")
+	if data.Token == "" {
+		user := context.User(r.Context())
+		if user == nil {
+			http.Redirect(w, r, "/signin", http.StatusFound)
+			return
+		}
+		data.Email = user.Email
+		data.Verified = user.EmailVerified()
+	}
+	u.Templates.VerifyEmail.Execute(w, r, data)
+}
+
+func (u Users) ProcessVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Token    string
+		Email    string
+		Verified bool
+	}
+	data.Token = r.FormValue("token")
+	_, err := u.EmailVerificationService.Consume(data.Token)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			err = errors.Public(err, "That link is invalid or has expired. Sign in to get a new one.")
+			data.Token = ""
+			u.Templates.VerifyEmail.Execute(w, r, data, err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+// ResendVerification sends a new verification link to the current user.
+func (u Users) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if user.EmailVerified() {
+		http.Redirect(w, r, "/users/me", http.StatusFound)
+		return
+	}
+	err := u.sendVerification(user)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/verify-email", http.StatusFound)
+}
+
+func (u Users) sendVerification(user *models.User) error {
+	verification, err := u.EmailVerificationService.Create(user.ID)
+	if err != nil {
+		return fmt.Errorf("send verification: %w", err)
+	}
+	vals := url.Values{
+		"token": {verification.Token},
+	}
+	verifyURL := u.BaseURL + "/verify-email?" + vals.Encode()
+	err = u.EmailService.VerifyEmail(user.Email, verifyURL)
+	if err != nil {
+		return fmt.Errorf("send verification: %w", err)
+	}
+	return nil
+}
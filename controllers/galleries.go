@@ -1,28 +1,53 @@
 package controllers
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
-	"math/rand"
+	"io"
 	"net/http"
+	"net/url"
+	"path"
 	"strconv"
+	"strings"
+	"time"
 
 	"lenslocked/context"
 	"lenslocked/errors"
 	"lenslocked/models"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/securecookie"
 )
 
 type Galleries struct {
 	Templates struct {
-		New   Template
-		Edit  Template
-		Index Template
-		Show  Template
+		New    Template
+		Edit   Template
+		Index  Template
+		Show   Template
+		Image  Template
+		Unlock Template
 	}
-	GalleryService *models.GalleryService
+	GalleryService       *models.GalleryService
+	ImageService         *models.ImageService
+	ImageMetadataService *models.ImageMetadataService
+	ShareService         *models.ShareService
+	GalleryMemberService *models.GalleryMemberService
+	// LoginThrottleService slows down guessing gallery passwords.
+	LoginThrottleService *models.LoginThrottleService
+	// UnlockKey signs the cookies that unlock password protected galleries.
+	UnlockKey []byte
+	// UnlockDuration is how long a gallery stays unlocked after the right
+	// password is entered. Defaults to DefaultUnlockDuration.
+	UnlockDuration time.Duration
+	// UnverifiedActions should match UserMiddleware.UnverifiedActions.
+	// Changing who can view a gallery needs ActionShareGallery.
+	UnverifiedActions []Action
 }
 
+const DefaultUnlockDuration = 24 * time.Hour
+
 func (g Galleries) New(w http.ResponseWriter, r *http.Request) {
 	var data struct {
 		Title string
@@ -49,29 +74,120 @@ func (g Galleries) Create(w http.ResponseWriter, r *http.Request) {
 }
 
 func (g Galleries) Edit(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionUpload))
 	if err != nil {
 		return
 	}
+	g.renderEdit(w, r, gallery)
+}
 
-	data := struct {
-		ID    int
-		Title string
-	}{
-		ID:    gallery.ID,
-		Title: gallery.Title,
+func (g Galleries) renderEdit(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, errs ...error) {
+	data, err := g.editData(r, gallery)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
 	}
-	g.Templates.Edit.Execute(w, r, data)
+	g.Templates.Edit.Execute(w, r, data, errs...)
+}
+
+type editGalleryImage struct {
+	GalleryID       int
+	Filename        string
+	FilenameEscaped string
+}
+
+type editGalleryData struct {
+	ID         int
+	Title      string
+	Visibility models.Visibility
+	ShareToken string
+	// HasPassword is true for galleries visitors have to unlock.
+	HasPassword bool
+	Images      []editGalleryImage
+	Shares      []models.Share
+	Members     []models.GalleryMember
+	// CanEdit and CanManage tell the template which parts of the page the
+	// user is allowed to use.
+	CanEdit   bool
+	CanManage bool
+	// NewShareURL is only set right after a share link is created, as it
+	// can't be recovered from the stored hash afterwards.
+	NewShareURL string
+}
+
+func (g Galleries) editData(r *http.Request, gallery *models.Gallery) (editGalleryData, error) {
+	role, err := g.userRole(r, gallery)
+	if err != nil {
+		return editGalleryData{}, err
+	}
+	data := editGalleryData{
+		ID:          gallery.ID,
+		Title:       gallery.Title,
+		Visibility:  gallery.Visibility,
+		ShareToken:  gallery.ShareToken,
+		HasPassword: gallery.PasswordHash != "",
+		CanEdit:     role.Can(models.PermissionEdit),
+		CanManage:   role.Can(models.PermissionManage),
+	}
+	images, err := g.ImageService.Images(gallery.ID)
+	if err != nil {
+		return data, err
+	}
+	for _, image := range images {
+		data.Images = append(data.Images, editGalleryImage{
+			GalleryID:       image.GalleryID,
+			Filename:        image.Filename,
+			FilenameEscaped: url.PathEscape(image.Filename),
+		})
+	}
+	if !data.CanManage {
+		return data, nil
+	}
+	data.Shares, err = g.ShareService.Active(gallery.ID)
+	if err != nil {
+		return data, err
+	}
+	data.Members, err = g.GalleryMemberService.ByGalleryID(gallery.ID)
+	if err != nil {
+		return data, err
+	}
+	return data, nil
 }
 
 func (g Galleries) Update(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionEdit))
 	if err != nil {
 		return
 	}
 
 	title := r.FormValue("title")
 	gallery.Title = title
+	role, err := g.userRole(r, gallery)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	// editors can rename the gallery, but only the owner decides who sees it
+	if role.Can(models.PermissionManage) {
+		visibility := models.Visibility(r.FormValue("visibility"))
+		if !visibility.Valid() {
+			g.renderEdit(w, r, gallery, errors.Public(
+				fmt.Errorf("invalid visibility: %q", visibility),
+				"Please pick who can view this gallery."))
+			return
+		}
+		user := context.User(r.Context())
+		if visibility != gallery.Visibility &&
+			!actionAllowed(user, g.UnverifiedActions, ActionShareGallery) {
+			g.renderEdit(w, r, gallery, errors.Public(
+				fmt.Errorf("unverified user %d changing visibility", user.ID),
+				"Please verify your email address before you publish this gallery."))
+			return
+		}
+		gallery.Visibility = visibility
+	}
 	err = g.GalleryService.Update(gallery)
 	if err != nil {
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
@@ -83,15 +199,21 @@ func (g Galleries) Update(w http.ResponseWriter, r *http.Request) {
 
 func (g Galleries) Index(w http.ResponseWriter, r *http.Request) {
 	type Gallery struct {
-		ID    int
-		Title string
+		ID         int
+		Title      string
+		Visibility models.Visibility
+	}
+	type SharedGallery struct {
+		ID        int
+		Title     string
+		Role      models.Role
+		CanUpload bool
 	}
 	var data struct {
 		Galleries []Gallery
+		// Shared are the galleries of other users this user is a member of.
+		Shared []SharedGallery
 	}
-	// TODO: lookup the gallery we are going to render
-	g.Templates.Index.Execute(w, r, data)
-
 	user := context.User(r.Context())
 	galleries, err := g.GalleryService.ByUserID(user.ID)
 	if err != nil {
@@ -101,38 +223,88 @@ func (g Galleries) Index(w http.ResponseWriter, r *http.Request) {
 	}
 	for _, gallery := range galleries {
 		data.Galleries = append(data.Galleries, Gallery{
-			ID:    gallery.ID,
-			Title: gallery.Title,
+			ID:         gallery.ID,
+			Title:      gallery.Title,
+			Visibility: gallery.Visibility,
+		})
+	}
+	shared, err := g.GalleryMemberService.Galleries(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, sg := range shared {
+		data.Shared = append(data.Shared, SharedGallery{
+			ID:        sg.Gallery.ID,
+			Title:     sg.Gallery.Title,
+			Role:      sg.Role,
+			CanUpload: sg.Role.Can(models.PermissionUpload),
 		})
 	}
+	g.Templates.Index.Execute(w, r, data)
 }
 
 func (g Galleries) Show(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r)
+	gallery, err := g.galleryByID(w, r, g.userCanViewGallery)
 	if err != nil {
 		return
 	}
+	type Image struct {
+		Filename string
+		// URL is the path of the original image, which is relative to the
+		// gallery URL the visitor used.
+		URL    string
+		SrcSet string
+	}
 	var data struct {
 		ID     int
 		Title  string
-		Images []string
+		Images []Image
 	}
 	data.ID = gallery.ID
 	data.Title = gallery.Title
-	// generate random cat pictures as default for the gallery
-	for i := 0; i < 20; i++ {
-		// width and height are random values betwee 200 and 700
-		w, h := rand.Intn(500)+200, rand.Intn(500)+200
-		// using the width and height, we generate a URL
-		catImageURL := fmt.Sprintf("https://placekitten.com/%d/%d", w, h)
-		// Then we add the URL to our images.
-		data.Images = append(data.Images, catImageURL)
+	if token := chi.URLParam(r, "share"); token != "" {
+		// only page views count towards a share link's view limit, the
+		// images they load don't.
+		share, err := g.ShareService.View(token)
+		if err != nil {
+			if errors.Is(err, models.ErrNotFound) {
+				http.Error(w, "This link has expired", http.StatusNotFound)
+				return
+			}
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		if share.MaxViews != 0 {
+			err = g.setShareViewCookie(w, share)
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "Something went wrong", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	images, err := g.ImageService.Images(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, image := range images {
+		imageURL := g.imageURL(r, gallery, image)
+		data.Images = append(data.Images, Image{
+			Filename: image.Filename,
+			URL:      imageURL,
+			SrcSet:   g.srcSet(imageURL),
+		})
 	}
 	g.Templates.Show.Execute(w, r, data)
 }
 
 func (g Galleries) Delete(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionManage))
 	if err != nil {
 		return
 	}
@@ -141,18 +313,578 @@ func (g Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
+	err = g.ImageService.DeleteAll(gallery.ID)
+	if err != nil {
+		// the gallery is already gone at this point, so we only log the
+		// leftover images instead of failing the request.
+		fmt.Println(err)
+	}
 	http.Redirect(w, r, "/galleries", http.StatusFound)
 }
 
-type galleryOpt func(http.ResponseWriter, *http.Request, *models.Gallery) error
+func (g Galleries) Image(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCanViewGallery)
+	if err != nil {
+		return
+	}
+	filename := g.filename(r)
+	image, err := g.ImageService.Image(gallery.ID, filename)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if r.FormValue("w") != "" {
+		// a resized variant was requested instead of the original. These are
+		// re-encoded without any EXIF data, so they are safe to serve as is.
+		width, err := strconv.Atoi(r.FormValue("w"))
+		if err != nil {
+			http.Error(w, "Invalid width", http.StatusBadRequest)
+			return
+		}
+		variant, err := g.ImageService.Variant(image, width)
+		if err != nil {
+			if errors.Is(err, models.ErrNotFound) {
+				http.Error(w, "Image not found", http.StatusNotFound)
+				return
+			}
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		rc, err := g.ImageService.Open(variant)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		defer rc.Close()
+		serveContent(w, r, variant.Filename, variant.ModTime, rc)
+		return
+	}
 
-func (g Galleries) galleryByID(w http.ResponseWriter, r *http.Request, opts ...galleryOpt) (*models.Gallery, error) {
-	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	role, err := g.userRole(r, gallery)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if role.Can(models.PermissionEdit) {
+		// the owner and editors get the original file back, metadata and all
+		rc, err := g.ImageService.Open(image)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		defer rc.Close()
+		serveContent(w, r, image.Filename, image.ModTime, rc)
+		return
+	}
+	rs, err := g.ImageService.OpenPublic(image)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	serveContent(w, r, image.Filename, image.ModTime, rs)
+}
+
+func (g Galleries) ImageDetails(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCanViewGallery)
+	if err != nil {
+		return
+	}
+	image, err := g.ImageService.Image(gallery.ID, g.filename(r))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	var data struct {
+		GalleryURL   string
+		GalleryTitle string
+		Filename     string
+		URL          string
+		SrcSet       string
+		Metadata     *models.ImageMetadata
+	}
+	data.GalleryURL = g.galleryURL(r, gallery)
+	data.GalleryTitle = gallery.Title
+	data.Filename = image.Filename
+	data.URL = g.imageURL(r, gallery, image)
+	data.SrcSet = g.srcSet(data.URL)
+	data.Metadata, err = g.ImageMetadataService.ByImage(gallery.ID, image.Filename)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	g.Templates.Image.Execute(w, r, data)
+}
+
+func (g Galleries) UploadImage(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionUpload))
+	if err != nil {
+		return
+	}
+	err = r.ParseMultipartForm(MaxUploadMemory)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusBadRequest)
+		return
+	}
+	fileHeaders := r.MultipartForm.File["images"]
+	for _, fileHeader := range fileHeaders {
+		file, err := fileHeader.Open()
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		meta, err := models.ParseExif(file)
+		if err != nil {
+			// a broken EXIF block shouldn't stop the upload, the image is
+			// simply stored without metadata.
+			fmt.Println(err)
+		}
+		_, err = file.Seek(0, io.SeekStart)
+		if err != nil {
+			file.Close()
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		image, err := g.ImageService.Create(gallery.ID, fileHeader.Filename, file)
+		file.Close()
+		if err != nil {
+			var fileErr models.FileError
+			if errors.As(err, &fileErr) {
+				msg := fmt.Sprintf("%v has an invalid content type or extension. "+
+					"Only png, gif, and jpg files can be uploaded.", fileHeader.Filename)
+				g.renderEdit(w, r, gallery, errors.Public(err, msg))
+				return
+			}
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		meta.GalleryID = image.GalleryID
+		meta.Filename = image.Filename
+		err = g.ImageMetadataService.Create(&meta)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+func (g Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionEdit))
+	if err != nil {
+		return
+	}
+	filename := g.filename(r)
+	err = g.ImageService.Delete(gallery.ID, filename)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = g.ImageMetadataService.Delete(gallery.ID, filename)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// galleryURL is the path visitors reached the gallery under. Galleries
+// viewed through an unlisted or share link have to keep using it, as their
+// ID based URLs are off limits to everyone but the owner.
+func (g Galleries) galleryURL(r *http.Request, gallery *models.Gallery) string {
+	if token := chi.URLParam(r, "token"); token != "" {
+		return "/g/" + url.PathEscape(token)
+	}
+	if token := chi.URLParam(r, "share"); token != "" {
+		return "/s/" + url.PathEscape(token)
+	}
+	return fmt.Sprintf("/galleries/%d", gallery.ID)
+}
+
+func (g Galleries) imageURL(r *http.Request, gallery *models.Gallery, image models.Image) string {
+	return g.galleryURL(r, gallery) + "/images/" + url.PathEscape(image.Filename)
+}
+
+func (g Galleries) UpdatePassword(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionManage))
+	if err != nil {
+		return
+	}
+	password := r.FormValue("password")
+	if r.FormValue("remove") != "" {
+		password = ""
+	} else if password == "" {
+		g.renderEdit(w, r, gallery, errors.Public(
+			fmt.Errorf("empty gallery password"), "Please enter a password for the gallery."))
+		return
+	}
+	err = g.GalleryService.UpdatePassword(gallery, password)
+	if err != nil {
+		var pubErr interface{ Public() string }
+		if errors.As(err, &pubErr) {
+			g.renderEdit(w, r, gallery, err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// Unlock checks the password of a protected gallery and, when it is right,
+// sets a cookie that unlocks only this gallery for UnlockDuration.
+func (g Galleries) Unlock(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, galleryMustBeVisible)
+	if err != nil {
+		return
+	}
+	ip := clientIP(r)
+	wait, err := g.LoginThrottleService.AttemptGalleryUnlock(gallery.ID, ip)
+	if err != nil {
+		if errors.Is(err, models.ErrTooManyAttempts) || errors.Is(err, models.ErrAccountLocked) {
+			g.renderUnlock(w, r, gallery, errors.Public(err,
+				fmt.Sprintf("Too many incorrect passwords. Please try again in %s.", formatWait(wait))))
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if !g.GalleryService.CheckPassword(gallery, r.FormValue("password")) {
+		g.renderUnlock(w, r, gallery, errors.Public(
+			fmt.Errorf("wrong password for gallery %d", gallery.ID),
+			"That password is incorrect."))
+		return
+	}
+	err = g.LoginThrottleService.SucceedGalleryUnlock(gallery.ID, ip)
+	if err != nil {
+		// not worth refusing the right password over
+		fmt.Println(err)
+	}
+	err = g.setUnlockCookie(w, gallery)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, g.galleryURL(r, gallery), http.StatusFound)
+}
+
+func (g Galleries) renderUnlock(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, errs ...error) {
+	var data struct {
+		Title string
+		URL   string
+	}
+	data.Title = gallery.Title
+	data.URL = g.galleryURL(r, gallery)
+	g.Templates.Unlock.Execute(w, r, data, errs...)
+}
+
+// unlockCookie is what the signed unlock cookie holds. The fingerprint ties
+// it to the current password, so changing the password locks everyone out
+// again.
+type unlockCookie struct {
+	GalleryID   int
+	Fingerprint string
+}
+
+func unlockCookieName(gallery *models.Gallery) string {
+	return fmt.Sprintf("gallery_unlock_%d", gallery.ID)
+}
+
+func passwordFingerprint(gallery *models.Gallery) string {
+	sum := sha256.Sum256([]byte(gallery.PasswordHash))
+	return base64.URLEncoding.EncodeToString(sum[:16])
+}
+
+func (g Galleries) unlockDuration() time.Duration {
+	if g.UnlockDuration == 0 {
+		return DefaultUnlockDuration
+	}
+	return g.UnlockDuration
+}
+
+func (g Galleries) unlockCodec() *securecookie.SecureCookie {
+	return securecookie.New(g.UnlockKey, nil).MaxAge(int(g.unlockDuration().Seconds()))
+}
+
+func (g Galleries) setUnlockCookie(w http.ResponseWriter, gallery *models.Gallery) error {
+	codec := g.unlockCodec()
+	name := unlockCookieName(gallery)
+	value, err := codec.Encode(name, unlockCookie{
+		GalleryID:   gallery.ID,
+		Fingerprint: passwordFingerprint(gallery),
+	})
+	if err != nil {
+		return fmt.Errorf("set unlock cookie: %w", err)
+	}
+	cookie := newCookie(name, value)
+	cookie.MaxAge = int(g.unlockDuration().Seconds())
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+func (g Galleries) galleryUnlocked(r *http.Request, gallery *models.Gallery) bool {
+	name := unlockCookieName(gallery)
+	value, err := readCookie(r, name)
+	if err != nil {
+		return false
+	}
+	var unlocked unlockCookie
+	err = g.unlockCodec().Decode(name, value, &unlocked)
+	if err != nil {
+		return false
+	}
+	return unlocked.GalleryID == gallery.ID &&
+		unlocked.Fingerprint == passwordFingerprint(gallery)
+}
+
+// shareViewDuration is how long the page view of a share link gets to load
+// the gallery's images after the link ran out of views.
+const shareViewDuration = 10 * time.Minute
+
+// shareViewCookie is what the signed cookie holds that lets a counted page
+// view of a share link load its images.
+type shareViewCookie struct {
+	ShareID int
+}
+
+func shareViewCookieName(share *models.Share) string {
+	return fmt.Sprintf("share_view_%d", share.ID)
+}
+
+func (g Galleries) shareViewCodec() *securecookie.SecureCookie {
+	return securecookie.New(g.UnlockKey, nil).MaxAge(int(shareViewDuration.Seconds()))
+}
+
+func (g Galleries) setShareViewCookie(w http.ResponseWriter, share *models.Share) error {
+	name := shareViewCookieName(share)
+	value, err := g.shareViewCodec().Encode(name, shareViewCookie{
+		ShareID: share.ID,
+	})
+	if err != nil {
+		return fmt.Errorf("set share view cookie: %w", err)
+	}
+	cookie := newCookie(name, value)
+	cookie.MaxAge = int(shareViewDuration.Seconds())
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+// shareByToken returns the share link for token if it can still be used.
+// Links that ran out of views only work for visitors whose page view was
+// counted in the last shareViewDuration, so that view can load its images.
+func (g Galleries) shareByToken(r *http.Request, token string) (*models.Share, error) {
+	share, err := g.ShareService.Check(token)
+	if !errors.Is(err, models.ErrNotFound) {
+		return share, err
+	}
+	share, err = g.ShareService.CheckViewed(token)
 	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusNotFound)
 		return nil, err
 	}
-	gallery, err := g.GalleryService.ByID(id)
+	name := shareViewCookieName(share)
+	value, err := readCookie(r, name)
+	if err != nil {
+		return nil, models.ErrNotFound
+	}
+	var viewed shareViewCookie
+	err = g.shareViewCodec().Decode(name, value, &viewed)
+	if err != nil || viewed.ShareID != share.ID {
+		return nil, models.ErrNotFound
+	}
+	return share, nil
+}
+
+func (g Galleries) AddMember(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionManage))
+	if err != nil {
+		return
+	}
+	email := r.FormValue("email")
+	role := models.Role(r.FormValue("role"))
+	if !role.Valid() {
+		g.renderEdit(w, r, gallery, errors.Public(
+			fmt.Errorf("invalid role: %q", role), "Please pick a role for the new member."))
+		return
+	}
+	if strings.EqualFold(email, context.User(r.Context()).Email) {
+		g.renderEdit(w, r, gallery, errors.Public(
+			fmt.Errorf("owner added as member"), "You already own this gallery."))
+		return
+	}
+	_, err = g.GalleryMemberService.Add(gallery.ID, email, role)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+func (g Galleries) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionManage))
+	if err != nil {
+		return
+	}
+	memberID, err := strconv.Atoi(chi.URLParam(r, "memberID"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	err = g.GalleryMemberService.Remove(gallery.ID, memberID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+func (g Galleries) CreateShare(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionManage))
+	if err != nil {
+		return
+	}
+	var expiresAt *time.Time
+	if r.FormValue("expires_at") != "" {
+		// the link stays valid through the whole day that was picked
+		date, err := time.Parse("2006-01-02", r.FormValue("expires_at"))
+		if err != nil {
+			g.renderEdit(w, r, gallery, errors.Public(err, "Please enter a valid expiry date."))
+			return
+		}
+		date = date.AddDate(0, 0, 1)
+		expiresAt = &date
+	}
+	var maxViews int
+	if r.FormValue("max_views") != "" {
+		maxViews, err = strconv.Atoi(r.FormValue("max_views"))
+		if err != nil || maxViews < 1 {
+			g.renderEdit(w, r, gallery, errors.Public(
+				fmt.Errorf("invalid max views: %q", r.FormValue("max_views")),
+				"The maximum number of views has to be a positive number."))
+			return
+		}
+	}
+	share, err := g.ShareService.Create(gallery.ID, expiresAt, maxViews)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data, err := g.editData(r, gallery)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.NewShareURL = "/s/" + url.PathEscape(share.Token)
+	g.Templates.Edit.Execute(w, r, data)
+}
+
+func (g Galleries) RevokeShare(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCan(models.PermissionManage))
+	if err != nil {
+		return
+	}
+	shareID, err := strconv.Atoi(chi.URLParam(r, "shareID"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	err = g.ShareService.Revoke(gallery.ID, shareID)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Share link not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// srcSet lists the URL of every resized variant of the image, so browsers
+// can pick the smallest one that still looks sharp.
+func (g Galleries) srcSet(imageURL string) string {
+	var candidates []string
+	for _, width := range g.ImageService.Widths() {
+		candidates = append(candidates, fmt.Sprintf("%s?w=%d %dw", imageURL, width, width))
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// filename reads the image filename from the URL and strips any directories
+// from it so it can't be used to reach files outside of the gallery.
+func (g Galleries) filename(r *http.Request) string {
+	filename := chi.URLParam(r, "filename")
+	return path.Base(filename)
+}
+
+// MaxUploadMemory is the number of bytes of a multipart upload that are kept
+// in memory, anything above it is written to temporary files on disk.
+const MaxUploadMemory = 32 << 20
+
+type galleryOpt func(http.ResponseWriter, *http.Request, *models.Gallery) error
+
+// galleryByID looks up the gallery from the {id} in the URL, the {token} of
+// an unlisted gallery's link or the {share} token of a share link, and then
+// runs every opt on it.
+func (g Galleries) galleryByID(w http.ResponseWriter, r *http.Request, opts ...galleryOpt) (*models.Gallery, error) {
+	var gallery *models.Gallery
+	var err error
+	if token := chi.URLParam(r, "token"); token != "" {
+		gallery, err = g.GalleryService.ByShareToken(token)
+	} else if token := chi.URLParam(r, "share"); token != "" {
+		var share *models.Share
+		share, err = g.shareByToken(r, token)
+		if err == nil {
+			gallery, err = g.GalleryService.ByID(share.GalleryID)
+		}
+	} else {
+		var id int
+		id, err = strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusNotFound)
+			return nil, err
+		}
+		gallery, err = g.GalleryService.ByID(id)
+	}
 	if err != nil {
 		if errors.Is(err, models.ErrNotFound) {
 			http.Error(w, "Gallery not found", http.StatusNotFound)
@@ -170,11 +902,89 @@ func (g Galleries) galleryByID(w http.ResponseWriter, r *http.Request, opts ...g
 	return gallery, nil
 }
 
-func userMustOwnGallery(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
-	user := context.User(r.Context())
-	if user.ID != gallery.UserID {
-		http.Error(w, "You are not authorized to edit this gallery", http.StatusForbidden)
-		return fmt.Errorf("user does not have access to this gallery")
+// userCanViewGallery enforces the visibility of the gallery and asks
+// visitors for the password of protected galleries. The owner and members
+// can always view the gallery.
+func (g Galleries) userCanViewGallery(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+	role, err := g.userRole(r, gallery)
+	if err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return err
+	}
+	if role.Can(models.PermissionView) {
+		// the owner and members don't need a link or password
+		return nil
+	}
+	err = galleryMustBeVisible(w, r, gallery)
+	if err != nil {
+		return err
+	}
+	if gallery.PasswordHash != "" && !g.galleryUnlocked(r, gallery) {
+		g.renderUnlock(w, r, gallery)
+		return fmt.Errorf("gallery %d is locked", gallery.ID)
 	}
 	return nil
 }
+
+// galleryMustBeVisible enforces the visibility of the gallery. Galleries the
+// user isn't allowed to see are reported as not found, so their IDs don't
+// leak which galleries exist.
+func galleryMustBeVisible(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+	if chi.URLParam(r, "share") != "" {
+		// galleryByID only finds galleries for share links that can still be
+		// used, and those grant access whatever the visibility.
+		return nil
+	}
+	switch gallery.Visibility {
+	case models.VisibilityPublic:
+		return nil
+	case models.VisibilityUnlisted:
+		token := chi.URLParam(r, "token")
+		if token != "" && token == gallery.ShareToken {
+			return nil
+		}
+	}
+	user := context.User(r.Context())
+	if user != nil && user.ID == gallery.UserID {
+		return nil
+	}
+	http.Error(w, "Gallery not found", http.StatusNotFound)
+	return fmt.Errorf("user does not have access to this gallery")
+}
+
+// userCan only lets users through who have perm for the gallery, either as
+// its owner or through their role as a member.
+func (g Galleries) userCan(perm models.Permission) galleryOpt {
+	return func(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+		role, err := g.userRole(r, gallery)
+		if err != nil {
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return err
+		}
+		if !role.Can(perm) {
+			http.Error(w, "You are not authorized to edit this gallery", http.StatusForbidden)
+			return fmt.Errorf("user does not have access to this gallery")
+		}
+		return nil
+	}
+}
+
+// userRole returns the role the current user has in the gallery, which is
+// empty for visitors that aren't signed in or aren't members.
+func (g Galleries) userRole(r *http.Request, gallery *models.Gallery) (models.Role, error) {
+	user := context.User(r.Context())
+	if user == nil {
+		return "", nil
+	}
+	if user.ID == gallery.UserID {
+		return models.RoleOwner, nil
+	}
+	role, err := g.GalleryMemberService.Role(gallery.ID, user.ID)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			return "", nil
+		}
+		return "", fmt.Errorf("user role: %w", err)
+	}
+	return role, nil
+}
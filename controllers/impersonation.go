@@ -0,0 +1,112 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+
+	"lenslocked/context"
+	"lenslocked/errors"
+	"lenslocked/models"
+)
+
+// Impersonate lets the admin see the site as the user in the URL does, in
+// their current session. Admins can't be impersonated.
+func (a Admin) Impersonate(w http.ResponseWriter, r *http.Request) {
+	admin := context.User(r.Context())
+	user, err := a.userByID(w, r)
+	if err != nil {
+		return
+	}
+	if user.ID == admin.ID || user.IsAdmin {
+		http.Error(w, "Admins can't be impersonated", http.StatusBadRequest)
+		return
+	}
+	token, err := readCookie(r, CookieSession)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	err = a.AuditLogService.Record(admin, models.AuditStartImpersonation, user, "")
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = a.SessionService.Impersonate(token, user.ID)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "This user can't be impersonated", http.StatusBadRequest)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
+
+// StopImpersonating takes the admin back to their own account, on the
+// impersonated user's page in the admin area.
+func (a Admin) StopImpersonating(w http.ResponseWriter, r *http.Request) {
+	admin := context.Impersonator(r.Context())
+	user := context.User(r.Context())
+	if admin == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	token, err := readCookie(r, CookieSession)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	err = a.SessionService.StopImpersonating(token)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = a.AuditLogService.Record(admin, models.AuditStopImpersonation, user, "")
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusFound)
+}
+
+// impersonationExempt are the requests admins can still make while they
+// impersonate a user, to get back to their own account.
+var impersonationExempt = map[string]bool{
+	"POST /impersonate/stop": true,
+	"POST /signout":          true,
+}
+
+// RejectImpersonation keeps admins who impersonate a user from changing
+// anything. They can look around, but every request that isn't a GET or
+// HEAD is refused, except for ending the impersonation. It goes on the
+// whole router, GET routes that do more than show a page also need
+// ForbidImpersonation.
+func (umw UserMiddleware) RejectImpersonation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if context.Impersonator(r.Context()) != nil &&
+			r.Method != http.MethodGet && r.Method != http.MethodHead &&
+			!impersonationExempt[r.Method+" "+r.URL.Path] {
+			http.Error(w, "This can't be done while impersonating a user", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ForbidImpersonation refuses requests of any method while impersonating,
+// for GET routes with side effects like downloading the user's data or
+// signing in.
+func (umw UserMiddleware) ForbidImpersonation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if context.Impersonator(r.Context()) != nil {
+			http.Error(w, "This can't be done while impersonating a user", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
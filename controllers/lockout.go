@@ -0,0 +1,118 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"lenslocked/errors"
+	"lenslocked/models"
+)
+
+// signInFailed records that a sign in attempt had the wrong password. When
+// that locks the account, its owner is emailed a link to unlock it. Errors
+// are only logged, the user is told about the failed sign in either way.
+func (u Users) signInFailed(email string) {
+	token, err := u.LoginThrottleService.Fail(email)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if token == "" {
+		return
+	}
+	_, err = u.UserService.ByEmail(email)
+	if err != nil {
+		// nobody to tell when the account doesn't exist
+		if !errors.Is(err, models.ErrNotFound) {
+			fmt.Println(err)
+		}
+		return
+	}
+	vals := url.Values{
+		"token": {token},
+	}
+	unlockURL := u.BaseURL + "/signin/unlock?" + vals.Encode()
+	err = u.EmailService.UnlockAccount(email, unlockURL)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// confirmPassword checks the password signed in users enter again before
+// sensitive changes to their account. Wrong passwords count as failed sign
+// ins, or a stolen session could be used to guess the password. The errors
+// about the password are errors.Public, wrong is the message for a wrong
+// one.
+func (u Users) confirmPassword(r *http.Request, user *models.User, password, wrong string) error {
+	ip := clientIP(r)
+	wait, err := u.LoginThrottleService.Attempt(user.Email, ip)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrAccountLocked):
+			return errors.Public(err, "This account is locked after too many wrong passwords. Follow the link we emailed you to unlock it, or try again later.")
+		case errors.Is(err, models.ErrTooManyAttempts):
+			return errors.Public(err, fmt.Sprintf("Too many wrong passwords. Please try again in %s.", formatWait(wait)))
+		}
+		return err
+	}
+	_, err = u.UserService.Authenticate(user.Email, password)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidLogin) {
+			u.signInFailed(user.Email)
+			return errors.Public(err, wrong)
+		}
+		return err
+	}
+	err = u.LoginThrottleService.Succeed(user.Email, ip)
+	if err != nil {
+		// not worth failing the change over
+		fmt.Println(err)
+	}
+	return nil
+}
+
+// UnlockAccount lifts the lock of the account the unlock email was sent
+// for, and lets the user sign in again.
+func (u Users) UnlockAccount(w http.ResponseWriter, r *http.Request) {
+	email, err := u.LoginThrottleService.Unlock(r.FormValue("token"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			var data struct {
+				Email    string
+				OIDCName string
+			}
+			if u.OIDCProvider != nil {
+				data.OIDCName = u.OIDCProvider.Name
+			}
+			err = errors.Public(err, "That unlock link is invalid or has expired. Your account unlocks by itself after a while.")
+			u.Templates.SignIn.Execute(w, r, data, err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	vals := url.Values{
+		"email": {email},
+	}
+	http.Redirect(w, r, "/signin?"+vals.Encode(), http.StatusFound)
+}
+
+// formatWait rounds a wait up to whole seconds or minutes for people to
+// read.
+func formatWait(wait time.Duration) string {
+	if wait < time.Minute {
+		seconds := int((wait + time.Second - 1) / time.Second)
+		if seconds == 1 {
+			return "1 second"
+		}
+		return fmt.Sprintf("%d seconds", seconds)
+	}
+	minutes := int((wait + time.Minute - 1) / time.Minute)
+	if minutes == 1 {
+		return "1 minute"
+	}
+	return fmt.Sprintf("%d minutes", minutes)
+}
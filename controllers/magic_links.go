@@ -0,0 +1,89 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"lenslocked/errors"
+	"lenslocked/models"
+)
+
+func (u Users) MagicLink(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Token string
+		Email string
+		Sent  bool
+	}
+	data.Email = r.FormValue("email")
+	u.Templates.MagicLink.Execute(w, r, data)
+}
+
+// ProcessMagicLink emails a sign in link. The page looks the same whether
+// or not there is an account for the email address, so it can't be used to
+// find out who has one.
+func (u Users) ProcessMagicLink(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Token string
+		Email string
+		Sent  bool
+	}
+	data.Email = r.FormValue("email")
+	link, err := u.MagicLinkService.Create(data.Email)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if err == nil {
+		vals := url.Values{
+			"token": {link.Token},
+		}
+		signInURL := u.BaseURL + "/signin/link/confirm?" + vals.Encode()
+		err = u.EmailService.MagicLink(data.Email, signInURL)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+	}
+	data.Sent = true
+	u.Templates.MagicLink.Execute(w, r, data)
+}
+
+// ConfirmMagicLink asks the user to confirm the sign in. Opening the link
+// doesn't sign in by itself, or link scanners in mail clients would use it
+// up, and others could sign people in to their account by sending them one.
+func (u Users) ConfirmMagicLink(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Token string
+		Email string
+		Sent  bool
+	}
+	data.Token = r.FormValue("token")
+	u.Templates.MagicLink.Execute(w, r, data)
+}
+
+// ProcessConfirmMagicLink signs in the user the link in the email was sent
+// to.
+func (u Users) ProcessConfirmMagicLink(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Token string
+		Email string
+		Sent  bool
+	}
+	user, err := u.MagicLinkService.Consume(r.FormValue("token"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			err = errors.Public(err, "That sign in link is invalid or has expired. Please request a new one.")
+			u.Templates.MagicLink.Execute(w, r, data, err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	// the link stands in for the password, two factor authentication still
+	// applies
+	u.completeSignIn(w, r, user.ID, false)
+}
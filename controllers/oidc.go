@@ -0,0 +1,280 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"lenslocked/context"
+	"lenslocked/errors"
+	"lenslocked/models"
+	"lenslocked/rand"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/securecookie"
+)
+
+// oidcTimeout is how long users have to sign in at the identity provider.
+const oidcTimeout = 10 * time.Minute
+
+// oidcCookie holds what we need to finish a sign in with the identity
+// provider once it redirects back. It is signed with the same key as the
+// two factor cookie.
+type oidcCookie struct {
+	State    string
+	Nonce    string
+	Verifier string
+	// UserID is set when a signed in user links their account at the
+	// provider, instead of signing in with it.
+	UserID int
+}
+
+// OIDCSignIn sends the user to the identity provider to sign in.
+func (u Users) OIDCSignIn(w http.ResponseWriter, r *http.Request) {
+	if u.OIDCProvider == nil {
+		http.Error(w, "Page not found", http.StatusNotFound)
+		return
+	}
+	u.redirectToOIDC(w, r, 0)
+}
+
+// LinkIdentity sends the signed in user to the identity provider, to add
+// their account there as a way to sign in.
+func (u Users) LinkIdentity(w http.ResponseWriter, r *http.Request) {
+	if u.OIDCProvider == nil {
+		http.Error(w, "Page not found", http.StatusNotFound)
+		return
+	}
+	user := context.User(r.Context())
+	u.redirectToOIDC(w, r, user.ID)
+}
+
+func (u Users) redirectToOIDC(w http.ResponseWriter, r *http.Request, userID int) {
+	pending := oidcCookie{
+		UserID: userID,
+	}
+	for _, v := range []*string{&pending.State, &pending.Nonce, &pending.Verifier} {
+		b, err := rand.Bytes(32)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+		// PKCE verifiers can't have the padding of rand.String
+		*v = base64.RawURLEncoding.EncodeToString(b)
+	}
+	authURL, err := u.OIDCProvider.AuthCodeURL(pending.State, pending.Nonce, pending.Verifier)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = u.setOIDCCookie(w, pending)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCCallback is where the identity provider sends users back to. Users
+// whose identity is linked are signed in. Otherwise the identity is linked
+// to the user with the same email address, when both we and the provider
+// verified it, or a new user is created for it.
+func (u Users) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if u.OIDCProvider == nil {
+		http.Error(w, "Page not found", http.StatusNotFound)
+		return
+	}
+	pending, err := u.readOIDCCookie(r)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	deleteCookie(w, CookieOIDC)
+	if subtle.ConstantTimeCompare([]byte(r.FormValue("state")), []byte(pending.State)) != 1 {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	if r.FormValue("error") != "" {
+		err = errors.Public(fmt.Errorf("oidc: %s: %s", r.FormValue("error"), r.FormValue("error_description")),
+			fmt.Sprintf("Signing in with %s was cancelled or failed.", u.OIDCProvider.Name))
+		u.oidcFailed(w, r, pending, err)
+		return
+	}
+	claims, err := u.OIDCProvider.Exchange(r.FormValue("code"), pending.Verifier, pending.Nonce)
+	if err != nil {
+		fmt.Println(err)
+		err = errors.Public(err, fmt.Sprintf("Signing in with %s failed. Please try again.", u.OIDCProvider.Name))
+		u.oidcFailed(w, r, pending, err)
+		return
+	}
+	provider := u.OIDCProvider.Issuer
+
+	if pending.UserID != 0 {
+		user := context.User(r.Context())
+		if user == nil || user.ID != pending.UserID {
+			http.Redirect(w, r, "/signin", http.StatusFound)
+			return
+		}
+		_, err = u.IdentityService.Link(user.ID, provider, claims.Subject, claims.Email)
+		if err != nil {
+			if errors.Is(err, models.ErrIdentityLinked) {
+				err = errors.Public(err, fmt.Sprintf("That %s account is already linked to another user.", u.OIDCProvider.Name))
+			}
+			u.oidcFailed(w, r, pending, err)
+			return
+		}
+		http.Redirect(w, r, "/users/me/identities", http.StatusFound)
+		return
+	}
+
+	identity, err := u.IdentityService.ByProviderSubject(provider, claims.Subject)
+	if err == nil {
+		u.completeSignIn(w, r, identity.UserID, false)
+		return
+	}
+	if !errors.Is(err, models.ErrNotFound) {
+		u.oidcFailed(w, r, pending, err)
+		return
+	}
+	if claims.Email == "" {
+		err = errors.Public(fmt.Errorf("oidc: no email for %q", claims.Subject),
+			fmt.Sprintf("Your %s account has no email address we can use.", u.OIDCProvider.Name))
+		u.oidcFailed(w, r, pending, err)
+		return
+	}
+	user, err := u.UserService.ByEmail(claims.Email)
+	switch {
+	case errors.Is(err, models.ErrNotFound):
+		user, err = u.UserService.CreateWithoutPassword(claims.Email, claims.EmailVerified)
+		if err != nil {
+			u.oidcFailed(w, r, pending, err)
+			return
+		}
+		if !claims.EmailVerified {
+			err = u.sendVerification(user)
+			if err != nil {
+				// the user can ask for another link from the verify page
+				fmt.Println(err)
+			}
+		}
+	case err != nil:
+		u.oidcFailed(w, r, pending, err)
+		return
+	case !claims.EmailVerified || !user.EmailVerified():
+		// linking unverified addresses would let whoever signed up with
+		// someone else's email address into their account, or the other
+		// way around
+		err = errors.Public(models.ErrEmailTaken,
+			fmt.Sprintf("That email address is already associated with an account. Sign in and connect %s from your settings.", u.OIDCProvider.Name))
+		u.oidcFailed(w, r, pending, err)
+		return
+	}
+	_, err = u.IdentityService.Link(user.ID, provider, claims.Subject, claims.Email)
+	if err != nil {
+		u.oidcFailed(w, r, pending, err)
+		return
+	}
+	// the provider stands in for the password, two factor authentication
+	// still applies
+	u.completeSignIn(w, r, user.ID, false)
+}
+
+// oidcFailed shows err on the page the user started from.
+func (u Users) oidcFailed(w http.ResponseWriter, r *http.Request, pending oidcCookie, err error) {
+	var pubErr interface{ Public() string }
+	if !errors.As(err, &pubErr) {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if pending.UserID != 0 {
+		u.renderIdentities(w, r, err)
+		return
+	}
+	var data struct {
+		Email    string
+		OIDCName string
+	}
+	data.OIDCName = u.OIDCProvider.Name
+	u.Templates.SignIn.Execute(w, r, data, err)
+}
+
+// Identities lists the accounts at identity providers the current user can
+// sign in with.
+func (u Users) Identities(w http.ResponseWriter, r *http.Request) {
+	u.renderIdentities(w, r)
+}
+
+func (u Users) renderIdentities(w http.ResponseWriter, r *http.Request, errs ...error) {
+	user := context.User(r.Context())
+	var data struct {
+		OIDCName   string
+		Identities []models.Identity
+	}
+	if u.OIDCProvider != nil {
+		data.OIDCName = u.OIDCProvider.Name
+	}
+	var err error
+	data.Identities, err = u.IdentityService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	u.Templates.Identities.Execute(w, r, data, errs...)
+}
+
+func (u Users) UnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := strconv.Atoi(chi.URLParam(r, "identityID"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	err = u.IdentityService.Unlink(user.ID, id)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me/identities", http.StatusFound)
+}
+
+func (u Users) setOIDCCookie(w http.ResponseWriter, pending oidcCookie) error {
+	value, err := u.oidcCodec().Encode(CookieOIDC, pending)
+	if err != nil {
+		return fmt.Errorf("set oidc cookie: %w", err)
+	}
+	cookie := newCookie(CookieOIDC, value)
+	cookie.MaxAge = int(oidcTimeout.Seconds())
+	// the provider redirects back with a top level GET, which Lax cookies
+	// are sent with
+	cookie.SameSite = http.SameSiteLaxMode
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+func (u Users) readOIDCCookie(r *http.Request) (oidcCookie, error) {
+	var pending oidcCookie
+	value, err := readCookie(r, CookieOIDC)
+	if err != nil {
+		return pending, err
+	}
+	err = u.oidcCodec().Decode(CookieOIDC, value, &pending)
+	if err != nil {
+		return pending, fmt.Errorf("read oidc cookie: %w", err)
+	}
+	return pending, nil
+}
+
+// oidcCodec is signInCodec with more time, as signing in at the provider
+// can take a while.
+func (u Users) oidcCodec() *securecookie.SecureCookie {
+	return u.signInCodec().MaxAge(int(oidcTimeout.Seconds()))
+}
@@ -0,0 +1,328 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"lenslocked/context"
+	"lenslocked/errors"
+	"lenslocked/models"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// webAuthnTimeout is how long the browser gives users to use their
+// authenticator. The WebAuthn options want it in milliseconds.
+const webAuthnTimeout = 5 * time.Minute
+
+// webAuthnCookie holds the challenge of a passkey ceremony in progress. It
+// is signed with the same codec as the two factor cookie.
+type webAuthnCookie struct {
+	Challenge []byte
+	// UserID is set when registering a passkey for a signed in user.
+	UserID   int
+	Remember bool
+}
+
+// b64 encodes binary WebAuthn fields for the JavaScript on our pages, which
+// turns them back into ArrayBuffers.
+type b64 []byte
+
+func (b b64) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *b64) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	*b, err = base64.RawURLEncoding.DecodeString(s)
+	return err
+}
+
+type webAuthnCredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   b64    `json:"id"`
+}
+
+// Passkeys lists the passkeys of the current user.
+func (u Users) Passkeys(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var data struct {
+		Passkeys []models.WebAuthnCredential
+	}
+	var err error
+	data.Passkeys, err = u.WebAuthnService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	u.Templates.Passkeys.Execute(w, r, data)
+}
+
+// BeginPasskeyRegistration returns the options for
+// navigator.credentials.create().
+func (u Users) BeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	challenge, err := u.WebAuthnService.NewChallenge()
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	existing, err := u.WebAuthnService.ByUserID(user.ID)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	err = u.setWebAuthnCookie(w, webAuthnCookie{
+		Challenge: challenge,
+		UserID:    user.ID,
+	})
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	type rp struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+	type webAuthnUser struct {
+		ID          b64    `json:"id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	}
+	type param struct {
+		Type string `json:"type"`
+		Alg  int    `json:"alg"`
+	}
+	type selection struct {
+		ResidentKey        string `json:"residentKey"`
+		RequireResidentKey bool   `json:"requireResidentKey"`
+		UserVerification   string `json:"userVerification"`
+	}
+	var options struct {
+		Challenge              b64                            `json:"challenge"`
+		RP                     rp                             `json:"rp"`
+		User                   webAuthnUser                   `json:"user"`
+		PubKeyCredParams       []param                        `json:"pubKeyCredParams"`
+		Timeout                int64                          `json:"timeout"`
+		Attestation            string                         `json:"attestation"`
+		AuthenticatorSelection selection                      `json:"authenticatorSelection"`
+		ExcludeCredentials     []webAuthnCredentialDescriptor `json:"excludeCredentials"`
+	}
+	options.Challenge = challenge
+	options.RP = rp{
+		ID:   u.WebAuthnService.RPID,
+		Name: u.WebAuthnService.RPName,
+	}
+	options.User = webAuthnUser{
+		ID:          b64(strconv.Itoa(user.ID)),
+		Name:        user.Email,
+		DisplayName: user.Email,
+	}
+	options.PubKeyCredParams = []param{{Type: "public-key", Alg: models.WebAuthnAlgES256}}
+	options.Timeout = webAuthnTimeout.Milliseconds()
+	options.Attestation = "none"
+	// passkeys have to be discoverable, so users can sign in without typing
+	// their email address first
+	options.AuthenticatorSelection = selection{
+		ResidentKey:        "required",
+		RequireResidentKey: true,
+		UserVerification:   "preferred",
+	}
+	options.ExcludeCredentials = []webAuthnCredentialDescriptor{}
+	for _, credential := range existing {
+		options.ExcludeCredentials = append(options.ExcludeCredentials,
+			webAuthnCredentialDescriptor{Type: "public-key", ID: credential.CredentialID})
+	}
+	writeJSON(w, options)
+}
+
+// FinishPasskeyRegistration stores the passkey the browser created.
+func (u Users) FinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var response struct {
+		Name              string `json:"name"`
+		ClientDataJSON    b64    `json:"clientDataJSON"`
+		AttestationObject b64    `json:"attestationObject"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&response)
+	if err != nil {
+		writeJSONError(w, errors.Public(err, "The passkey could not be read."))
+		return
+	}
+	pending, err := u.readWebAuthnCookie(r)
+	if err != nil || pending.UserID != user.ID {
+		writeJSONError(w, errors.Public(models.ErrInvalidCredential,
+			"Adding the passkey took too long. Please try again."))
+		return
+	}
+	deleteCookie(w, CookieWebAuthn)
+	if response.Name == "" {
+		response.Name = "Passkey"
+	}
+	_, err = u.WebAuthnService.Register(user.ID, response.Name, pending.Challenge,
+		response.ClientDataJSON, response.AttestationObject)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCredential) {
+			err = errors.Public(err, "The passkey could not be verified.")
+		}
+		writeJSONError(w, err)
+		return
+	}
+	writeJSON(w, map[string]string{"redirect": "/users/me/passkeys"})
+}
+
+func (u Users) DeletePasskey(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := strconv.Atoi(chi.URLParam(r, "passkeyID"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	err = u.WebAuthnService.Delete(user.ID, id)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me/passkeys", http.StatusFound)
+}
+
+// BeginPasskeySignIn returns the options for navigator.credentials.get().
+// No credentials are listed, so the browser offers every passkey the user
+// has for the site.
+func (u Users) BeginPasskeySignIn(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Remember bool `json:"remember"`
+	}
+	// the body is optional, without it the session isn't remembered
+	_ = json.NewDecoder(r.Body).Decode(&request)
+	challenge, err := u.WebAuthnService.NewChallenge()
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	err = u.setWebAuthnCookie(w, webAuthnCookie{
+		Challenge: challenge,
+		Remember:  request.Remember,
+	})
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	var options struct {
+		Challenge        b64                            `json:"challenge"`
+		RPID             string                         `json:"rpId"`
+		Timeout          int64                          `json:"timeout"`
+		UserVerification string                         `json:"userVerification"`
+		AllowCredentials []webAuthnCredentialDescriptor `json:"allowCredentials"`
+	}
+	options.Challenge = challenge
+	options.RPID = u.WebAuthnService.RPID
+	options.Timeout = webAuthnTimeout.Milliseconds()
+	options.UserVerification = "preferred"
+	options.AllowCredentials = []webAuthnCredentialDescriptor{}
+	writeJSON(w, options)
+}
+
+// FinishPasskeySignIn signs in the owner of the passkey. A passkey that
+// verified the user counts as two factors by itself, otherwise users with
+// two factor authentication still have to enter their code.
+func (u Users) FinishPasskeySignIn(w http.ResponseWriter, r *http.Request) {
+	var response struct {
+		ID                b64 `json:"id"`
+		ClientDataJSON    b64 `json:"clientDataJSON"`
+		AuthenticatorData b64 `json:"authenticatorData"`
+		Signature         b64 `json:"signature"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&response)
+	if err != nil {
+		writeJSONError(w, errors.Public(err, "The passkey could not be read."))
+		return
+	}
+	pending, err := u.readWebAuthnCookie(r)
+	if err != nil || pending.UserID != 0 {
+		writeJSONError(w, errors.Public(models.ErrInvalidCredential,
+			"Signing in took too long. Please try again."))
+		return
+	}
+	deleteCookie(w, CookieWebAuthn)
+	credential, err := u.WebAuthnService.Authenticate(pending.Challenge, response.ID,
+		response.ClientDataJSON, response.AuthenticatorData, response.Signature)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCredential) {
+			err = errors.Public(err, "That passkey could not be verified.")
+		}
+		writeJSONError(w, err)
+		return
+	}
+	next := "/users/me"
+	if credential.UserVerified {
+		err = u.signIn(w, r, credential.UserID, pending.Remember)
+	} else {
+		next, err = u.passwordSignedIn(w, r, credential.UserID, pending.Remember)
+	}
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	writeJSON(w, map[string]string{"redirect": next})
+}
+
+func (u Users) setWebAuthnCookie(w http.ResponseWriter, pending webAuthnCookie) error {
+	value, err := u.signInCodec().Encode(CookieWebAuthn, pending)
+	if err != nil {
+		return fmt.Errorf("set webauthn cookie: %w", err)
+	}
+	cookie := newCookie(CookieWebAuthn, value)
+	cookie.MaxAge = int(webAuthnTimeout.Seconds())
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+func (u Users) readWebAuthnCookie(r *http.Request) (webAuthnCookie, error) {
+	var pending webAuthnCookie
+	value, err := readCookie(r, CookieWebAuthn)
+	if err != nil {
+		return pending, err
+	}
+	err = u.signInCodec().Decode(CookieWebAuthn, value, &pending)
+	if err != nil {
+		return pending, fmt.Errorf("read webauthn cookie: %w", err)
+	}
+	return pending, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// writeJSONError responds with the public message of err, if it has one.
+// Other errors are logged and reported as a server error.
+func writeJSONError(w http.ResponseWriter, err error) {
+	var pubErr interface{ Public() string }
+	status := http.StatusBadRequest
+	msg := "Something went wrong."
+	if errors.As(err, &pubErr) {
+		msg = pubErr.Public()
+	} else {
+		fmt.Println(err)
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
@@ -0,0 +1,87 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+
+	"lenslocked/errors"
+	"lenslocked/models"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Profiles serves the public profile pages at /u/{username}.
+type Profiles struct {
+	Templates struct {
+		Show Template
+	}
+	ProfileService *models.ProfileService
+	GalleryService *models.GalleryService
+}
+
+// Show lists the public galleries of the user along with their display name,
+// bio and avatar.
+func (p Profiles) Show(w http.ResponseWriter, r *http.Request) {
+	profile, err := p.profile(w, r)
+	if err != nil {
+		return
+	}
+	galleries, err := p.GalleryService.ByUserID(profile.UserID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	var data struct {
+		Profile   *models.Profile
+		Galleries []models.Gallery
+	}
+	data.Profile = profile
+	for _, gallery := range galleries {
+		// galleries behind a password are only public to those who have it
+		if gallery.Visibility == models.VisibilityPublic && gallery.PasswordHash == "" {
+			data.Galleries = append(data.Galleries, gallery)
+		}
+	}
+	p.Templates.Show.Execute(w, r, data)
+}
+
+func (p Profiles) Avatar(w http.ResponseWriter, r *http.Request) {
+	profile, err := p.profile(w, r)
+	if err != nil {
+		return
+	}
+	serveAvatar(w, r, p.ProfileService, profile)
+}
+
+// profile looks up the profile of the username in the URL, and renders an
+// error if there is none.
+func (p Profiles) profile(w http.ResponseWriter, r *http.Request) (*models.Profile, error) {
+	profile, err := p.ProfileService.ByUsername(chi.URLParam(r, "username"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Profile not found", http.StatusNotFound)
+			return nil, err
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return nil, err
+	}
+	return profile, nil
+}
+
+func serveAvatar(w http.ResponseWriter, r *http.Request, profiles *models.ProfileService, profile *models.Profile) {
+	rc, modTime, err := profiles.OpenAvatar(profile)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Avatar not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+	serveContent(w, r, "avatar"+path.Ext(profile.AvatarKey), modTime, rc)
+}
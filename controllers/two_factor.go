@@ -0,0 +1,326 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"lenslocked/context"
+	"lenslocked/errors"
+	"lenslocked/models"
+
+	"github.com/gorilla/securecookie"
+)
+
+// twoFactorTimeout is how long users have to enter their code after they
+// entered the right password.
+const twoFactorTimeout = 5 * time.Minute
+
+// twoFactorCookie remembers who entered the right password while they are
+// asked for their second factor.
+type twoFactorCookie struct {
+	UserID   int
+	Remember bool
+}
+
+// completeSignIn signs in a user who entered the right password, unless they
+// have two factor authentication enabled. Those users are sent on to enter
+// their code first.
+func (u Users) completeSignIn(w http.ResponseWriter, r *http.Request, userID int, remember bool) {
+	next, err := u.passwordSignedIn(w, r, userID, remember)
+	if err != nil {
+		signInError(w, err)
+		return
+	}
+	http.Redirect(w, r, next, http.StatusFound)
+}
+
+// signInError responds to a sign in that failed after the user proved who
+// they are, which only happens for suspended accounts or when something went
+// wrong.
+func signInError(w http.ResponseWriter, err error) {
+	var pubErr interface{ Public() string }
+	if errors.As(err, &pubErr) {
+		http.Error(w, pubErr.Public(), http.StatusForbidden)
+		return
+	}
+	fmt.Println(err)
+	http.Error(w, "something went wrong", http.StatusInternalServerError)
+}
+
+// passwordSignedIn does the work of completeSignIn and returns where the
+// user should go next, for handlers that don't respond with a redirect.
+func (u Users) passwordSignedIn(w http.ResponseWriter, r *http.Request, userID int, remember bool) (string, error) {
+	enabled, err := u.TOTPService.Enabled(userID)
+	if err != nil {
+		return "", err
+	}
+	if enabled {
+		err = u.setTwoFactorCookie(w, twoFactorCookie{
+			UserID:   userID,
+			Remember: remember,
+		})
+		if err != nil {
+			return "", err
+		}
+		return "/signin/2fa", nil
+	}
+	err = u.signIn(w, r, userID, remember)
+	if err != nil {
+		return "", err
+	}
+	return "/users/me", nil
+}
+
+func (u Users) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	_, err := u.readTwoFactorCookie(r)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	u.Templates.TwoFactor.Execute(w, r, nil)
+}
+
+// ProcessTwoFactor finishes signing in with either a code from the user's
+// authenticator app or one of their recovery codes.
+func (u Users) ProcessTwoFactor(w http.ResponseWriter, r *http.Request) {
+	pending, err := u.readTwoFactorCookie(r)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	// counted before the code is checked, or the pending sign in would
+	// allow guessing codes for as long as it lasts
+	ip := clientIP(r)
+	wait, err := u.LoginThrottleService.AttemptTwoFactor(pending.UserID, ip)
+	if err != nil {
+		if errors.Is(err, models.ErrTooManyAttempts) || errors.Is(err, models.ErrAccountLocked) {
+			err = errors.Public(err, fmt.Sprintf("Too many invalid codes. Please try again in %s.", formatWait(wait)))
+			u.Templates.TwoFactor.Execute(w, r, nil, err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if code := r.FormValue("recovery_code"); code != "" {
+		err = u.TOTPService.UseRecoveryCode(pending.UserID, code)
+	} else {
+		err = u.TOTPService.Verify(pending.UserID, r.FormValue("code"))
+	}
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCode) {
+			err = errors.Public(err, "That code is invalid. Please try again.")
+			u.Templates.TwoFactor.Execute(w, r, nil, err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = u.LoginThrottleService.SucceedTwoFactor(pending.UserID, ip)
+	if err != nil {
+		// not worth failing the sign in over
+		fmt.Println(err)
+	}
+	deleteCookie(w, CookieTwoFactor)
+	err = u.signIn(w, r, pending.UserID, pending.Remember)
+	if err != nil {
+		signInError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+type twoFactorSettingsData struct {
+	Enabled           bool
+	RecoveryCodesLeft int
+	// Secret and URI are set while the user is adding the account to their
+	// authenticator app.
+	Secret string
+	URI    string
+	// RecoveryCodes are only set right after they are generated, they can't
+	// be shown again afterwards.
+	RecoveryCodes []string
+}
+
+func (u Users) TwoFactorSettings(w http.ResponseWriter, r *http.Request) {
+	u.renderTwoFactorSettings(w, r, twoFactorSettingsData{})
+}
+
+// renderTwoFactorSettings fills in whether two factor authentication is
+// enabled and renders the settings page.
+func (u Users) renderTwoFactorSettings(w http.ResponseWriter, r *http.Request, data twoFactorSettingsData, errs ...error) {
+	user := context.User(r.Context())
+	var err error
+	data.Enabled, err = u.TOTPService.Enabled(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if data.Enabled {
+		data.RecoveryCodesLeft, err = u.TOTPService.RecoveryCodesLeft(user.ID)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+	}
+	u.Templates.TwoFactorSettings.Execute(w, r, data, errs...)
+}
+
+func (u Users) EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	totp, err := u.TOTPService.Enroll(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	u.renderTwoFactorSettings(w, r, twoFactorSettingsData{
+		Secret: totp.Secret,
+		URI:    u.TOTPService.URI(totp, user.Email),
+	})
+}
+
+// ConfirmTwoFactor enables two factor authentication once the user entered
+// the first code from their app, and hands out their recovery codes.
+func (u Users) ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	err := u.TOTPService.Confirm(user.ID, r.FormValue("code"))
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCode) {
+			totp, err2 := u.TOTPService.ByUserID(user.ID)
+			if err2 != nil {
+				fmt.Println(err2)
+				http.Error(w, "something went wrong", http.StatusInternalServerError)
+				return
+			}
+			err = errors.Public(err, "That code is invalid. Please try again.")
+			u.renderTwoFactorSettings(w, r, twoFactorSettingsData{
+				Secret: totp.Secret,
+				URI:    u.TOTPService.URI(totp, user.Email),
+			}, err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	codes, err := u.TOTPService.GenerateRecoveryCodes(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	u.renderTwoFactorSettings(w, r, twoFactorSettingsData{
+		RecoveryCodes: codes,
+	})
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the user, which
+// takes a current code from their app.
+func (u Users) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	err := u.checkTwoFactorCode(r, user.ID, r.FormValue("code"))
+	if err != nil {
+		u.twoFactorCodeError(w, r, err)
+		return
+	}
+	codes, err := u.TOTPService.GenerateRecoveryCodes(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	u.renderTwoFactorSettings(w, r, twoFactorSettingsData{
+		RecoveryCodes: codes,
+	})
+}
+
+// DisableTwoFactor turns off two factor authentication, which takes a
+// current code from the user's app.
+func (u Users) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	err := u.checkTwoFactorCode(r, user.ID, r.FormValue("code"))
+	if err != nil {
+		u.twoFactorCodeError(w, r, err)
+		return
+	}
+	err = u.TOTPService.Disable(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me/2fa", http.StatusFound)
+}
+
+// checkTwoFactorCode verifies a code from the user's app before changes to
+// their two factor settings. The codes count towards the same limit as the
+// ones entered while signing in, or a stolen session could be used to guess
+// them. Errors about the code are errors.Public.
+func (u Users) checkTwoFactorCode(r *http.Request, userID int, code string) error {
+	ip := clientIP(r)
+	wait, err := u.LoginThrottleService.AttemptTwoFactor(userID, ip)
+	if err != nil {
+		if errors.Is(err, models.ErrTooManyAttempts) || errors.Is(err, models.ErrAccountLocked) {
+			return errors.Public(err, fmt.Sprintf("Too many invalid codes. Please try again in %s.", formatWait(wait)))
+		}
+		return err
+	}
+	err = u.TOTPService.Verify(userID, code)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCode) {
+			return errors.Public(err, "That code is invalid. Please try again.")
+		}
+		return err
+	}
+	err = u.LoginThrottleService.SucceedTwoFactor(userID, ip)
+	if err != nil {
+		// not worth failing the change over
+		fmt.Println(err)
+	}
+	return nil
+}
+
+func (u Users) twoFactorCodeError(w http.ResponseWriter, r *http.Request, err error) {
+	var pubErr interface{ Public() string }
+	if errors.As(err, &pubErr) {
+		u.renderTwoFactorSettings(w, r, twoFactorSettingsData{}, err)
+		return
+	}
+	fmt.Println(err)
+	http.Error(w, "something went wrong", http.StatusInternalServerError)
+}
+
+// signInCodec signs the short lived cookies used halfway through signing
+// in, for the two factor step and passkey challenges.
+func (u Users) signInCodec() *securecookie.SecureCookie {
+	return securecookie.New(u.TwoFactorKey, nil).MaxAge(int(twoFactorTimeout.Seconds()))
+}
+
+func (u Users) setTwoFactorCookie(w http.ResponseWriter, pending twoFactorCookie) error {
+	value, err := u.signInCodec().Encode(CookieTwoFactor, pending)
+	if err != nil {
+		return fmt.Errorf("set two factor cookie: %w", err)
+	}
+	cookie := newCookie(CookieTwoFactor, value)
+	cookie.MaxAge = int(twoFactorTimeout.Seconds())
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+func (u Users) readTwoFactorCookie(r *http.Request) (twoFactorCookie, error) {
+	var pending twoFactorCookie
+	value, err := readCookie(r, CookieTwoFactor)
+	if err != nil {
+		return pending, err
+	}
+	err = u.signInCodec().Decode(CookieTwoFactor, value, &pending)
+	if err != nil {
+		return pending, fmt.Errorf("read two factor cookie: %w", err)
+	}
+	return pending, nil
+}
@@ -11,20 +11,71 @@ import (
 
 type Users struct {
 	Templates struct {
+		// Account is the page at /users/me that links to every other
+		// setting.
+		Account        Template
 		New            Template
 		SignIn         Template
 		ForgotPassword Template
 		CheckYourEmail Template
 		ResetPassword  Template
+		VerifyEmail    Template
+		Devices        Template
+		// TwoFactor asks for the code during sign in, TwoFactorSettings
+		// is where users turn two factor authentication on and off.
+		TwoFactor         Template
+		TwoFactorSettings Template
+		Passkeys          Template
+		MagicLink         Template
+		Identities        Template
+		APITokens         Template
+		// ChangeEmail is the settings form, EmailChange where the links
+		// in the emails lead to.
+		ChangeEmail    Template
+		EmailChange    Template
+		ChangePassword Template
+		DeleteAccount  Template
 	}
-	UserService          *models.UserService
-	SessionService       *models.SessionService
-	PasswordResetService *models.PasswordResetService
-	EmailService         *models.EmailService
+	UserService              *models.UserService
+	SessionService           *models.SessionService
+	PasswordResetService     *models.PasswordResetService
+	EmailVerificationService *models.EmailVerificationService
+	TOTPService              *models.TOTPService
+	WebAuthnService          *models.WebAuthnService
+	MagicLinkService         *models.MagicLinkService
+	IdentityService          *models.IdentityService
+	APITokenService          *models.APITokenService
+	LoginThrottleService     *models.LoginThrottleService
+	EmailChangeService       *models.EmailChangeService
+	AccountService           *models.AccountService
+	ProfileService           *models.ProfileService
+	EmailService             *models.EmailService
+	// BaseURL is prepended to the links sent by email, eg
+	// "https://www.lenslocked.com".
+	BaseURL string
+	// TwoFactorKey signs the short lived cookies used while signing in: the
+	// one that remembers who entered the right password while they are asked
+	// for their two factor code, and passkey challenges.
+	TwoFactorKey []byte
+	// OIDCProvider is the external identity provider users can sign in
+	// with. Nil if none is configured.
+	OIDCProvider *models.OIDCProvider
 }
 
+// suspendedMessage is shown to suspended users trying to sign in, whichever
+// way they try.
+const suspendedMessage = "This account has been suspended. Please contact us if you think this is a mistake."
+
+// passwordResetRequiredMessage is shown to users who have to choose a new
+// password before they can sign in, whichever way they try.
+const passwordResetRequiredMessage = "Please choose a new password before you sign in. Follow the link we emailed you, or request a new one at /forgot-pw."
+
 type UserMiddleware struct {
-	SessionService *models.SessionService
+	SessionService  *models.SessionService
+	APITokenService *models.APITokenService
+	// UnverifiedActions are the actions users can take before they verify
+	// their email address. Defaults to DefaultUnverifiedActions.
+	UnverifiedActions []Action
 }
 
 func (u Users) New(w http.ResponseWriter, r *http.Request) {
@@ -37,32 +88,67 @@ func (u Users) New(w http.ResponseWriter, r *http.Request) {
 
 func (u Users) SignIn(w http.ResponseWriter, r *http.Request) {
 	var data struct {
-		Email string
+		Email    string
+		OIDCName string
 	}
 	data.Email = r.FormValue("email")
+	if u.OIDCProvider != nil {
+		data.OIDCName = u.OIDCProvider.Name
+	}
 	u.Templates.SignIn.Execute(w, r, data)
 }
 func (u Users) ProcessSignIn(w http.ResponseWriter, r *http.Request) {
 	var data struct {
 		Email    string
 		Password string
+		Remember bool
+		OIDCName string
 	}
 	data.Email = r.FormValue("email")
 	data.Password = r.FormValue("password")
+	data.Remember = r.FormValue("remember") != ""
+	if u.OIDCProvider != nil {
+		data.OIDCName = u.OIDCProvider.Name
+	}
+	ip := clientIP(r)
+	wait, err := u.LoginThrottleService.Attempt(data.Email, ip)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrAccountLocked):
+			err = errors.Public(err, "This account is locked after too many failed sign in attempts. Follow the link we emailed you to unlock it, or try again later.")
+		case errors.Is(err, models.ErrTooManyAttempts):
+			err = errors.Public(err, fmt.Sprintf("Too many failed sign in attempts. Please try again in %s.", formatWait(wait)))
+		default:
+			fmt.Println(err)
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+		u.Templates.SignIn.Execute(w, r, data, err)
+		return
+	}
 	user, err := u.UserService.Authenticate(data.Email, data.Password)
 	if err != nil {
+		if errors.Is(err, models.ErrInvalidLogin) {
+			u.signInFailed(data.Email)
+			err = errors.Public(err, "Invalid email address or password.")
+			u.Templates.SignIn.Execute(w, r, data, err)
+			return
+		}
 		fmt.Println(err)
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
-	session, err := u.SessionService.Create(user.ID)
+	err = u.LoginThrottleService.Succeed(data.Email, ip)
 	if err != nil {
+		// not worth failing the sign in over
 		fmt.Println(err)
-		http.Error(w, "something went wrong", http.StatusInternalServerError)
+	}
+	if user.Suspended() {
+		err = errors.Public(models.ErrAccountSuspended, suspendedMessage)
+		u.Templates.SignIn.Execute(w, r, data, err)
 		return
 	}
-	setCookie(w, CookieSession, session.Token)
-	http.Redirect(w, r, "/users/me", http.StatusFound)
+	u.completeSignIn(w, r, user.ID, data.Remember)
 }
 
 func (u Users) Create(w http.ResponseWriter, r *http.Request) {
@@ -80,39 +166,56 @@ func (u Users) Create(w http.ResponseWriter, r *http.Request) {
 		u.Templates.New.Execute(w, r, data, err)
 		return
 	}
-	session, err := u.SessionService.Create(user.ID)
+	err = u.sendVerification(user)
+	if err != nil {
+		// the user can ask for another link from the verify page
+		fmt.Println(err)
+	}
+	err = u.signIn(w, r, user.ID, false)
 	if err != nil {
 		fmt.Println(err)
 		// TODO: show a warning about not being able to sign a user in
 		http.Redirect(w, r, "/signin", http.StatusFound)
 		return
 	}
-	setCookie(w, CookieSession, session.Token)
-	http.Redirect(w, r, "/users/me", http.StatusFound)
+	http.Redirect(w, r, "/verify-email", http.StatusFound)
 }
 
-func (u Users) CurrentUser(w http.ResponseWriter, r *http.Request) {
+// signIn starts a new session for the user on the device the request came
+// from. Remember gives the session the longer "remember me" lifetime.
+func (u Users) signIn(w http.ResponseWriter, r *http.Request, userID int, remember bool) error {
+	session, err := u.SessionService.Create(userID, r.UserAgent(), clientIP(r), remember)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrAccountSuspended):
+			return errors.Public(err, suspendedMessage)
+		case errors.Is(err, models.ErrPasswordResetRequired):
+			return errors.Public(err, passwordResetRequiredMessage)
+		}
+		return fmt.Errorf("sign in: %w", err)
+	}
+	setSessionCookie(w, session.Token, session.ExpiresAt)
+	return nil
+}
 
+func (u Users) CurrentUser(w http.ResponseWriter, r *http.Request) {
 	user := context.User(r.Context())
-	fmt.Fprintf(w, "Current user: %s\n", user.Email)
-
-	// token, err := readCookie(r, CookieSession)
-	// if err != nil {
-	// 	fmt.Println(err)
-	// 	http.Redirect(w, r, "/signin", http.StatusFound)
-	// 	return
-	// }
-	// user, err := u.SessionService.User(token)
-	// if err != nil {
-	// 	fmt.Println(err)
-	// 	http.Redirect(w, r, "/signin", http.StatusFound)
-	// 	return
-	// }
-	// fmt.Fprintf(w, "current user: %s\n", user.Email)
+	profile, err := u.ProfileService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	u.renderAccount(w, r, profile)
 }
 
 func (umw UserMiddleware) SetUser(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if context.User(r.Context()) != nil {
+			// already signed in with an API token by SetTokenUser
+			next.ServeHTTP(w, r)
+			return
+		}
 		token, err := readCookie(r, CookieSession)
 		if err != nil {
 			// cannot lookup a user without cookie so proceed without
@@ -120,14 +223,26 @@ func (umw UserMiddleware) SetUser(next http.Handler) http.Handler {
 			next.ServeHTTP(w, r)
 			return
 		}
-		user, err := umw.SessionService.User(token)
+		session, user, err := umw.SessionService.Use(token)
 		if err != nil {
 			// invalid or expired token, in any case we can proceed
 			// we just cannot set a user
+			if errors.Is(err, models.ErrNotFound) {
+				deleteCookie(w, CookieSession)
+			}
 			next.ServeHTTP(w, r)
 			return
 		}
+		if session.Renewed {
+			// keep the cookie around for as long as the session lasts
+			setSessionCookie(w, token, session.ExpiresAt)
+		}
 		ctx := r.Context()
+		if session.Impersonating != nil {
+			// the admin sees the site as the user does
+			ctx = context.WithImpersonator(ctx, user)
+			user = session.Impersonating
+		}
 		ctx = context.WithUser(ctx, user)
 		r = r.WithContext(ctx)
 		next.ServeHTTP(w, r)
@@ -145,6 +260,23 @@ func (umw UserMiddleware) RequireUser(next http.Handler) http.Handler {
 	})
 }
 
+// RequireAdmin only lets admins through. Like RequireUser, it sends people
+// who aren't signed in to the sign in page.
+func (umw UserMiddleware) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		if user == nil {
+			http.Redirect(w, r, "/signin", http.StatusFound)
+			return
+		}
+		if !user.IsAdmin {
+			http.Error(w, "You don't have access to this page", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (u Users) ProcessSignOut(w http.ResponseWriter, r *http.Request) {
 	token, err := readCookie(r, CookieSession)
 	if err != nil {
@@ -184,8 +316,7 @@ func (u Users) ProcessForgotPassword(w http.ResponseWriter, r *http.Request) {
 	vals := url.Values{
 		"token": {pwReset.Token},
 	}
-	// TODO: make the url configurable
-	resetURL := "https//www.lenslocked.com/reset-pw?" + vals.Encode()
+	resetURL := u.BaseURL + "/reset-pw?" + vals.Encode()
 	err = u.EmailService.ForgotPassword(data.Email, resetURL)
 	if err != nil {
 		fmt.Println(err)
@@ -211,6 +342,14 @@ func (u Users) ProcessResetPassword(w http.ResponseWriter, r *http.Request) {
 	data.Token = r.FormValue("token")
 	data.Password = r.FormValue("password")
 
+	// check the password before the token is used up, so users can pick
+	// another one
+	err := u.UserService.CheckPassword(data.Password)
+	if err != nil {
+		u.Templates.ResetPassword.Execute(w, r, data, err)
+		return
+	}
+
 	user, err := u.PasswordResetService.Consume(data.Token)
 	if err != nil {
 		fmt.Println(err)
@@ -221,17 +360,27 @@ func (u Users) ProcessResetPassword(w http.ResponseWriter, r *http.Request) {
 
 	err = u.UserService.UpdatePassword(user.ID, data.Password)
 	if err != nil {
+		var pubErr interface{ Public() string }
+		if errors.As(err, &pubErr) {
+			// the password contains the user's details, which the check
+			// above didn't know about. The token is gone, so they need a
+			// new link.
+			u.Templates.ForgotPassword.Execute(w, r, struct{ Email string }{user.Email}, err)
+			return
+		}
 		fmt.Println(err)
 		http.Error(w, "something went wrong", http.StatusInternalServerError)
 		return
 	}
 
-	session, err := u.SessionService.Create(user.ID)
+	// whoever else had the old password shouldn't stay signed in
+	err = u.SessionService.DeleteAll(user.ID)
 	if err != nil {
 		fmt.Println(err)
-		http.Redirect(w, r, "/signin", http.StatusFound)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
 		return
 	}
-	setCookie(w, CookieSession, session.Token)
-	http.Redirect(w, r, "/users/me", http.StatusFound)
+
+	// a reset password doesn't get anyone past two factor authentication
+	u.completeSignIn(w, r, user.ID, false)
 }
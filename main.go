@@ -3,8 +3,11 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"lenslocked/controllers"
 	"lenslocked/migrations"
@@ -14,6 +17,7 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/gorilla/csrf"
+	"github.com/gorilla/securecookie"
 	"github.com/joho/godotenv"
 )
 
@@ -26,7 +30,59 @@ type config struct {
 	}
 	Server struct {
 		Address string
+		// BaseURL is where the server can be reached, used for the links
+		// in emails.
+		BaseURL string
 	}
+	Sessions struct {
+		Duration            time.Duration
+		IdleTimeout         time.Duration
+		RememberDuration    time.Duration
+		RememberIdleTimeout time.Duration
+		// ImpersonationDuration is how long admins can impersonate a user
+		// at a time.
+		ImpersonationDuration time.Duration
+	}
+	Users struct {
+		// TwoFactorKey signs the cookie of users halfway through signing
+		// in with two factor authentication.
+		TwoFactorKey []byte
+		// UnverifiedActions are what users can do before they verify their
+		// email address. Nil means controllers.DefaultUnverifiedActions.
+		UnverifiedActions []controllers.Action
+		// PasswordPolicy is what passwords users can choose.
+		PasswordPolicy models.PasswordPolicy
+		// PasswordHasher hashes their passwords, picked with the
+		// PASSWORD_HASHER env variable.
+		PasswordHasher models.PasswordHasher
+		// DeletionGracePeriod is how long deleted accounts are kept around
+		// in case users change their mind.
+		DeletionGracePeriod time.Duration
+	}
+	// OIDC is the external identity provider users can sign in with. It is
+	// only enabled when an issuer is set.
+	OIDC struct {
+		Name         string
+		Issuer       string
+		ClientID     string
+		ClientSecret string
+	}
+	Galleries struct {
+		// UnlockKey signs the cookies of unlocked password protected
+		// galleries.
+		UnlockKey      []byte
+		UnlockDuration time.Duration
+	}
+	Images struct {
+		// ExifStripTags are removed from publicly served images.
+		ExifStripTags []uint16
+	}
+	// Storage is the backend that holds uploaded images, picked with the
+	// STORAGE_BACKEND env variable.
+	Storage models.Storage
+	// Env is "dev", "test" or "production", from the APP_ENV env variable.
+	// Anything unset or unknown counts as production.
+	Env string
 }
 
 func loadEnvConfig() (config, error) {
@@ -38,6 +94,177 @@ func loadEnvConfig() (config, error) {
 	// TODO: read psql values from an ENV variable
 	cfg.PSQL = models.DefaultPostgresConfig()
 
+	cfg.Env = os.Getenv("APP_ENV")
+	switch cfg.Env {
+	case "dev", "test", "production":
+	default:
+		cfg.Env = "production"
+	}
+
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "local":
+		cfg.Storage = &models.LocalStorage{
+			Dir: os.Getenv("STORAGE_LOCAL_DIR"),
+		}
+	case "memory":
+		// uploads would be gone after every restart
+		if cfg.Env == "production" {
+			return cfg, fmt.Errorf("memory storage is only for APP_ENV dev or test")
+		}
+		cfg.Storage = &models.MemoryStorage{}
+	case "s3":
+		cfg.Storage = &models.S3Storage{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+		}
+	default:
+		return cfg, fmt.Errorf("unknown storage backend: %q", backend)
+	}
+
+	cfg.Galleries.UnlockKey = []byte(os.Getenv("GALLERY_UNLOCK_KEY"))
+	if len(cfg.Galleries.UnlockKey) == 0 {
+		// without a configured key unlocked galleries lock again whenever
+		// the server restarts
+		cfg.Galleries.UnlockKey = securecookie.GenerateRandomKey(32)
+	}
+	if duration := os.Getenv("GALLERY_UNLOCK_DURATION"); duration != "" {
+		cfg.Galleries.UnlockDuration, err = time.ParseDuration(duration)
+		if err != nil {
+			return cfg, fmt.Errorf("gallery unlock duration: %w", err)
+		}
+	}
+
+	if tagNames := os.Getenv("EXIF_STRIP_TAGS"); tagNames != "" {
+		for _, name := range strings.Split(tagNames, ",") {
+			tag, ok := models.ExifTagNames[strings.TrimSpace(name)]
+			if !ok {
+				return cfg, fmt.Errorf("unknown exif tag: %q", name)
+			}
+			cfg.Images.ExifStripTags = append(cfg.Images.ExifStripTags, tag)
+		}
+	}
+
+	sessionDurations := []struct {
+		env string
+		dst *time.Duration
+	}{
+		{"SESSION_DURATION", &cfg.Sessions.Duration},
+		{"SESSION_IDLE_TIMEOUT", &cfg.Sessions.IdleTimeout},
+		{"SESSION_REMEMBER_DURATION", &cfg.Sessions.RememberDuration},
+		{"SESSION_REMEMBER_IDLE_TIMEOUT", &cfg.Sessions.RememberIdleTimeout},
+		{"SESSION_IMPERSONATION_DURATION", &cfg.Sessions.ImpersonationDuration},
+	}
+	for _, d := range sessionDurations {
+		if value := os.Getenv(d.env); value != "" {
+			*d.dst, err = time.ParseDuration(value)
+			if err != nil {
+				return cfg, fmt.Errorf("%s: %w", strings.ToLower(d.env), err)
+			}
+		}
+	}
+
+	if grace := os.Getenv("ACCOUNT_DELETION_GRACE_PERIOD"); grace != "" {
+		cfg.Users.DeletionGracePeriod, err = time.ParseDuration(grace)
+		if err != nil {
+			return cfg, fmt.Errorf("account deletion grace period: %w", err)
+		}
+	}
+
+	cfg.Users.TwoFactorKey = []byte(os.Getenv("TWO_FACTOR_KEY"))
+	if len(cfg.Users.TwoFactorKey) == 0 {
+		// without a configured key sign ins waiting for a code have to
+		// start over when the server restarts
+		cfg.Users.TwoFactorKey = securecookie.GenerateRandomKey(32)
+	}
+
+	cfg.Server.BaseURL = strings.TrimSuffix(os.Getenv("SERVER_BASE_URL"), "/")
+	if cfg.Server.BaseURL == "" {
+		cfg.Server.BaseURL = "http://localhost:3000"
+	}
+
+	switch actions := os.Getenv("UNVERIFIED_ACTIONS"); actions {
+	case "":
+	case "none":
+		cfg.Users.UnverifiedActions = []controllers.Action{}
+	default:
+		for _, name := range strings.Split(actions, ",") {
+			action := controllers.Action(strings.TrimSpace(name))
+			if !action.Valid() {
+				return cfg, fmt.Errorf("unknown action: %q", name)
+			}
+			cfg.Users.UnverifiedActions = append(cfg.Users.UnverifiedActions, action)
+		}
+	}
+
+	passwordInts := []struct {
+		env string
+		dst *int
+	}{
+		{"PASSWORD_MIN_LENGTH", &cfg.Users.PasswordPolicy.MinLength},
+		{"PASSWORD_MAX_LENGTH", &cfg.Users.PasswordPolicy.MaxLength},
+		{"PASSWORD_MIN_SCORE", &cfg.Users.PasswordPolicy.MinScore},
+	}
+	for _, p := range passwordInts {
+		if value := os.Getenv(p.env); value != "" {
+			*p.dst, err = strconv.Atoi(value)
+			if err != nil {
+				return cfg, fmt.Errorf("%s: %w", strings.ToLower(p.env), err)
+			}
+		}
+	}
+	cfg.Users.PasswordPolicy.BreachedDir = os.Getenv("PASSWORD_BREACHED_DIR")
+
+	switch hasher := os.Getenv("PASSWORD_HASHER"); hasher {
+	case "", "bcrypt":
+		var h models.BcryptHasher
+		if cost := os.Getenv("BCRYPT_COST"); cost != "" {
+			h.Cost, err = strconv.Atoi(cost)
+			if err != nil {
+				return cfg, fmt.Errorf("bcrypt cost: %w", err)
+			}
+		}
+		cfg.Users.PasswordHasher = h
+	case "argon2id":
+		var h models.Argon2idHasher
+		argon2Params := []struct {
+			env string
+			dst *uint32
+		}{
+			{"ARGON2_MEMORY", &h.Memory},
+			{"ARGON2_TIME", &h.Time},
+		}
+		for _, p := range argon2Params {
+			if value := os.Getenv(p.env); value != "" {
+				n, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					return cfg, fmt.Errorf("%s: %w", strings.ToLower(p.env), err)
+				}
+				*p.dst = uint32(n)
+			}
+		}
+		if threads := os.Getenv("ARGON2_THREADS"); threads != "" {
+			n, err := strconv.ParseUint(threads, 10, 8)
+			if err != nil {
+				return cfg, fmt.Errorf("argon2 threads: %w", err)
+			}
+			h.Threads = uint8(n)
+		}
+		cfg.Users.PasswordHasher = h
+	default:
+		return cfg, fmt.Errorf("unknown password hasher: %q", hasher)
+	}
+
+	cfg.OIDC.Issuer = os.Getenv("OIDC_ISSUER")
+	cfg.OIDC.ClientID = os.Getenv("OIDC_CLIENT_ID")
+	cfg.OIDC.ClientSecret = os.Getenv("OIDC_CLIENT_SECRET")
+	cfg.OIDC.Name = os.Getenv("OIDC_NAME")
+	if cfg.OIDC.Name == "" {
+		cfg.OIDC.Name = "Single sign-on"
+	}
+
 	cfg.SMTP.Host = os.Getenv("SMTP_HOST")
 	portStr := os.Getenv("SMTP_PORT")
 	cfg.SMTP.Port, err = strconv.Atoi(portStr)
@@ -78,10 +305,21 @@ func main() {
 	}
 	// setup model services
 	userService := &models.UserService{
+		DB:             db,
+		PasswordPolicy: cfg.Users.PasswordPolicy,
+		Hasher:         cfg.Users.PasswordHasher,
+	}
+	auditLogService := &models.AuditLogService{
 		DB: db,
 	}
 	sessionService := &models.SessionService{
-		DB: db,
+		DB:                    db,
+		Duration:              cfg.Sessions.Duration,
+		IdleTimeout:           cfg.Sessions.IdleTimeout,
+		RememberDuration:      cfg.Sessions.RememberDuration,
+		RememberIdleTimeout:   cfg.Sessions.RememberIdleTimeout,
+		ImpersonationDuration: cfg.Sessions.ImpersonationDuration,
+		AuditLogService:       auditLogService,
 	}
 	pwResetService := &models.PasswordResetService{
 		DB: db,
@@ -89,11 +327,83 @@ func main() {
 	galleryService := &models.GalleryService{
 		DB: db,
 	}
+	imageService := &models.ImageService{
+		Storage:       cfg.Storage,
+		ExifStripTags: cfg.Images.ExifStripTags,
+	}
+	imageMetadataService := &models.ImageMetadataService{
+		DB: db,
+	}
+	shareService := &models.ShareService{
+		DB: db,
+	}
+	galleryMemberService := &models.GalleryMemberService{
+		DB: db,
+	}
+	emailVerificationService := &models.EmailVerificationService{
+		DB: db,
+	}
+	totpService := &models.TOTPService{
+		DB: db,
+	}
+	baseURL, err := url.Parse(cfg.Server.BaseURL)
+	if err != nil {
+		panic(err)
+	}
+	webAuthnService := &models.WebAuthnService{
+		DB:     db,
+		RPID:   baseURL.Hostname(),
+		RPName: "Lenslocked",
+		Origin: cfg.Server.BaseURL,
+	}
+	magicLinkService := &models.MagicLinkService{
+		DB: db,
+	}
+	identityService := &models.IdentityService{
+		DB: db,
+	}
+	apiTokenService := &models.APITokenService{
+		DB: db,
+	}
+	loginThrottleService := &models.LoginThrottleService{
+		DB: db,
+	}
+	emailChangeService := &models.EmailChangeService{
+		DB: db,
+	}
+	profileService := &models.ProfileService{
+		DB:      db,
+		Storage: cfg.Storage,
+	}
+	accountService := &models.AccountService{
+		DB:                  db,
+		GalleryService:      galleryService,
+		ImageService:        imageService,
+		SessionService:      sessionService,
+		ProfileService:      profileService,
+		DeletionGracePeriod: cfg.Users.DeletionGracePeriod,
+	}
+	adminService := &models.AdminService{
+		DB:             db,
+		SessionService: sessionService,
+	}
+	var oidcProvider *models.OIDCProvider
+	if cfg.OIDC.Issuer != "" {
+		oidcProvider = &models.OIDCProvider{
+			Name:         cfg.OIDC.Name,
+			Issuer:       cfg.OIDC.Issuer,
+			ClientID:     cfg.OIDC.ClientID,
+			ClientSecret: cfg.OIDC.ClientSecret,
+			RedirectURL:  cfg.Server.BaseURL + "/signin/oidc/callback",
+		}
+	}
 	emailService := models.NewEmailService(cfg.SMTP)
 
 	// setup middlewares
 	umw := controllers.UserMiddleware{
-		SessionService: sessionService,
+		SessionService:    sessionService,
+		APITokenService:   apiTokenService,
+		UnverifiedActions: cfg.Users.UnverifiedActions,
 	}
 	// setup csrf protection
 	csrfMw := csrf.Protect(
@@ -105,38 +415,111 @@ func main() {
 
 	// setup controllers
 	usersC := controllers.Users{
-		UserService:          userService,
+		UserService:              userService,
+		SessionService:           sessionService,
+		PasswordResetService:     pwResetService,
+		EmailVerificationService: emailVerificationService,
+		TOTPService:              totpService,
+		WebAuthnService:          webAuthnService,
+		MagicLinkService:         magicLinkService,
+		IdentityService:          identityService,
+		APITokenService:          apiTokenService,
+		LoginThrottleService:     loginThrottleService,
+		EmailChangeService:       emailChangeService,
+		AccountService:           accountService,
+		ProfileService:           profileService,
+		EmailService:             emailService,
+		BaseURL:                  cfg.Server.BaseURL,
+		TwoFactorKey:             cfg.Users.TwoFactorKey,
+		OIDCProvider:             oidcProvider,
+	}
+	galleriesC := controllers.Galleries{
+		GalleryService:       galleryService,
+		ImageService:         imageService,
+		ImageMetadataService: imageMetadataService,
+		ShareService:         shareService,
+		GalleryMemberService: galleryMemberService,
+		LoginThrottleService: loginThrottleService,
+		UnlockKey:            cfg.Galleries.UnlockKey,
+		UnlockDuration:       cfg.Galleries.UnlockDuration,
+		UnverifiedActions:    cfg.Users.UnverifiedActions,
+	}
+	adminC := controllers.Admin{
+		AdminService:         adminService,
+		AuditLogService:      auditLogService,
+		GalleryService:       galleryService,
 		SessionService:       sessionService,
 		PasswordResetService: pwResetService,
 		EmailService:         emailService,
+		BaseURL:              cfg.Server.BaseURL,
 	}
-	galleriesC := controllers.Galleries{
+	profilesC := controllers.Profiles{
+		ProfileService: profileService,
 		GalleryService: galleryService,
 	}
+	usersC.Templates.Account = (views.Must(views.ParseFS(
+		templates.FS, "users/account.gohtml", "tailwind.gohtml")))
 	usersC.Templates.New = (views.Must(
 		views.ParseFS(templates.FS, "signup.gohtml", "tailwind.gohtml")))
-	usersC.Templates.SignIn = (views.Must(
-		views.ParseFS(templates.FS, "signin.gohtml", "tailwind.gohtml")))
+	usersC.Templates.SignIn = (views.Must(views.ParseFS(
+		templates.FS, "signin.gohtml", "webauthn.gohtml", "tailwind.gohtml")))
 	usersC.Templates.ForgotPassword = (views.Must(
 		views.ParseFS(templates.FS, "forgot-pw.gohtml", "tailwind.gohtml")))
 	usersC.Templates.CheckYourEmail = (views.Must(
 		views.ParseFS(templates.FS, "check-your-email.gohtml", "tailwind.gohtml")))
 	usersC.Templates.ResetPassword = (views.Must(views.ParseFS(
 		templates.FS, "reset-pw.gohtml", "tailwind.gohtml")))
+	usersC.Templates.VerifyEmail = (views.Must(views.ParseFS(
+		templates.FS, "verify-email.gohtml", "tailwind.gohtml")))
+	usersC.Templates.Devices = (views.Must(views.ParseFS(
+		templates.FS, "users/devices.gohtml", "tailwind.gohtml")))
+	usersC.Templates.TwoFactor = (views.Must(views.ParseFS(
+		templates.FS, "signin-2fa.gohtml", "tailwind.gohtml")))
+	usersC.Templates.TwoFactorSettings = (views.Must(views.ParseFS(
+		templates.FS, "users/two-factor.gohtml", "tailwind.gohtml")))
+	usersC.Templates.MagicLink = (views.Must(views.ParseFS(
+		templates.FS, "signin-link.gohtml", "tailwind.gohtml")))
+	usersC.Templates.Passkeys = (views.Must(views.ParseFS(
+		templates.FS, "users/passkeys.gohtml", "webauthn.gohtml", "tailwind.gohtml")))
+	usersC.Templates.Identities = (views.Must(views.ParseFS(
+		templates.FS, "users/identities.gohtml", "tailwind.gohtml")))
+	usersC.Templates.APITokens = (views.Must(views.ParseFS(
+		templates.FS, "users/api-tokens.gohtml", "tailwind.gohtml")))
+	usersC.Templates.ChangeEmail = (views.Must(views.ParseFS(
+		templates.FS, "users/email.gohtml", "tailwind.gohtml")))
+	usersC.Templates.EmailChange = (views.Must(views.ParseFS(
+		templates.FS, "email-change.gohtml", "tailwind.gohtml")))
+	usersC.Templates.ChangePassword = (views.Must(views.ParseFS(
+		templates.FS, "users/password.gohtml", "tailwind.gohtml")))
+	usersC.Templates.DeleteAccount = (views.Must(views.ParseFS(
+		templates.FS, "users/delete.gohtml", "tailwind.gohtml")))
 	galleriesC.Templates.New = (views.Must(views.ParseFS(
 		templates.FS, "galleries/new.gohtml", "tailwind.gohtml")))
-	galleriesC.Templates.New = (views.Must(views.ParseFS(
+	galleriesC.Templates.Edit = (views.Must(views.ParseFS(
 		templates.FS, "galleries/edit.gohtml", "tailwind.gohtml")))
 	galleriesC.Templates.Index = (views.Must(views.ParseFS(
 		templates.FS, "galleries/index.gohtml", "tailwind.gohtml")))
 	galleriesC.Templates.Show = (views.Must(views.ParseFS(
 		templates.FS, "galleries/show.gohtml", "tailwind.gohtml")))
+	galleriesC.Templates.Image = (views.Must(views.ParseFS(
+		templates.FS, "galleries/image.gohtml", "tailwind.gohtml")))
+	galleriesC.Templates.Unlock = (views.Must(views.ParseFS(
+		templates.FS, "galleries/unlock.gohtml", "tailwind.gohtml")))
+	profilesC.Templates.Show = (views.Must(views.ParseFS(
+		templates.FS, "profiles/show.gohtml", "tailwind.gohtml")))
+	adminC.Templates.Dashboard = (views.Must(views.ParseFS(
+		templates.FS, "admin/dashboard.gohtml", "admin/audit.gohtml", "tailwind.gohtml")))
+	adminC.Templates.User = (views.Must(views.ParseFS(
+		templates.FS, "admin/user.gohtml", "admin/audit.gohtml", "tailwind.gohtml")))
 
 	// setup router
 	r := chi.NewRouter()
-	// these middlewares are used everywhere
+	// these middlewares are used everywhere, API tokens have to be checked
+	// before csrf protection as requests made with them are exempt
+	r.Use(umw.SetTokenUser)
 	r.Use(csrfMw)
 	r.Use(umw.SetUser)
+	r.Use(umw.RejectImpersonation)
 
 	// now we setup routes
 	r.Get("/", controllers.StaticHandler(views.Must(
@@ -150,31 +533,143 @@ func main() {
 	r.Get("/signin", usersC.SignIn)
 	r.Route("/users/me", func(r chi.Router) {
 		r.Use(umw.RequireUser)
+		r.Use(umw.RejectAPITokens)
 		r.Get("/", usersC.CurrentUser)
+		r.Post("/profile", usersC.UpdateProfile)
+		r.Get("/avatar", usersC.Avatar)
+		r.Post("/avatar", usersC.UploadAvatar)
+		r.Post("/avatar/delete", usersC.DeleteAvatar)
+		r.Get("/devices", usersC.Devices)
+		r.Post("/devices/{sessionID}/revoke", usersC.RevokeDevice)
+		r.Post("/devices/signout", usersC.SignOutEverywhere)
+		r.Get("/2fa", usersC.TwoFactorSettings)
+		r.Post("/2fa/enroll", usersC.EnrollTwoFactor)
+		r.Post("/2fa/confirm", usersC.ConfirmTwoFactor)
+		r.Post("/2fa/recovery-codes", usersC.RegenerateRecoveryCodes)
+		r.Post("/2fa/disable", usersC.DisableTwoFactor)
+		r.Get("/passkeys", usersC.Passkeys)
+		r.Post("/passkeys/begin", usersC.BeginPasskeyRegistration)
+		r.Post("/passkeys/finish", usersC.FinishPasskeyRegistration)
+		r.Post("/passkeys/{passkeyID}/delete", usersC.DeletePasskey)
+		r.Get("/identities", usersC.Identities)
+		r.Post("/identities/link", usersC.LinkIdentity)
+		r.Post("/identities/{identityID}/unlink", usersC.UnlinkIdentity)
+		r.Get("/email", usersC.ChangeEmail)
+		r.Post("/email", usersC.ProcessChangeEmail)
+		r.Get("/password", usersC.ChangePassword)
+		r.Post("/password", usersC.ProcessChangePassword)
+		r.With(umw.ForbidImpersonation).Get("/export", usersC.ExportData)
+		r.Get("/delete", usersC.DeleteAccount)
+		r.Post("/delete", usersC.ProcessDeleteAccount)
+		r.Post("/delete/cancel", usersC.CancelDeleteAccount)
+		r.Get("/tokens", usersC.APITokens)
+		r.Post("/tokens", usersC.CreateAPIToken)
+		r.Post("/tokens/{tokenID}/delete", usersC.DeleteAPIToken)
 	})
 	r.Get("/forgot-pw", usersC.ForgotPassword)
 	r.Get("/reset-pw", usersC.ResetPassword)
+	r.Get("/verify-email", usersC.VerifyEmail)
+	r.Post("/verify-email", usersC.ProcessVerifyEmail)
+	r.Get("/email-change/confirm", usersC.EmailChange)
+	r.Post("/email-change/confirm", usersC.ConfirmEmailChange)
+	r.Get("/email-change/revert", usersC.RevertEmailChange)
+	r.Post("/email-change/revert", usersC.ProcessRevertEmailChange)
+	r.With(umw.RequireUser, umw.RejectAPITokens).Post("/verify-email/resend", usersC.ResendVerification)
 	r.Route("/galleries", func(r chi.Router) {
 		r.Get("/{id}", galleriesC.Show)
+		r.Get("/{id}/images/{filename}", galleriesC.Image)
+		r.Get("/{id}/images/{filename}/details", galleriesC.ImageDetails)
+		r.Post("/{id}/unlock", galleriesC.Unlock)
 		r.Group(func(r chi.Router) {
 			r.Use(umw.RequireUser)
 			r.Get("/", galleriesC.Index)
-			r.Get("/new", galleriesC.New)
-			r.Post("/", galleriesC.Create)
-			r.Get("/{id}/edit", galleriesC.Edit)
-			r.Post("/{id}", galleriesC.Update)
-			r.Post("/{id}/delete", galleriesC.Delete)
+			r.With(umw.RequireVerified(controllers.ActionCreateGallery),
+				umw.RequireScope(controllers.ActionCreateGallery)).Group(func(r chi.Router) {
+				r.Get("/new", galleriesC.New)
+				r.Post("/", galleriesC.Create)
+			})
+			r.With(umw.RequireVerified(controllers.ActionEditGallery),
+				umw.RequireScope(controllers.ActionEditGallery)).Group(func(r chi.Router) {
+				r.Get("/{id}/edit", galleriesC.Edit)
+				r.Post("/{id}", galleriesC.Update)
+				r.Post("/{id}/password", galleriesC.UpdatePassword)
+			})
+			r.With(umw.RequireVerified(controllers.ActionDeleteGallery),
+				umw.RequireScope(controllers.ActionDeleteGallery)).Group(func(r chi.Router) {
+				r.Post("/{id}/delete", galleriesC.Delete)
+				r.Post("/{id}/images/{filename}/delete", galleriesC.DeleteImage)
+			})
+			r.With(umw.RequireVerified(controllers.ActionUploadImages),
+				umw.RequireScope(controllers.ActionUploadImages)).
+				Post("/{id}/images", galleriesC.UploadImage)
+			r.With(umw.RequireVerified(controllers.ActionShareGallery),
+				umw.RequireScope(controllers.ActionShareGallery)).Group(func(r chi.Router) {
+				r.Post("/{id}/shares", galleriesC.CreateShare)
+				r.Post("/{id}/shares/{shareID}/revoke", galleriesC.RevokeShare)
+				r.Post("/{id}/members", galleriesC.AddMember)
+				r.Post("/{id}/members/{memberID}/remove", galleriesC.RemoveMember)
+			})
 		})
 	})
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(umw.RejectAPITokens, umw.RequireAdmin)
+		r.Get("/", adminC.Dashboard)
+		r.Get("/users/{id}", adminC.User)
+		r.Post("/users/{id}/suspend", adminC.Suspend)
+		r.Post("/users/{id}/unsuspend", adminC.Unsuspend)
+		r.Post("/users/{id}/reset-password", adminC.ForcePasswordReset)
+		r.Post("/users/{id}/grant-admin", adminC.GrantAdmin)
+		r.Post("/users/{id}/revoke-admin", adminC.RevokeAdmin)
+		r.Post("/users/{id}/impersonate", adminC.Impersonate)
+	})
+	r.Post("/impersonate/stop", adminC.StopImpersonating)
+	r.Get("/u/{username}", profilesC.Show)
+	r.Get("/u/{username}/avatar", profilesC.Avatar)
+	r.Route("/g/{token}", func(r chi.Router) {
+		r.Get("/", galleriesC.Show)
+		r.Get("/images/{filename}", galleriesC.Image)
+		r.Get("/images/{filename}/details", galleriesC.ImageDetails)
+		r.Post("/unlock", galleriesC.Unlock)
+	})
+	r.Route("/s/{share}", func(r chi.Router) {
+		r.Get("/", galleriesC.Show)
+		r.Get("/images/{filename}", galleriesC.Image)
+		r.Get("/images/{filename}/details", galleriesC.ImageDetails)
+		r.Post("/unlock", galleriesC.Unlock)
+	})
 	r.Post("/reset-pw", usersC.ProcessResetPassword)
 	r.Post("/signup", usersC.Create)
 	r.Post("/signin", usersC.ProcessSignIn)
+	r.Get("/signin/2fa", usersC.TwoFactor)
+	r.Post("/signin/2fa", usersC.ProcessTwoFactor)
+	r.Post("/signin/passkey/begin", usersC.BeginPasskeySignIn)
+	r.Post("/signin/passkey/finish", usersC.FinishPasskeySignIn)
+	r.Get("/signin/link", usersC.MagicLink)
+	r.Post("/signin/link", usersC.ProcessMagicLink)
+	r.Get("/signin/link/confirm", usersC.ConfirmMagicLink)
+	r.Post("/signin/link/confirm", usersC.ProcessConfirmMagicLink)
+	r.With(umw.ForbidImpersonation).Get("/signin/unlock", usersC.UnlockAccount)
+	r.With(umw.ForbidImpersonation).Get("/signin/oidc", usersC.OIDCSignIn)
+	r.With(umw.ForbidImpersonation).Get("/signin/oidc/callback", usersC.OIDCCallback)
 	r.Post("/signout", usersC.ProcessSignOut)
 	r.Post("/forgot-pw", usersC.ProcessForgotPassword)
 	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Page not found", http.StatusNotFound)
 	})
 
+	// delete the accounts whose grace period is over every now and then
+	go func() {
+		for {
+			n, err := accountService.PurgeDeleted()
+			if err != nil {
+				fmt.Println(err)
+			} else if n > 0 {
+				fmt.Printf("Deleted %d accounts\n", n)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+
 	// start the server
 	fmt.Printf("Starting the server on %s...\n", cfg.Server.Address)
 	err = http.ListenAndServe(cfg.Server.Address, r)
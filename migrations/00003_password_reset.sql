@@ -3,7 +3,7 @@
 CREATE TABLE password_resets (
     id SERIAL PRIMARY KEY,
     user_id INT UNIQUE REFERENCES users (id) ON DELETE CASCADE,
-    token_hash UNIQUE NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
     expires_at TIMESTAMPTZ NOT NULL
 );
 -- +goose StatementEnd
@@ -3,7 +3,7 @@
 CREATE TABLE galleries(
 id SERIAL PRIMARY KEY,
 user_id INTEGER REFERENCES users (id),
-title TEXT,
+title TEXT
 );
 -- +goose StatementEnd
 
@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE image_metadata (
+    id SERIAL PRIMARY KEY,
+    gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+    filename TEXT NOT NULL,
+    camera_make TEXT NOT NULL DEFAULT '',
+    camera_model TEXT NOT NULL DEFAULT '',
+    lens_model TEXT NOT NULL DEFAULT '',
+    exposure_time TEXT NOT NULL DEFAULT '',
+    f_number DOUBLE PRECISION NOT NULL DEFAULT 0,
+    iso INT NOT NULL DEFAULT 0,
+    focal_length DOUBLE PRECISION NOT NULL DEFAULT 0,
+    taken_at TIMESTAMPTZ,
+    has_gps BOOLEAN NOT NULL DEFAULT FALSE,
+    UNIQUE (gallery_id, filename)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE image_metadata;
+-- +goose StatementEnd
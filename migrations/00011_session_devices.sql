@@ -0,0 +1,30 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE sessions
+    DROP CONSTRAINT sessions_user_id_key,
+    ALTER COLUMN user_id SET NOT NULL,
+    ADD COLUMN user_agent TEXT NOT NULL DEFAULT '',
+    ADD COLUMN ip_address TEXT NOT NULL DEFAULT '',
+    ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    ADD COLUMN last_seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+CREATE INDEX sessions_user_id_idx ON sessions (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX sessions_user_id_idx;
+-- only the most recent session of each user survives
+DELETE FROM sessions
+WHERE id NOT IN (
+    SELECT DISTINCT ON (user_id) id
+    FROM sessions
+    ORDER BY user_id, last_seen_at DESC
+);
+ALTER TABLE sessions
+    DROP COLUMN last_seen_at,
+    DROP COLUMN created_at,
+    DROP COLUMN ip_address,
+    DROP COLUMN user_agent,
+    ALTER COLUMN user_id DROP NOT NULL,
+    ADD CONSTRAINT sessions_user_id_key UNIQUE (user_id);
+-- +goose StatementEnd
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE galleries
+    DROP CONSTRAINT galleries_user_id_fkey,
+    ADD CONSTRAINT galleries_user_id_fkey
+        FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE;
+ALTER TABLE users
+    ADD COLUMN delete_after TIMESTAMPTZ;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users
+    DROP COLUMN delete_after;
+ALTER TABLE galleries
+    DROP CONSTRAINT galleries_user_id_fkey,
+    ADD CONSTRAINT galleries_user_id_fkey
+        FOREIGN KEY (user_id) REFERENCES users (id);
+-- +goose StatementEnd
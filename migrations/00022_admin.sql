@@ -0,0 +1,29 @@
+-- +goose Up
+-- +goose StatementBegin
+-- admins can make others admin in the admin area, the first one is made with
+-- UPDATE users SET is_admin = TRUE WHERE email = '...';
+ALTER TABLE users
+    ADD COLUMN is_admin BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN suspended_at TIMESTAMPTZ;
+CREATE TABLE audit_log (
+    id SERIAL PRIMARY KEY,
+    -- the emails are kept as well, so the log still makes sense after
+    -- either account is deleted
+    admin_id INT REFERENCES users (id) ON DELETE SET NULL,
+    admin_email TEXT NOT NULL,
+    action TEXT NOT NULL,
+    target_user_id INT REFERENCES users (id) ON DELETE SET NULL,
+    target_email TEXT NOT NULL DEFAULT '',
+    details TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX audit_log_target_user_id_idx ON audit_log (target_user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE audit_log;
+ALTER TABLE users
+    DROP COLUMN suspended_at,
+    DROP COLUMN is_admin;
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE sessions
+    ADD COLUMN impersonated_user_id INT REFERENCES users (id) ON DELETE SET NULL,
+    ADD COLUMN impersonation_started_at TIMESTAMPTZ;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE sessions
+    DROP COLUMN impersonation_started_at,
+    DROP COLUMN impersonated_user_id;
+-- +goose StatementEnd
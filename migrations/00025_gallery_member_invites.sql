@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE gallery_members
+    ALTER COLUMN user_id DROP NOT NULL,
+    ADD COLUMN email TEXT,
+    ADD UNIQUE (gallery_id, email),
+    ADD CHECK (user_id IS NOT NULL OR email IS NOT NULL);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DELETE FROM gallery_members
+WHERE user_id IS NULL;
+ALTER TABLE gallery_members
+    DROP COLUMN email,
+    ALTER COLUMN user_id SET NOT NULL;
+-- +goose StatementEnd
@@ -0,0 +1,288 @@
+package models
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"time"
+)
+
+// AccountService exports everything we store about a user, and deletes
+// accounts once the grace period after users asked for it is over.
+type AccountService struct {
+	DB             *sql.DB
+	GalleryService *GalleryService
+	ImageService   *ImageService
+	SessionService *SessionService
+	ProfileService *ProfileService
+	// DeletionGracePeriod is how long users can change their mind after
+	// asking to delete their account. Defaults to
+	// DefaultDeletionGracePeriod.
+	DeletionGracePeriod time.Duration
+}
+
+const (
+	DefaultDeletionGracePeriod = 14 * 24 * time.Hour
+)
+
+type accountExport struct {
+	User struct {
+		ID              int        `json:"id"`
+		Email           string     `json:"email"`
+		EmailVerifiedAt *time.Time `json:"email_verified_at"`
+		Username        string     `json:"username"`
+		DisplayName     string     `json:"display_name"`
+		Bio             string     `json:"bio"`
+		// Avatar is the path of the avatar image in the ZIP file, if the
+		// user has one.
+		Avatar string `json:"avatar,omitempty"`
+	} `json:"user"`
+	Galleries []galleryExport `json:"galleries"`
+	Sessions  []sessionExport `json:"sessions"`
+}
+
+type galleryExport struct {
+	ID         int        `json:"id"`
+	Title      string     `json:"title"`
+	Visibility Visibility `json:"visibility"`
+	// Images are the paths of the images in the ZIP file.
+	Images []string `json:"images"`
+}
+
+type sessionExport struct {
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+}
+
+// Export writes a ZIP file to w with a data.json describing the user, their
+// profile, galleries and sessions, their avatar and the original of every
+// image they uploaded. The ZIP is streamed, so w may have been written to
+// when an error is returned.
+func (service *AccountService) Export(user *User, w io.Writer) error {
+	var export accountExport
+	export.User.ID = user.ID
+	export.User.Email = user.Email
+	export.User.EmailVerifiedAt = user.EmailVerifiedAt
+	export.Galleries = []galleryExport{}
+	export.Sessions = []sessionExport{}
+
+	profile, err := service.ProfileService.ByUserID(user.ID)
+	if err != nil {
+		return fmt.Errorf("export account: %w", err)
+	}
+	export.User.Username = profile.Username
+	export.User.DisplayName = profile.DisplayName
+	export.User.Bio = profile.Bio
+	if profile.AvatarKey != "" {
+		export.User.Avatar = "avatar" + path.Ext(profile.AvatarKey)
+	}
+	galleries, err := service.GalleryService.ByUserID(user.ID)
+	if err != nil {
+		return fmt.Errorf("export account: %w", err)
+	}
+	var images []Image
+	for _, gallery := range galleries {
+		ge := galleryExport{
+			ID:         gallery.ID,
+			Title:      gallery.Title,
+			Visibility: gallery.Visibility,
+			Images:     []string{},
+		}
+		galleryImages, err := service.ImageService.Images(gallery.ID)
+		if err != nil {
+			return fmt.Errorf("export account: %w", err)
+		}
+		for _, image := range galleryImages {
+			ge.Images = append(ge.Images, exportImagePath(image))
+		}
+		images = append(images, galleryImages...)
+		export.Galleries = append(export.Galleries, ge)
+	}
+	sessions, err := service.SessionService.ByUserID(user.ID)
+	if err != nil {
+		return fmt.Errorf("export account: %w", err)
+	}
+	for _, session := range sessions {
+		export.Sessions = append(export.Sessions, sessionExport{
+			UserAgent:  session.UserAgent,
+			IPAddress:  session.IPAddress,
+			CreatedAt:  session.CreatedAt,
+			LastSeenAt: session.LastSeenAt,
+		})
+	}
+
+	zw := zip.NewWriter(w)
+	f, err := zw.Create("data.json")
+	if err != nil {
+		return fmt.Errorf("export account: %w", err)
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(export)
+	if err != nil {
+		return fmt.Errorf("export account: %w", err)
+	}
+	if export.User.Avatar != "" {
+		err = service.exportAvatar(zw, profile, export.User.Avatar)
+		if err != nil {
+			return fmt.Errorf("export account: %w", err)
+		}
+	}
+	for _, image := range images {
+		err = service.exportImage(zw, image)
+		if err != nil {
+			return fmt.Errorf("export account: %w", err)
+		}
+	}
+	err = zw.Close()
+	if err != nil {
+		return fmt.Errorf("export account: %w", err)
+	}
+	return nil
+}
+
+func (service *AccountService) exportImage(zw *zip.Writer, image Image) error {
+	rc, err := service.ImageService.Open(image)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return storeInZip(zw, exportImagePath(image), rc)
+}
+
+func (service *AccountService) exportAvatar(zw *zip.Writer, profile *Profile, name string) error {
+	rc, _, err := service.ProfileService.OpenAvatar(profile)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return storeInZip(zw, name, rc)
+}
+
+// storeInZip adds the file without compressing it, as images are compressed
+// already.
+func storeInZip(zw *zip.Writer, name string, r io.Reader) error {
+	f, err := zw.CreateHeader(&zip.FileHeader{
+		Name:   name,
+		Method: zip.Store,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	return err
+}
+
+func exportImagePath(image Image) string {
+	return fmt.Sprintf("galleries/%d/%s", image.GalleryID, image.Filename)
+}
+
+// ScheduleDeletion marks the user's account for deletion once the grace
+// period is over, and returns when that will be.
+func (service *AccountService) ScheduleDeletion(userID int) (time.Time, error) {
+	grace := service.DeletionGracePeriod
+	if grace == 0 {
+		grace = DefaultDeletionGracePeriod
+	}
+	deleteAfter := time.Now().Add(grace)
+	_, err := service.DB.Exec(`
+		UPDATE users
+		SET delete_after = $2
+		WHERE id = $1;`, userID, deleteAfter)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("schedule deletion: %w", err)
+	}
+	return deleteAfter, nil
+}
+
+// DeletionScheduled returns when the user's account will be deleted, or nil
+// if it won't.
+func (service *AccountService) DeletionScheduled(userID int) (*time.Time, error) {
+	var deleteAfter *time.Time
+	row := service.DB.QueryRow(`
+		SELECT delete_after FROM users WHERE id = $1;`, userID)
+	err := row.Scan(&deleteAfter)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("deletion scheduled: %w", err)
+	}
+	return deleteAfter, nil
+}
+
+// CancelDeletion keeps the user's account after all. Once the grace period
+// is over the account may be purged any moment, so it can't be cancelled
+// anymore.
+func (service *AccountService) CancelDeletion(userID int) error {
+	_, err := service.DB.Exec(`
+		UPDATE users
+		SET delete_after = NULL
+		WHERE id = $1 AND delete_after > NOW();`, userID)
+	if err != nil {
+		return fmt.Errorf("cancel deletion: %w", err)
+	}
+	return nil
+}
+
+// PurgeDeleted deletes the accounts whose grace period is over, with their
+// images and avatar. Everything else of theirs is removed by the database as it
+// references the user. It returns how many accounts were deleted.
+func (service *AccountService) PurgeDeleted() (int, error) {
+	rows, err := service.DB.Query(`
+		SELECT id FROM users WHERE delete_after <= NOW();`)
+	if err != nil {
+		return 0, fmt.Errorf("purge deleted accounts: %w", err)
+	}
+	var userIDs []int
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("purge deleted accounts: %w", err)
+		}
+		userIDs = append(userIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("purge deleted accounts: %w", err)
+	}
+
+	purged := 0
+	for _, userID := range userIDs {
+		galleries, err := service.GalleryService.ByUserID(userID)
+		if err != nil {
+			return purged, fmt.Errorf("purge deleted accounts: %w", err)
+		}
+		for _, gallery := range galleries {
+			err = service.ImageService.DeleteAll(gallery.ID)
+			if err != nil {
+				return purged, fmt.Errorf("purge deleted accounts: %w", err)
+			}
+		}
+		err = service.ProfileService.DeleteAvatar(userID)
+		if err != nil {
+			return purged, fmt.Errorf("purge deleted accounts: %w", err)
+		}
+		// only if nothing changed since we looked
+		res, err := service.DB.Exec(`
+			DELETE FROM users
+			WHERE id = $1 AND delete_after <= NOW();`, userID)
+		if err != nil {
+			return purged, fmt.Errorf("purge deleted accounts: %w", err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return purged, fmt.Errorf("purge deleted accounts: %w", err)
+		}
+		purged += int(n)
+	}
+	return purged, nil
+}
@@ -0,0 +1,130 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// AdminService looks up and manages any user's account, for the admin area.
+// Callers are responsible for checking the current user is an admin, and for
+// recording what they did in the audit log.
+type AdminService struct {
+	DB             *sql.DB
+	SessionService *SessionService
+}
+
+// MaxUserSearchResults limits how many users SearchUsers returns.
+const MaxUserSearchResults = 50
+
+// SearchUsers returns the users whose email address or username contains
+// query, ignoring case. An empty query returns the newest users.
+func (service *AdminService) SearchUsers(query string) ([]User, error) {
+	// LIKE treats % and _ as wildcards, they are searched for literally
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).
+		Replace(strings.TrimSpace(query)) + "%"
+	rows, err := service.DB.Query(`
+		SELECT id, email, email_verified_at, is_admin, suspended_at
+		FROM users
+		WHERE email ILIKE $1 OR username ILIKE $1
+		ORDER BY id DESC
+		LIMIT $2;`, pattern, MaxUserSearchResults)
+	if err != nil {
+		return nil, fmt.Errorf("search users: %w", err)
+	}
+	defer rows.Close()
+	var users []User
+	for rows.Next() {
+		var user User
+		err = rows.Scan(&user.ID, &user.Email, &user.EmailVerifiedAt,
+			&user.IsAdmin, &user.SuspendedAt)
+		if err != nil {
+			return nil, fmt.Errorf("search users: %w", err)
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("search users: %w", err)
+	}
+	return users, nil
+}
+
+// User looks up any user by ID. ErrNotFound is returned if there is none.
+func (service *AdminService) User(userID int) (*User, error) {
+	user := User{
+		ID: userID,
+	}
+	row := service.DB.QueryRow(`
+		SELECT email, email_verified_at, is_admin, suspended_at
+		FROM users
+		WHERE id = $1;`, userID)
+	err := row.Scan(&user.Email, &user.EmailVerifiedAt, &user.IsAdmin,
+		&user.SuspendedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("admin user: %w", err)
+	}
+	return &user, nil
+}
+
+// Suspend keeps the user from signing in and signs them out everywhere.
+// Their API tokens stop working until the account is unsuspended.
+func (service *AdminService) Suspend(userID int) error {
+	_, err := service.DB.Exec(`
+		UPDATE users
+		SET suspended_at = NOW()
+		WHERE id = $1 AND suspended_at IS NULL;`, userID)
+	if err != nil {
+		return fmt.Errorf("suspend user: %w", err)
+	}
+	err = service.SessionService.DeleteAll(userID)
+	if err != nil {
+		return fmt.Errorf("suspend user: %w", err)
+	}
+	return nil
+}
+
+func (service *AdminService) Unsuspend(userID int) error {
+	_, err := service.DB.Exec(`
+		UPDATE users
+		SET suspended_at = NULL
+		WHERE id = $1;`, userID)
+	if err != nil {
+		return fmt.Errorf("unsuspend user: %w", err)
+	}
+	return nil
+}
+
+// ForcePasswordReset removes the user's password and signs them out
+// everywhere, so they have to choose a new password through a reset link
+// before they can sign in again. That holds for every way of signing in,
+// passkeys, magic links and OIDC included.
+func (service *AdminService) ForcePasswordReset(userID int) error {
+	_, err := service.DB.Exec(`
+		UPDATE users
+		SET password_hash = '', password_reset_required = TRUE
+		WHERE id = $1;`, userID)
+	if err != nil {
+		return fmt.Errorf("force password reset: %w", err)
+	}
+	err = service.SessionService.DeleteAll(userID)
+	if err != nil {
+		return fmt.Errorf("force password reset: %w", err)
+	}
+	return nil
+}
+
+// SetAdmin grants or revokes the user's admin role.
+func (service *AdminService) SetAdmin(userID int, admin bool) error {
+	_, err := service.DB.Exec(`
+		UPDATE users
+		SET is_admin = $2
+		WHERE id = $1;`, userID, admin)
+	if err != nil {
+		return fmt.Errorf("set admin: %w", err)
+	}
+	return nil
+}
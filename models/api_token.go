@@ -0,0 +1,188 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"lenslocked/rand"
+	"strings"
+	"time"
+)
+
+// APIToken lets scripts act on behalf of a user, within the token's scopes.
+type APIToken struct {
+	ID     int
+	UserID int
+	Name   string
+	// Token is only set when creating a new token, like session tokens only
+	// the hash is stored.
+	Token     string
+	TokenHash string
+	// Scopes are what the token may be used for. The models package doesn't
+	// interpret them.
+	Scopes []string
+	// ExpiresAt is nil for tokens that don't expire.
+	ExpiresAt  *time.Time
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+}
+
+// HasScope reports whether the token may be used for scope.
+func (t APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired reports whether the token can't be used anymore.
+func (t APIToken) Expired() bool {
+	return t.ExpiresAt != nil && !time.Now().Before(*t.ExpiresAt)
+}
+
+type APITokenService struct {
+	DB *sql.DB
+	// BytesPerToken is used to determine how many bytes to use when generating
+	// each token. Defaults to MinBytesPerToken.
+	BytesPerToken int
+}
+
+func (service *APITokenService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+// Create issues a new token for the user. ExpiresAt may be nil for a token
+// that doesn't expire.
+func (service *APITokenService) Create(userID int, name string, scopes []string, expiresAt *time.Time) (*APIToken, error) {
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create api token: %w", err)
+	}
+	apiToken := APIToken{
+		UserID:    userID,
+		Name:      name,
+		Token:     token,
+		TokenHash: service.hash(token),
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+	}
+	row := service.DB.QueryRow(`
+		INSERT INTO api_tokens (user_id, name, token_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at;`, userID, name, apiToken.TokenHash,
+		strings.Join(scopes, " "), expiresAt)
+	err = row.Scan(&apiToken.ID, &apiToken.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("create api token: %w", err)
+	}
+	return &apiToken, nil
+}
+
+// Use looks up a token and its user, and records that the token was just
+// used. Unknown and expired tokens, and those of suspended users, are
+// reported as ErrNotFound.
+func (service *APITokenService) Use(token string) (*APIToken, *User, error) {
+	var apiToken APIToken
+	var user User
+	var scopes string
+	tokenHash := service.hash(token)
+	row := service.DB.QueryRow(`
+		SELECT api_tokens.id,
+			api_tokens.name,
+			api_tokens.scopes,
+			api_tokens.expires_at,
+			api_tokens.created_at,
+			api_tokens.last_used_at,
+			users.id,
+			users.email,
+			users.password_hash,
+			users.email_verified_at,
+			users.is_admin,
+			users.suspended_at
+		FROM api_tokens
+		JOIN users ON users.id = api_tokens.user_id
+		WHERE api_tokens.token_hash = $1;`, tokenHash)
+	err := row.Scan(&apiToken.ID, &apiToken.Name, &scopes, &apiToken.ExpiresAt,
+		&apiToken.CreatedAt, &apiToken.LastUsedAt, &user.ID, &user.Email,
+		&user.PasswordHash, &user.EmailVerifiedAt, &user.IsAdmin,
+		&user.SuspendedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, fmt.Errorf("use api token: %w", err)
+	}
+	apiToken.UserID = user.ID
+	apiToken.TokenHash = tokenHash
+	apiToken.Scopes = strings.Fields(scopes)
+	if apiToken.Expired() || user.Suspended() {
+		return nil, nil, ErrNotFound
+	}
+	// scripts make lots of requests, so like sessions the last use is only
+	// written every so often
+	if apiToken.LastUsedAt == nil || time.Since(*apiToken.LastUsedAt) > lastSeenInterval {
+		row = service.DB.QueryRow(`
+			UPDATE api_tokens
+			SET last_used_at = NOW()
+			WHERE id = $1
+			RETURNING last_used_at;`, apiToken.ID)
+		err = row.Scan(&apiToken.LastUsedAt)
+		if err != nil {
+			return nil, nil, fmt.Errorf("use api token: %w", err)
+		}
+	}
+	return &apiToken, &user, nil
+}
+
+// ByUserID returns the tokens of the user, newest first. Expired tokens are
+// included so users can see why their script stopped working.
+func (service *APITokenService) ByUserID(userID int) ([]APIToken, error) {
+	rows, err := service.DB.Query(`
+		SELECT id, name, token_hash, scopes, expires_at, created_at,
+			last_used_at
+		FROM api_tokens
+		WHERE user_id = $1
+		ORDER BY id DESC;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query api tokens by user: %w", err)
+	}
+	defer rows.Close()
+	var tokens []APIToken
+	for rows.Next() {
+		token := APIToken{
+			UserID: userID,
+		}
+		var scopes string
+		err = rows.Scan(&token.ID, &token.Name, &token.TokenHash, &scopes,
+			&token.ExpiresAt, &token.CreatedAt, &token.LastUsedAt)
+		if err != nil {
+			return nil, fmt.Errorf("query api tokens by user: %w", err)
+		}
+		token.Scopes = strings.Fields(scopes)
+		tokens = append(tokens, token)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query api tokens by user: %w", err)
+	}
+	return tokens, nil
+}
+
+// Delete revokes one of the user's tokens.
+func (service *APITokenService) Delete(userID, id int) error {
+	_, err := service.DB.Exec(`
+		DELETE FROM api_tokens
+		WHERE id = $1 AND user_id = $2;`, id, userID)
+	if err != nil {
+		return fmt.Errorf("delete api token: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// AuditAction is something an admin did.
+type AuditAction string
+
+const (
+	AuditSearchUsers        AuditAction = "search_users"
+	AuditViewUser           AuditAction = "view_user"
+	AuditSuspendUser        AuditAction = "suspend_user"
+	AuditUnsuspendUser      AuditAction = "unsuspend_user"
+	AuditForcePasswordReset AuditAction = "force_password_reset"
+	AuditGrantAdmin         AuditAction = "grant_admin"
+	AuditRevokeAdmin        AuditAction = "revoke_admin"
+	AuditStartImpersonation AuditAction = "start_impersonation"
+	AuditStopImpersonation  AuditAction = "stop_impersonation"
+)
+
+type AuditEntry struct {
+	ID int
+	// AdminID and TargetUserID are nil once the account was deleted, the
+	// emails are kept.
+	AdminID      *int
+	AdminEmail   string
+	Action       AuditAction
+	TargetUserID *int
+	TargetEmail  string
+	// Details is anything else worth knowing about the action, like what
+	// was searched for.
+	Details   string
+	CreatedAt time.Time
+}
+
+// AuditLogService keeps track of what admins do. Entries are never changed
+// or deleted.
+type AuditLogService struct {
+	DB *sql.DB
+}
+
+// MaxAuditEntries limits how many entries are returned at once.
+const MaxAuditEntries = 100
+
+// Record adds an entry for the admin taking the action. Target is the user
+// it was taken on, nil if there is none.
+func (service *AuditLogService) Record(admin *User, action AuditAction, target *User, details string) error {
+	var targetID *int
+	var targetEmail string
+	if target != nil {
+		targetID = &target.ID
+		targetEmail = target.Email
+	}
+	_, err := service.DB.Exec(`
+		INSERT INTO audit_log (admin_id, admin_email, action, target_user_id,
+			target_email, details)
+		VALUES ($1, $2, $3, $4, $5, $6);`, admin.ID, admin.Email, action,
+		targetID, targetEmail, details)
+	if err != nil {
+		return fmt.Errorf("record audit entry: %w", err)
+	}
+	return nil
+}
+
+// Recent returns the newest entries, newest first.
+func (service *AuditLogService) Recent() ([]AuditEntry, error) {
+	rows, err := service.DB.Query(`
+		SELECT id, admin_id, admin_email, action, target_user_id, target_email,
+			details, created_at
+		FROM audit_log
+		ORDER BY id DESC
+		LIMIT $1;`, MaxAuditEntries)
+	if err != nil {
+		return nil, fmt.Errorf("recent audit entries: %w", err)
+	}
+	return scanAuditEntries(rows)
+}
+
+// ByTargetUserID returns the newest entries about actions taken on the
+// user, newest first.
+func (service *AuditLogService) ByTargetUserID(userID int) ([]AuditEntry, error) {
+	rows, err := service.DB.Query(`
+		SELECT id, admin_id, admin_email, action, target_user_id, target_email,
+			details, created_at
+		FROM audit_log
+		WHERE target_user_id = $1
+		ORDER BY id DESC
+		LIMIT $2;`, userID, MaxAuditEntries)
+	if err != nil {
+		return nil, fmt.Errorf("audit entries by target user: %w", err)
+	}
+	return scanAuditEntries(rows)
+}
+
+func scanAuditEntries(rows *sql.Rows) ([]AuditEntry, error) {
+	defer rows.Close()
+	var entries []AuditEntry
+	for rows.Next() {
+		var entry AuditEntry
+		err := rows.Scan(&entry.ID, &entry.AdminID, &entry.AdminEmail,
+			&entry.Action, &entry.TargetUserID, &entry.TargetEmail,
+			&entry.Details, &entry.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("scan audit entries: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("scan audit entries: %w", err)
+	}
+	return entries, nil
+}
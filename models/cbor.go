@@ -0,0 +1,134 @@
+package models
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// cborDecode decodes the first CBOR data item in data, see RFC 8949. It only
+// supports what WebAuthn needs: integers, byte and text strings, arrays,
+// maps, booleans and null, all with definite lengths. Maps decode to
+// map[interface{}]interface{} with int64 or string keys. The number of bytes
+// the item took is returned along with it, as WebAuthn packs other data
+// right after CBOR items.
+func cborDecode(data []byte) (interface{}, int, error) {
+	return cborDecodeDepth(data, 0)
+}
+
+// cborMaxDepth stops deeply nested input from exhausting the stack.
+const cborMaxDepth = 16
+
+func cborDecodeDepth(data []byte, depth int) (interface{}, int, error) {
+	if depth > cborMaxDepth {
+		return nil, 0, fmt.Errorf("cbor: nested too deeply")
+	}
+	if len(data) == 0 {
+		return nil, 0, fmt.Errorf("cbor: unexpected end of data")
+	}
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	n := 1
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info == 24:
+		if len(data) < 2 {
+			return nil, 0, fmt.Errorf("cbor: unexpected end of data")
+		}
+		arg = uint64(data[1])
+		n = 2
+	case info == 25:
+		if len(data) < 3 {
+			return nil, 0, fmt.Errorf("cbor: unexpected end of data")
+		}
+		arg = uint64(binary.BigEndian.Uint16(data[1:]))
+		n = 3
+	case info == 26:
+		if len(data) < 5 {
+			return nil, 0, fmt.Errorf("cbor: unexpected end of data")
+		}
+		arg = uint64(binary.BigEndian.Uint32(data[1:]))
+		n = 5
+	case info == 27:
+		if len(data) < 9 {
+			return nil, 0, fmt.Errorf("cbor: unexpected end of data")
+		}
+		arg = binary.BigEndian.Uint64(data[1:])
+		n = 9
+	default:
+		return nil, 0, fmt.Errorf("cbor: unsupported additional info %d", info)
+	}
+
+	switch major {
+	case 0:
+		if arg > 1<<62 {
+			return nil, 0, fmt.Errorf("cbor: integer too large")
+		}
+		return int64(arg), n, nil
+	case 1:
+		if arg > 1<<62 {
+			return nil, 0, fmt.Errorf("cbor: integer too large")
+		}
+		return -1 - int64(arg), n, nil
+	case 2, 3:
+		if arg > uint64(len(data)-n) {
+			return nil, 0, fmt.Errorf("cbor: unexpected end of data")
+		}
+		b := data[n : n+int(arg)]
+		n += int(arg)
+		if major == 3 {
+			return string(b), n, nil
+		}
+		return append([]byte(nil), b...), n, nil
+	case 4:
+		if arg > uint64(len(data)) {
+			return nil, 0, fmt.Errorf("cbor: unexpected end of data")
+		}
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			item, size, err := cborDecodeDepth(data[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			items = append(items, item)
+			n += size
+		}
+		return items, n, nil
+	case 5:
+		if arg > uint64(len(data)) {
+			return nil, 0, fmt.Errorf("cbor: unexpected end of data")
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			key, size, err := cborDecodeDepth(data[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			n += size
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, 0, fmt.Errorf("cbor: unsupported map key %T", key)
+			}
+			value, size, err := cborDecodeDepth(data[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			n += size
+			m[key] = value
+		}
+		return m, n, nil
+	case 7:
+		switch info {
+		case 20:
+			return false, n, nil
+		case 21:
+			return true, n, nil
+		case 22:
+			return nil, n, nil
+		}
+		return nil, 0, fmt.Errorf("cbor: unsupported simple value %d", info)
+	}
+	return nil, 0, fmt.Errorf("cbor: unsupported major type %d", major)
+}
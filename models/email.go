@@ -2,6 +2,8 @@ package models
 
 import (
 	"fmt"
+	"html"
+	"time"
 
 	"github.com/go-mail/mail/v2"
 )
@@ -88,3 +90,123 @@ func (es *EmailService) ForgotPassword(to, resetURL string) error {
 	}
 	return nil
 }
+
+func (es *EmailService) VerifyEmail(to, verifyURL string) error {
+	email := Email{
+		Subject:   "Confirm your email address",
+		To:        to,
+		Plaintext: "To confirm your email address, please visit the following link: " + verifyURL,
+		HTML:      `<p>To confirm your email address, please visit the following link: <a href="` + verifyURL + `">` + verifyURL + `</a></p>`,
+	}
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("verify email: %w", err)
+	}
+	return nil
+}
+
+func (es *EmailService) MagicLink(to, signInURL string) error {
+	email := Email{
+		Subject:   "Your sign in link",
+		To:        to,
+		Plaintext: "To sign in to your account, please visit the following link: " + signInURL,
+		HTML:      `<p>To sign in to your account, please visit the following link: <a href="` + signInURL + `">` + signInURL + `</a></p>`,
+	}
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("magic link email: %w", err)
+	}
+	return nil
+}
+
+func (es *EmailService) UnlockAccount(to, unlockURL string) error {
+	email := Email{
+		Subject:   "Your account was locked",
+		To:        to,
+		Plaintext: "We locked your account after too many failed sign in attempts. If this was you, you can unlock it by visiting the following link: " + unlockURL + "\n\nIf it wasn't you, someone may be trying to guess your password. Your account unlocks by itself after a while, consider choosing a stronger password.",
+		HTML:      `<p>We locked your account after too many failed sign in attempts. If this was you, you can unlock it by visiting the following link: <a href="` + unlockURL + `">` + unlockURL + `</a></p><p>If it wasn't you, someone may be trying to guess your password. Your account unlocks by itself after a while, consider choosing a stronger password.</p>`,
+	}
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("unlock account email: %w", err)
+	}
+	return nil
+}
+
+func (es *EmailService) ConfirmEmailChange(to, confirmURL string) error {
+	email := Email{
+		Subject:   "Confirm your new email address",
+		To:        to,
+		Plaintext: "To use this email address for your account, please visit the following link: " + confirmURL,
+		HTML:      `<p>To use this email address for your account, please visit the following link: <a href="` + confirmURL + `">` + confirmURL + `</a></p>`,
+	}
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("confirm email change email: %w", err)
+	}
+	return nil
+}
+
+// EmailChangeRequested tells the old address about a change to newEmail.
+func (es *EmailService) EmailChangeRequested(to, newEmail, revertURL string) error {
+	email := Email{
+		Subject:   "Your email address is being changed",
+		To:        to,
+		Plaintext: "Someone asked to change the email address of your account to " + newEmail + ". If that wasn't you, visit the following link to keep this address and sign out everywhere: " + revertURL,
+		HTML:      `<p>Someone asked to change the email address of your account to ` + html.EscapeString(newEmail) + `.</p><p>If that wasn't you, visit the following link to keep this address and sign out everywhere: <a href="` + revertURL + `">` + revertURL + `</a></p>`,
+	}
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("email change requested email: %w", err)
+	}
+	return nil
+}
+
+// PasswordChanged tells the user their password was changed, in case it
+// wasn't them.
+func (es *EmailService) PasswordChanged(to, resetURL string) error {
+	email := Email{
+		Subject:   "Your password was changed",
+		To:        to,
+		Plaintext: "The password of your account was just changed, and you were signed out on your other devices. If that wasn't you, please reset your password right away: " + resetURL,
+		HTML:      `<p>The password of your account was just changed, and you were signed out on your other devices.</p><p>If that wasn't you, please reset your password right away: <a href="` + resetURL + `">` + resetURL + `</a></p>`,
+	}
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("password changed email: %w", err)
+	}
+	return nil
+}
+
+// PasswordResetRequired tells the user an admin reset their password, and
+// how to choose a new one.
+func (es *EmailService) PasswordResetRequired(to, resetURL string) error {
+	email := Email{
+		Subject:   "Please choose a new password",
+		To:        to,
+		Plaintext: "For your security, the password of your account was reset and you were signed out everywhere. You can't sign in again until you choose a new password: " + resetURL,
+		HTML:      `<p>For your security, the password of your account was reset and you were signed out everywhere.</p><p>You can't sign in again until you choose a new password: <a href="` + resetURL + `">` + resetURL + `</a></p>`,
+	}
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("password reset required email: %w", err)
+	}
+	return nil
+}
+
+// AccountDeletionScheduled confirms the user asked to delete their account,
+// and tells them how to keep it.
+func (es *EmailService) AccountDeletionScheduled(to string, deleteAfter time.Time, signInURL string) error {
+	date := deleteAfter.Format("January 2, 2006")
+	email := Email{
+		Subject:   "Your account will be deleted",
+		To:        to,
+		Plaintext: "Your account and everything in it will be deleted on " + date + ". If you change your mind, sign in before then and cancel the deletion: " + signInURL,
+		HTML:      `<p>Your account and everything in it will be deleted on ` + date + `.</p><p>If you change your mind, sign in before then and cancel the deletion: <a href="` + signInURL + `">` + signInURL + `</a></p>`,
+	}
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("account deletion scheduled email: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"lenslocked/rand"
+	"strings"
+	"time"
+)
+
+// EmailChange is a request to change a user's email address. It is applied
+// once the new address is confirmed, and the old address can revert it for
+// a while after that.
+type EmailChange struct {
+	ID       int
+	UserID   int
+	OldEmail string
+	NewEmail string
+	// Token and RevertToken are only set when an EmailChange is being
+	// created. The token goes to the new address and the revert token to
+	// the old one.
+	Token           string
+	TokenHash       string
+	ExpiresAt       time.Time
+	RevertToken     string
+	RevertTokenHash string
+	RevertExpiresAt time.Time
+	// ConfirmedAt is nil until the new address is confirmed.
+	ConfirmedAt *time.Time
+}
+
+type EmailChangeService struct {
+	DB *sql.DB
+	// BytesPerToken is used to determine how many bytes to use when generating
+	// each token. Defaults to MinBytesPerToken.
+	BytesPerToken int
+	// Duration is how long the new address has to confirm. Defaults to
+	// DefaultEmailChangeDuration.
+	Duration time.Duration
+	// RevertDuration is how long the old address can revert the change.
+	// Defaults to DefaultEmailRevertDuration.
+	RevertDuration time.Duration
+}
+
+const (
+	DefaultEmailChangeDuration = 24 * time.Hour
+	DefaultEmailRevertDuration = 7 * 24 * time.Hour
+)
+
+func (service *EmailChangeService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+// Create starts changing the user's email address, replacing any change of
+// theirs that wasn't confirmed yet. Confirmed changes are kept, so they can
+// still be reverted.
+func (service *EmailChangeService) Create(userID int, oldEmail, newEmail string) (*EmailChange, error) {
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create email change: %w", err)
+	}
+	revertToken, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create email change: %w", err)
+	}
+	duration, revertDuration := service.Duration, service.RevertDuration
+	if duration == 0 {
+		duration = DefaultEmailChangeDuration
+	}
+	if revertDuration == 0 {
+		revertDuration = DefaultEmailRevertDuration
+	}
+	change := EmailChange{
+		UserID:          userID,
+		OldEmail:        strings.ToLower(oldEmail),
+		NewEmail:        strings.ToLower(newEmail),
+		Token:           token,
+		TokenHash:       service.hash(token),
+		ExpiresAt:       time.Now().Add(duration),
+		RevertToken:     revertToken,
+		RevertTokenHash: service.hash(revertToken),
+		RevertExpiresAt: time.Now().Add(revertDuration),
+	}
+	_, err = service.DB.Exec(`
+		DELETE FROM email_changes
+		WHERE user_id = $1 AND confirmed_at IS NULL;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("create email change: %w", err)
+	}
+	row := service.DB.QueryRow(`
+		INSERT INTO email_changes (user_id, old_email, new_email, token_hash,
+			expires_at, revert_token_hash, revert_expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id;`, change.UserID, change.OldEmail, change.NewEmail,
+		change.TokenHash, change.ExpiresAt, change.RevertTokenHash,
+		change.RevertExpiresAt)
+	err = row.Scan(&change.ID)
+	if err != nil {
+		return nil, fmt.Errorf("create email change: %w", err)
+	}
+	return &change, nil
+}
+
+// Consume uses up the token in a confirmation link and changes the user's
+// email address to the new one, which counts as verified. Both happen in a
+// single statement, so a link can't be used twice and a change isn't
+// confirmed without being applied. ErrNotFound is returned if the token is
+// invalid, expired or was used, and ErrEmailTaken if another user has the
+// address by now.
+func (service *EmailChangeService) Consume(token string) (*EmailChange, error) {
+	change := EmailChange{
+		TokenHash: service.hash(token),
+	}
+	row := service.DB.QueryRow(`
+		WITH change AS (
+			UPDATE email_changes
+			SET confirmed_at = NOW()
+			WHERE token_hash = $1 AND confirmed_at IS NULL AND expires_at > NOW()
+			RETURNING id, user_id, old_email, new_email, expires_at,
+				revert_token_hash, revert_expires_at, confirmed_at
+		)
+		UPDATE users
+		SET email = change.new_email, email_verified_at = NOW()
+		FROM change
+		WHERE users.id = change.user_id
+		RETURNING change.id, change.user_id, change.old_email, change.new_email,
+			change.expires_at, change.revert_token_hash,
+			change.revert_expires_at, change.confirmed_at;`, change.TokenHash)
+	err := row.Scan(&change.ID, &change.UserID, &change.OldEmail,
+		&change.NewEmail, &change.ExpiresAt, &change.RevertTokenHash,
+		&change.RevertExpiresAt, &change.ConfirmedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		if uniqueViolation(err) {
+			return nil, ErrEmailTaken
+		}
+		return nil, fmt.Errorf("consume email change: %w", err)
+	}
+	return &change, nil
+}
+
+// Revert uses up the revert token sent to the old address and returns the
+// change it was for. If the change was confirmed, the caller has to restore
+// the old address. Every other change of the user is dropped as well, so
+// whoever made it can't undo the revert. ErrNotFound is returned if the
+// token is invalid or expired.
+func (service *EmailChangeService) Revert(revertToken string) (*EmailChange, error) {
+	change := EmailChange{
+		RevertTokenHash: service.hash(revertToken),
+	}
+	row := service.DB.QueryRow(`
+		DELETE FROM email_changes
+		WHERE revert_token_hash = $1
+		RETURNING id, user_id, old_email, new_email, token_hash, expires_at,
+			revert_expires_at, confirmed_at;`, change.RevertTokenHash)
+	err := row.Scan(&change.ID, &change.UserID, &change.OldEmail,
+		&change.NewEmail, &change.TokenHash, &change.ExpiresAt,
+		&change.RevertExpiresAt, &change.ConfirmedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("revert email change: %w", err)
+	}
+	if time.Now().After(change.RevertExpiresAt) {
+		return nil, ErrNotFound
+	}
+	_, err = service.DB.Exec(`
+		DELETE FROM email_changes
+		WHERE user_id = $1;`, change.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("revert email change: %w", err)
+	}
+	return &change, nil
+}
@@ -0,0 +1,115 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"lenslocked/rand"
+	"time"
+)
+
+type EmailVerification struct {
+	ID     int
+	UserID int
+	// Token is only set when an EmailVerification is being created
+	Token     string
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+type EmailVerificationService struct {
+	DB *sql.DB
+	// BytesPerToken is used to determine how many bytes to use when generating
+	// each verification token. Defaults to MinBytesPerToken.
+	BytesPerToken int
+	// Duration for EmailVerification. Defaults to DefaultVerificationDuration
+	Duration time.Duration
+}
+
+const (
+	DefaultVerificationDuration = 24 * time.Hour
+)
+
+func (service *EmailVerificationService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+// Create starts the verification of the user's email address. Any earlier
+// verification of the same user is replaced, so only the most recent link
+// works.
+func (service *EmailVerificationService) Create(userID int) (*EmailVerification, error) {
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken == 0 {
+		bytesPerToken = MinBytesPerToken
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create verification: %w", err)
+	}
+	duration := service.Duration
+	if duration == 0 {
+		duration = DefaultVerificationDuration
+	}
+	verification := EmailVerification{
+		UserID:    userID,
+		Token:     token,
+		TokenHash: service.hash(token),
+		ExpiresAt: time.Now().Add(duration),
+	}
+	row := service.DB.QueryRow(`
+		INSERT INTO email_verifications (user_id, token_hash, expires_at)
+		VALUES ($1, $2, $3) ON CONFLICT (user_id) DO
+		UPDATE
+		SET token_hash = $2, expires_at = $3
+		RETURNING id;`, verification.UserID, verification.TokenHash, verification.ExpiresAt)
+	err = row.Scan(&verification.ID)
+	if err != nil {
+		return nil, fmt.Errorf("create verification: %w", err)
+	}
+	return &verification, nil
+}
+
+// Consume marks the email address of the user the token was sent to as
+// verified. ErrNotFound is returned for unknown or expired tokens.
+func (service *EmailVerificationService) Consume(token string) (*User, error) {
+	tokenHash := service.hash(token)
+	var user User
+	var verification EmailVerification
+	row := service.DB.QueryRow(`
+		SELECT email_verifications.id,
+			email_verifications.expires_at,
+			users.id,
+			users.email
+		FROM email_verifications
+			JOIN users ON users.id = email_verifications.user_id
+		WHERE email_verifications.token_hash = $1;`, tokenHash)
+	err := row.Scan(&verification.ID, &verification.ExpiresAt, &user.ID, &user.Email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("consume verification: %w", err)
+	}
+	if time.Now().After(verification.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+	row = service.DB.QueryRow(`
+		UPDATE users
+		SET email_verified_at = NOW()
+		WHERE id = $1
+		RETURNING email_verified_at;`, user.ID)
+	err = row.Scan(&user.EmailVerifiedAt)
+	if err != nil {
+		return nil, fmt.Errorf("consume verification: %w", err)
+	}
+	_, err = service.DB.Exec(`
+		DELETE FROM email_verifications
+		WHERE id = $1;`, verification.ID)
+	if err != nil {
+		return nil, fmt.Errorf("consume verification: %w", err)
+	}
+	return &user, nil
+}
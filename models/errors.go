@@ -1,8 +1,53 @@
 package models
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	ErrNotFound   = errors.New("models: resource could not be found")
 	ErrEmailTaken = errors.New("models: email address is already in use")
+	// ErrInvalidCode is returned when a two factor or recovery code is
+	// wrong, expired or was used already.
+	ErrInvalidCode = errors.New("models: invalid code")
+	// ErrInvalidCredential is returned when a passkey registration or sign
+	// in doesn't check out.
+	ErrInvalidCredential = errors.New("models: invalid webauthn credential")
+	// ErrInvalidLogin is returned when there is no user with the email
+	// address or the password is wrong. They aren't told apart, so sign in
+	// doesn't reveal who has an account.
+	ErrInvalidLogin = errors.New("models: invalid email or password")
+	// ErrTooManyAttempts is returned while sign ins are held back after
+	// repeated failures.
+	ErrTooManyAttempts = errors.New("models: too many failed sign in attempts")
+	// ErrAccountLocked is returned for sign ins of an account that is locked
+	// after too many failures.
+	ErrAccountLocked = errors.New("models: account is locked")
+	// ErrAccountSuspended is returned when signing in to an account an admin
+	// suspended.
+	ErrAccountSuspended = errors.New("models: account is suspended")
+	// ErrPasswordResetRequired is returned when signing in, however that
+	// happens, to an account an admin reset the password of until the user
+	// chose a new one.
+	ErrPasswordResetRequired = errors.New("models: password reset required")
+	// ErrWeakPassword and ErrBreachedPassword are returned for passwords
+	// the PasswordPolicy doesn't accept.
+	ErrWeakPassword     = errors.New("models: password is too weak")
+	ErrBreachedPassword = errors.New("models: password appeared in a data breach")
+	// ErrInvalidUsername is returned for usernames that don't match the
+	// allowed format.
+	ErrInvalidUsername = errors.New("models: invalid username")
+	// ErrInvalidKey is returned by a Storage for keys it can't store
+	// objects under.
+	ErrInvalidKey    = errors.New("models: invalid storage key")
+	ErrUsernameTaken = errors.New("models: username is already in use")
 )
+
+type FileError struct {
+	Issue string
+}
+
+func (fe FileError) Error() string {
+	return fmt.Sprintf("invalid file: %v", fe.Issue)
+}
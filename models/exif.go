@@ -0,0 +1,515 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"time"
+)
+
+// EXIF tags we read or strip. The full list lives in the EXIF 2.32 spec,
+// https://www.cipa.jp/std/documents/e/DC-008-Translation-2019-E.pdf
+const (
+	TagMake             uint16 = 0x010F
+	TagModel            uint16 = 0x0110
+	TagArtist           uint16 = 0x013B
+	TagExifIFD          uint16 = 0x8769
+	TagGPSIFD           uint16 = 0x8825
+	TagExposureTime     uint16 = 0x829A
+	TagFNumber          uint16 = 0x829D
+	TagISO              uint16 = 0x8827
+	TagDateTimeOriginal uint16 = 0x9003
+	TagFocalLength      uint16 = 0x920A
+	TagMakerNote        uint16 = 0x927C
+	TagCameraOwnerName  uint16 = 0xA430
+	TagBodySerialNumber uint16 = 0xA431
+	TagLensModel        uint16 = 0xA434
+	TagLensSerialNumber uint16 = 0xA435
+	exifDateTimeLayout         = "2006:01:02 15:04:05"
+)
+
+// ExifTagNames maps the names accepted in configuration to their tags.
+var ExifTagNames = map[string]uint16{
+	"GPS":              TagGPSIFD,
+	"Artist":           TagArtist,
+	"MakerNote":        TagMakerNote,
+	"CameraOwnerName":  TagCameraOwnerName,
+	"BodySerialNumber": TagBodySerialNumber,
+	"LensSerialNumber": TagLensSerialNumber,
+}
+
+// DefaultExifStripTags are removed from publicly served images when
+// ImageService.ExifStripTags is not set. Besides the location they cover the
+// tags that identify the photographer's gear.
+var DefaultExifStripTags = []uint16{
+	TagGPSIFD,
+	TagCameraOwnerName,
+	TagBodySerialNumber,
+	TagLensSerialNumber,
+}
+
+var errNoExif = errors.New("no exif data")
+
+// ParseExif reads the EXIF metadata of a JPEG or PNG image. Images without
+// any EXIF data, including every GIF, result in empty metadata and no error.
+func ParseExif(r io.Reader) (ImageMetadata, error) {
+	var meta ImageMetadata
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return meta, fmt.Errorf("parse exif: %w", err)
+	}
+	start, end, err := findExif(data)
+	if err != nil {
+		if errors.Is(err, errNoExif) {
+			return meta, nil
+		}
+		return meta, fmt.Errorf("parse exif: %w", err)
+	}
+	tiff, err := newTIFF(data[start:end])
+	if err != nil {
+		return meta, fmt.Errorf("parse exif: %w", err)
+	}
+
+	ifd0, err := tiff.entries(tiff.firstIFD())
+	if err != nil {
+		return meta, fmt.Errorf("parse exif: %w", err)
+	}
+	entries := ifd0
+	for _, e := range ifd0 {
+		switch e.tag {
+		case TagExifIFD:
+			exifIFD, err := tiff.entries(tiff.long(e))
+			if err != nil {
+				return meta, fmt.Errorf("parse exif: %w", err)
+			}
+			entries = append(entries, exifIFD...)
+		case TagGPSIFD:
+			meta.HasGPS = true
+		}
+	}
+
+	for _, e := range entries {
+		switch e.tag {
+		case TagMake:
+			meta.CameraMake = tiff.ascii(e)
+		case TagModel:
+			meta.CameraModel = tiff.ascii(e)
+		case TagLensModel:
+			meta.LensModel = tiff.ascii(e)
+		case TagExposureTime:
+			num, den := tiff.rational(e)
+			meta.ExposureTime = formatExposure(num, den)
+		case TagFNumber:
+			num, den := tiff.rational(e)
+			if den != 0 {
+				meta.FNumber = float64(num) / float64(den)
+			}
+		case TagFocalLength:
+			num, den := tiff.rational(e)
+			if den != 0 {
+				meta.FocalLength = float64(num) / float64(den)
+			}
+		case TagISO:
+			meta.ISO = int(tiff.short(e))
+		case TagDateTimeOriginal:
+			takenAt, err := time.Parse(exifDateTimeLayout, tiff.ascii(e))
+			if err == nil {
+				meta.TakenAt = &takenAt
+			}
+		}
+	}
+	return meta, nil
+}
+
+// StripExif returns a copy of the JPEG or PNG image in data with the given
+// EXIF tags removed. When the GPS tag is stripped the whole GPS IFD is wiped
+// and XMP metadata, which can repeat the location, is dropped as well. PNGs
+// also lose the raw EXIF profiles some tools write into text chunks, since
+// those can't be stripped tag by tag. GIFs can't carry EXIF data and WebP
+// isn't accepted for upload, so anything else is returned unchanged.
+func StripExif(data []byte, tags []uint16) ([]byte, error) {
+	isPNG := bytes.HasPrefix(data, []byte(pngSignature))
+	if isPNG && len(tags) > 0 {
+		var err error
+		data, err = dropPNGMetadata(data, containsTag(tags, TagGPSIFD))
+		if err != nil {
+			return nil, fmt.Errorf("strip exif: %w", err)
+		}
+	}
+	start, end, err := findExif(data)
+	if err != nil {
+		if errors.Is(err, errNoExif) {
+			return data, nil
+		}
+		return nil, fmt.Errorf("strip exif: %w", err)
+	}
+	stripped := bytes.Clone(data)
+	tiff, err := newTIFF(stripped[start:end])
+	if err != nil {
+		return nil, fmt.Errorf("strip exif: %w", err)
+	}
+	ifd0 := tiff.firstIFD()
+	ifd0Entries, err := tiff.entries(ifd0)
+	if err != nil {
+		return nil, fmt.Errorf("strip exif: %w", err)
+	}
+	for _, e := range ifd0Entries {
+		if e.tag == TagExifIFD {
+			err = tiff.strip(tiff.long(e), tags)
+			if err != nil {
+				return nil, fmt.Errorf("strip exif: %w", err)
+			}
+		}
+	}
+	err = tiff.strip(ifd0, tags)
+	if err != nil {
+		return nil, fmt.Errorf("strip exif: %w", err)
+	}
+
+	if isPNG {
+		// the chunk CRC covers the chunk type and data
+		binary.BigEndian.PutUint32(stripped[end:], crc32.ChecksumIEEE(stripped[start-4:end]))
+		return stripped, nil
+	}
+	for _, tag := range tags {
+		if tag == TagGPSIFD {
+			return dropXMP(stripped), nil
+		}
+	}
+	return stripped, nil
+}
+
+// findExif locates the TIFF structure inside the APP1 Exif segment of a
+// JPEG or the eXIf chunk of a PNG, returning its start and end offsets in
+// data.
+func findExif(data []byte) (int, int, error) {
+	if bytes.HasPrefix(data, []byte(pngSignature)) {
+		return findPNGExif(data)
+	}
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 0, 0, errNoExif
+	}
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xFF {
+			return 0, 0, fmt.Errorf("invalid jpeg marker at %d", pos)
+		}
+		pos = skipJPEGFill(data, pos)
+		if pos+4 > len(data) {
+			break
+		}
+		marker := data[pos+1]
+		if marker == 0xDA || marker == 0xD9 {
+			// start of scan or end of image, metadata always comes before
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		segStart, segEnd := pos+4, pos+2+length
+		if length < 2 || segEnd > len(data) {
+			return 0, 0, fmt.Errorf("invalid jpeg segment length at %d", pos)
+		}
+		if marker == 0xE1 && bytes.HasPrefix(data[segStart:segEnd], []byte("Exif\x00\x00")) {
+			return segStart + 6, segEnd, nil
+		}
+		pos = segEnd
+	}
+	return 0, 0, errNoExif
+}
+
+// skipJPEGFill skips the 0xFF fill bytes a JPEG may put before a marker,
+// returning the position of the 0xFF right before the marker itself.
+func skipJPEGFill(data []byte, pos int) int {
+	for pos+1 < len(data) && data[pos+1] == 0xFF {
+		pos++
+	}
+	return pos
+}
+
+// dropXMP removes every APP1 XMP segment from a JPEG.
+func dropXMP(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:2]...)
+	pos := 2
+	for pos+4 <= len(data) && data[pos] == 0xFF {
+		// fill bytes are optional, they aren't copied
+		pos = skipJPEGFill(data, pos)
+		if pos+4 > len(data) {
+			break
+		}
+		marker := data[pos+1]
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+		segEnd := pos + 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+		if segEnd > len(data) {
+			break
+		}
+		if !(marker == 0xE1 && bytes.HasPrefix(data[pos+4:segEnd], []byte("http://ns.adobe.com/xap/1.0/"))) {
+			out = append(out, data[pos:segEnd]...)
+		}
+		pos = segEnd
+	}
+	return append(out, data[pos:]...)
+}
+
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// pngChunk is a chunk of a PNG, given as offsets into the file.
+type pngChunk struct {
+	typ string
+	// start and end of the chunk data, the length and type come before
+	// start and the CRC after end
+	start, end int
+}
+
+// pngChunks splits a PNG into its chunks, up to and including IEND.
+func pngChunks(data []byte) ([]pngChunk, error) {
+	var chunks []pngChunk
+	for pos := len(pngSignature); pos < len(data); {
+		if pos+12 > len(data) {
+			return nil, fmt.Errorf("truncated png chunk at %d", pos)
+		}
+		length := int64(binary.BigEndian.Uint32(data[pos:]))
+		if length > int64(len(data)-pos-12) {
+			return nil, fmt.Errorf("invalid png chunk length at %d", pos)
+		}
+		chunk := pngChunk{
+			typ:   string(data[pos+4 : pos+8]),
+			start: pos + 8,
+			end:   pos + 8 + int(length),
+		}
+		chunks = append(chunks, chunk)
+		if chunk.typ == "IEND" {
+			break
+		}
+		pos = chunk.end + 4
+	}
+	return chunks, nil
+}
+
+// findPNGExif locates the TIFF structure inside the eXIf chunk of a PNG.
+func findPNGExif(data []byte) (int, int, error) {
+	chunks, err := pngChunks(data)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, chunk := range chunks {
+		if chunk.typ == "eXIf" {
+			return chunk.start, chunk.end, nil
+		}
+	}
+	return 0, 0, errNoExif
+}
+
+// dropPNGMetadata returns a copy of a PNG without the text chunks holding raw
+// EXIF profiles and, when xmp is set, without its XMP chunk.
+func dropPNGMetadata(data []byte, xmp bool) ([]byte, error) {
+	chunks, err := pngChunks(data)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, pngSignature...)
+	pos := len(pngSignature)
+	for _, chunk := range chunks {
+		next := chunk.end + 4
+		if !dropPNGChunk(chunk.typ, data[chunk.start:chunk.end], xmp) {
+			out = append(out, data[pos:next]...)
+		}
+		pos = next
+	}
+	return append(out, data[pos:]...), nil
+}
+
+func dropPNGChunk(typ string, data []byte, xmp bool) bool {
+	switch typ {
+	case "tEXt", "zTXt", "iTXt":
+	default:
+		return false
+	}
+	keyword, _, _ := bytes.Cut(data, []byte{0})
+	switch string(keyword) {
+	case "Raw profile type exif", "Raw profile type APP1":
+		return true
+	case "XML:com.adobe.xmp":
+		return xmp
+	}
+	return false
+}
+
+func formatExposure(num, den uint32) string {
+	switch {
+	case num == 0 || den == 0:
+		return ""
+	case num >= den:
+		return fmt.Sprintf("%g", float64(num)/float64(den))
+	default:
+		return fmt.Sprintf("1/%d", (den+num/2)/num)
+	}
+}
+
+// tiff gives access to the IFDs of the TIFF structure embedded in EXIF data.
+// Changes made through it are written to the underlying slice.
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+type ifdEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	// offset of the entry itself within the tiff data
+	offset int
+}
+
+// size in bytes of a single value of each TIFF type
+var tiffTypeSizes = map[uint16]int{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+func newTIFF(data []byte) (*tiff, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("tiff header too short")
+	}
+	t := tiff{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("invalid tiff byte order %q", data[:2])
+	}
+	if t.order.Uint16(data[2:]) != 42 {
+		return nil, fmt.Errorf("invalid tiff magic number")
+	}
+	return &t, nil
+}
+
+func (t *tiff) firstIFD() int {
+	return int(t.order.Uint32(t.data[4:]))
+}
+
+func (t *tiff) entries(ifd int) ([]ifdEntry, error) {
+	if ifd < 8 || ifd+2 > len(t.data) {
+		return nil, fmt.Errorf("ifd offset %d out of range", ifd)
+	}
+	count := int(t.order.Uint16(t.data[ifd:]))
+	if ifd+2+count*12 > len(t.data) {
+		return nil, fmt.Errorf("ifd at %d out of range", ifd)
+	}
+	entries := make([]ifdEntry, 0, count)
+	for i := 0; i < count; i++ {
+		off := ifd + 2 + i*12
+		entries = append(entries, ifdEntry{
+			tag:    t.order.Uint16(t.data[off:]),
+			typ:    t.order.Uint16(t.data[off+2:]),
+			count:  t.order.Uint32(t.data[off+4:]),
+			offset: off,
+		})
+	}
+	return entries, nil
+}
+
+// value returns the raw bytes of an entry's value, which are stored inline
+// when they fit in 4 bytes and somewhere else in the data otherwise.
+func (t *tiff) value(e ifdEntry) []byte {
+	size := tiffTypeSizes[e.typ] * int(e.count)
+	if size <= 4 {
+		return t.data[e.offset+8 : e.offset+8+size]
+	}
+	off := int(t.order.Uint32(t.data[e.offset+8:]))
+	if off < 0 || off+size > len(t.data) {
+		return nil
+	}
+	return t.data[off : off+size]
+}
+
+func (t *tiff) ascii(e ifdEntry) string {
+	return strings.TrimSpace(strings.TrimRight(string(t.value(e)), "\x00"))
+}
+
+func (t *tiff) short(e ifdEntry) uint16 {
+	v := t.value(e)
+	if len(v) < 2 {
+		return 0
+	}
+	return t.order.Uint16(v)
+}
+
+func (t *tiff) long(e ifdEntry) int {
+	v := t.value(e)
+	if len(v) < 4 {
+		return 0
+	}
+	return int(t.order.Uint32(v))
+}
+
+func (t *tiff) rational(e ifdEntry) (uint32, uint32) {
+	v := t.value(e)
+	if len(v) < 8 {
+		return 0, 0
+	}
+	return t.order.Uint32(v), t.order.Uint32(v[4:])
+}
+
+// strip removes every entry with one of the tags from the IFD. The entries
+// after it are shifted up so the IFD stays valid, and the removed values are
+// zeroed so they can't be recovered from the bytes.
+func (t *tiff) strip(ifd int, tags []uint16) error {
+	entries, err := t.entries(ifd)
+	if err != nil {
+		return err
+	}
+	count := len(entries)
+	end := ifd + 2 + count*12 + 4
+	if end > len(t.data) {
+		return fmt.Errorf("ifd at %d out of range", ifd)
+	}
+	// walk backwards so removing an entry doesn't move the ones still to come
+	for i := count - 1; i >= 0; i-- {
+		e := entries[i]
+		if !containsTag(tags, e.tag) {
+			continue
+		}
+		if e.tag == TagGPSIFD {
+			err = t.wipeIFD(t.long(e))
+			if err != nil {
+				return err
+			}
+		}
+		clear(t.value(e))
+		copy(t.data[e.offset:end], t.data[e.offset+12:end])
+		clear(t.data[end-12 : end])
+		end -= 12
+		count--
+	}
+	t.order.PutUint16(t.data[ifd:], uint16(count))
+	return nil
+}
+
+// wipeIFD zeroes an IFD along with all of the values it points at.
+func (t *tiff) wipeIFD(ifd int) error {
+	entries, err := t.entries(ifd)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		clear(t.value(e))
+	}
+	clear(t.data[ifd : ifd+2+len(entries)*12])
+	return nil
+}
+
+func containsTag(tags []uint16, tag uint16) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
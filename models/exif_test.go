@@ -0,0 +1,244 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strings"
+	"testing"
+)
+
+// testExifTIFF returns a little endian TIFF structure with an Artist tag and
+// a GPS IFD holding only the GPS version.
+func testExifTIFF() []byte {
+	data := []byte("II*\x00")
+	data = binary.LittleEndian.AppendUint32(data, 8)
+	// IFD0 at 8 with two entries, the GPS IFD follows it at 38
+	data = binary.LittleEndian.AppendUint16(data, 2)
+	data = binary.LittleEndian.AppendUint16(data, TagArtist)
+	data = binary.LittleEndian.AppendUint16(data, 2)
+	data = binary.LittleEndian.AppendUint32(data, 4)
+	data = append(data, "Jon\x00"...)
+	data = binary.LittleEndian.AppendUint16(data, TagGPSIFD)
+	data = binary.LittleEndian.AppendUint16(data, 4)
+	data = binary.LittleEndian.AppendUint32(data, 1)
+	data = binary.LittleEndian.AppendUint32(data, 38)
+	data = binary.LittleEndian.AppendUint32(data, 0)
+	// GPS IFD with GPSVersionID 2.2.0.0
+	data = binary.LittleEndian.AppendUint16(data, 1)
+	data = binary.LittleEndian.AppendUint16(data, 0)
+	data = binary.LittleEndian.AppendUint16(data, 1)
+	data = binary.LittleEndian.AppendUint32(data, 4)
+	data = append(data, 2, 2, 0, 0)
+	return binary.LittleEndian.AppendUint32(data, 0)
+}
+
+func testPNGChunk(typ string, data []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, typ...)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// testPNG returns a 1x1 PNG with the extra chunks placed right after IHDR.
+func testPNG(t *testing.T, extra ...[]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// signature and the 13 byte IHDR chunk
+	headerEnd := len(pngSignature) + 12 + 13
+	out := append([]byte(nil), data[:headerEnd]...)
+	for _, chunk := range extra {
+		out = append(out, chunk...)
+	}
+	return append(out, data[headerEnd:]...)
+}
+
+func TestStripExifPNG(t *testing.T) {
+	data := testPNG(t,
+		testPNGChunk("eXIf", testExifTIFF()),
+		testPNGChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta/>")),
+		testPNGChunk("zTXt", []byte("Raw profile type exif\x00\x00compressed")),
+		testPNGChunk("tEXt", []byte("Comment\x00kept")),
+	)
+	meta, err := ParseExif(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ParseExif() err = %v", err)
+	}
+	if !meta.HasGPS {
+		t.Fatalf("ParseExif().HasGPS = false before stripping, want true")
+	}
+
+	stripped, err := StripExif(data, DefaultExifStripTags)
+	if err != nil {
+		t.Fatalf("StripExif() err = %v", err)
+	}
+	// the decoder checks the CRC of every chunk
+	_, err = png.Decode(bytes.NewReader(stripped))
+	if err != nil {
+		t.Fatalf("png.Decode() of the stripped image err = %v", err)
+	}
+	meta, err = ParseExif(bytes.NewReader(stripped))
+	if err != nil {
+		t.Fatalf("ParseExif() err = %v", err)
+	}
+	if meta.HasGPS {
+		t.Errorf("ParseExif().HasGPS = true after stripping, want false")
+	}
+	for _, dropped := range []string{"XML:com.adobe.xmp", "Raw profile type exif"} {
+		if bytes.Contains(stripped, []byte(dropped)) {
+			t.Errorf("stripped image still contains %q", dropped)
+		}
+	}
+	if !bytes.Contains(stripped, []byte("Comment\x00kept")) {
+		t.Errorf("stripped image lost an unrelated text chunk")
+	}
+	// Artist isn't in the default tags
+	if !bytes.Contains(stripped, []byte("Jon\x00")) {
+		t.Errorf("stripped image lost a tag that wasn't stripped")
+	}
+}
+
+func TestStripExifPNGWithoutExif(t *testing.T) {
+	data := testPNG(t)
+	stripped, err := StripExif(data, DefaultExifStripTags)
+	if err != nil {
+		t.Fatalf("StripExif() err = %v", err)
+	}
+	if !bytes.Equal(stripped, data) {
+		t.Errorf("StripExif() changed a PNG without metadata")
+	}
+}
+
+func testJPEGSegment(marker byte, data []byte) []byte {
+	segment := []byte{0xFF, marker}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(data)+2))
+	return append(segment, data...)
+}
+
+// testJPEG returns a small JPEG with the extra segments placed right after
+// the start of image marker.
+func testJPEG(t *testing.T, extra ...[]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	out := append([]byte(nil), data[:2]...)
+	for _, segment := range extra {
+		out = append(out, segment...)
+	}
+	return append(out, data[2:]...)
+}
+
+func TestStripExifJPEG(t *testing.T) {
+	exif := testJPEGSegment(0xE1, append([]byte("Exif\x00\x00"), testExifTIFF()...))
+	xmp := testJPEGSegment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>"))
+	// fill bytes may come before any marker
+	filled := append([]byte{0xFF, 0xFF}, exif...)
+	tests := map[string]struct {
+		data      []byte
+		tags      []uint16
+		artist    bool
+		gps       bool
+		xmp       bool
+		unchanged bool
+	}{
+		"default tags": {
+			data:   testJPEG(t, exif, xmp),
+			tags:   DefaultExifStripTags,
+			artist: true,
+		},
+		"artist only": {
+			data: testJPEG(t, exif, xmp),
+			tags: []uint16{TagArtist},
+			gps:  true,
+			xmp:  true,
+		},
+		"fill bytes": {
+			data:   testJPEG(t, filled, xmp),
+			tags:   DefaultExifStripTags,
+			artist: true,
+		},
+		"no exif": {
+			data:      testJPEG(t),
+			tags:      DefaultExifStripTags,
+			unchanged: true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			stripped, err := StripExif(tc.data, tc.tags)
+			if err != nil {
+				t.Fatalf("StripExif() err = %v", err)
+			}
+			if tc.unchanged {
+				if !bytes.Equal(stripped, tc.data) {
+					t.Errorf("StripExif() changed a JPEG without metadata")
+				}
+				return
+			}
+			_, err = jpeg.Decode(bytes.NewReader(stripped))
+			if err != nil {
+				t.Fatalf("jpeg.Decode() of the stripped image err = %v", err)
+			}
+			meta, err := ParseExif(bytes.NewReader(stripped))
+			if err != nil {
+				t.Fatalf("ParseExif() err = %v", err)
+			}
+			if meta.HasGPS != tc.gps {
+				t.Errorf("HasGPS = %t, want %t", meta.HasGPS, tc.gps)
+			}
+			if got := bytes.Contains(stripped, []byte("Jon\x00")); got != tc.artist {
+				t.Errorf("contains the artist = %t, want %t", got, tc.artist)
+			}
+			if got := bytes.Contains(stripped, []byte("ns.adobe.com/xap")); got != tc.xmp {
+				t.Errorf("contains XMP = %t, want %t", got, tc.xmp)
+			}
+		})
+	}
+}
+
+func TestOpenPublicUnparsableExif(t *testing.T) {
+	// the TIFF structure has no valid byte order, decoders skip it anyway
+	data := testJPEG(t, testJPEGSegment(0xE1, []byte("Exif\x00\x00XX*\x00GPS")))
+	if _, err := StripExif(data, DefaultExifStripTags); err == nil {
+		t.Fatalf("StripExif() err = nil, want the broken segment to fail")
+	}
+	service := ImageService{
+		Storage: &MemoryStorage{},
+	}
+	err := service.Storage.Put("galleries/1/photo.jpg", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := service.OpenPublic(Image{
+		GalleryID: 1,
+		Key:       "galleries/1/photo.jpg",
+		Filename:  "photo.jpg",
+	})
+	if err != nil {
+		t.Fatalf("OpenPublic() err = %v", err)
+	}
+	served, err := io.ReadAll(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(served), "Exif") {
+		t.Errorf("OpenPublic() served the unparsable metadata")
+	}
+	_, err = jpeg.Decode(bytes.NewReader(served))
+	if err != nil {
+		t.Errorf("jpeg.Decode() of the served image err = %v", err)
+	}
+}
@@ -2,14 +2,49 @@ package models
 
 import (
 	"database/sql"
-	"errors"
 	"fmt"
+	"lenslocked/errors"
+	"lenslocked/rand"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
+// Visibility controls who can view a gallery.
+type Visibility string
+
+const (
+	// VisibilityPrivate galleries can only be viewed by their owner.
+	VisibilityPrivate Visibility = "private"
+	// VisibilityUnlisted galleries can be viewed by anyone who has the link
+	// with their share token, but they can't be reached by their ID.
+	VisibilityUnlisted Visibility = "unlisted"
+	// VisibilityPublic galleries can be viewed by anyone.
+	VisibilityPublic Visibility = "public"
+)
+
+// BytesPerShareToken is the number of random bytes used for the share token
+// of unlisted galleries.
+const BytesPerShareToken = 32
+
+func (v Visibility) Valid() bool {
+	switch v {
+	case VisibilityPrivate, VisibilityUnlisted, VisibilityPublic:
+		return true
+	}
+	return false
+}
+
 type Gallery struct {
-	ID     int
-	UserID int
-	Title  string
+	ID         int
+	UserID     int
+	Title      string
+	Visibility Visibility
+	// ShareToken is the unguessable part of an unlisted gallery's URL. It is
+	// generated the first time a gallery is made unlisted.
+	ShareToken string
+	// PasswordHash is set for galleries that visitors have to unlock with a
+	// password first.
+	PasswordHash string
 }
 
 type GalleryService struct {
@@ -18,12 +53,13 @@ type GalleryService struct {
 
 func (service *GalleryService) Create(title string, userID int) (*Gallery, error) {
 	gallery := Gallery{
-		Title:  title,
-		UserID: userID,
+		Title:      title,
+		UserID:     userID,
+		Visibility: VisibilityPrivate,
 	}
 	row := service.DB.QueryRow(`
-		INSERT INTO galleries (title, user_id)
-		VALUES ($1, $2) RETURNING id;`, gallery.Title, gallery.UserID)
+		INSERT INTO galleries (title, user_id, visibility)
+		VALUES ($1, $2, $3) RETURNING id;`, gallery.Title, gallery.UserID, gallery.Visibility)
 	err := row.Scan(&gallery.ID)
 	if err != nil {
 		return nil, fmt.Errorf("create gallery: %w", err)
@@ -36,10 +72,12 @@ func (service *GalleryService) ByID(id int) (*Gallery, error) {
 		ID: id,
 	}
 	row := service.DB.QueryRow(`
-		SELECT title, user_id
+		SELECT title, user_id, visibility, COALESCE(share_token, ''),
+			COALESCE(password_hash, '')
 		FROM galleries
 		WHERE id = $1;`, gallery.ID)
-	err := row.Scan(&gallery.Title, &gallery.UserID)
+	err := row.Scan(&gallery.Title, &gallery.UserID, &gallery.Visibility,
+		&gallery.ShareToken, &gallery.PasswordHash)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, ErrNotFound
@@ -49,9 +87,29 @@ func (service *GalleryService) ByID(id int) (*Gallery, error) {
 	return &gallery, nil
 }
 
+func (service *GalleryService) ByShareToken(token string) (*Gallery, error) {
+	gallery := Gallery{
+		ShareToken: token,
+	}
+	row := service.DB.QueryRow(`
+		SELECT id, title, user_id, visibility, COALESCE(password_hash, '')
+		FROM galleries
+		WHERE share_token = $1;`, gallery.ShareToken)
+	err := row.Scan(&gallery.ID, &gallery.Title, &gallery.UserID,
+		&gallery.Visibility, &gallery.PasswordHash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query gallery by share token: %w", err)
+	}
+	return &gallery, nil
+}
+
 func (service *GalleryService) ByUserID(userID int) ([]Gallery, error) {
 	rows, err := service.DB.Query(`
-		SELECT id, title
+		SELECT id, title, visibility, COALESCE(share_token, ''),
+			COALESCE(password_hash, '')
 		FROM galleries
 		WHERE user_id = $1;`, userID)
 	if err != nil {
@@ -62,7 +120,8 @@ func (service *GalleryService) ByUserID(userID int) ([]Gallery, error) {
 		gallery := Gallery{
 			UserID: userID,
 		}
-		err = rows.Scan(&gallery.ID, &gallery.Title)
+		err = rows.Scan(&gallery.ID, &gallery.Title, &gallery.Visibility,
+			&gallery.ShareToken, &gallery.PasswordHash)
 		if err != nil {
 			return nil, fmt.Errorf("querry gallery by user: %w", err)
 		}
@@ -74,17 +133,66 @@ func (service *GalleryService) ByUserID(userID int) ([]Gallery, error) {
 	return galleries, nil
 }
 
+// Update saves the title and visibility of the gallery. Galleries that are
+// made unlisted get a share token if they don't have one yet.
 func (service *GalleryService) Update(gallery *Gallery) error {
+	if gallery.Visibility == VisibilityUnlisted && gallery.ShareToken == "" {
+		token, err := rand.String(BytesPerShareToken)
+		if err != nil {
+			return fmt.Errorf("update gallery: %w", err)
+		}
+		gallery.ShareToken = token
+	}
 	_, err := service.DB.Exec(`
 		UPDATE galleries
-		SET title = $2
-		WHERE id = $1;`, gallery.ID, gallery.Title)
+		SET title = $2, visibility = $3, share_token = NULLIF($4, '')
+		WHERE id = $1;`, gallery.ID, gallery.Title, gallery.Visibility, gallery.ShareToken)
 	if err != nil {
 		return fmt.Errorf("update gallery: %w", err)
 	}
 	return nil
 }
 
+// UpdatePassword protects the gallery with password. An empty password
+// removes the protection again. Passwords bcrypt can't hash are refused
+// with an errors.Public error.
+func (service *GalleryService) UpdatePassword(gallery *Gallery, password string) error {
+	passwordHash := ""
+	if len(password) > BcryptMaxPasswordBytes {
+		return errors.Public(fmt.Errorf("update gallery password: %w", bcrypt.ErrPasswordTooLong),
+			"That password is too long, please pick a shorter one.")
+	}
+	if password != "" {
+		hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return fmt.Errorf("update gallery password: %w", err)
+		}
+		passwordHash = string(hashedBytes)
+	}
+	_, err := service.DB.Exec(`
+		UPDATE galleries
+		SET password_hash = NULLIF($2, '')
+		WHERE id = $1;`, gallery.ID, passwordHash)
+	if err != nil {
+		return fmt.Errorf("update gallery password: %w", err)
+	}
+	gallery.PasswordHash = passwordHash
+	return nil
+}
+
+// CheckPassword reports whether password unlocks the gallery.
+func (service *GalleryService) CheckPassword(gallery *Gallery, password string) bool {
+	if gallery.PasswordHash == "" {
+		return true
+	}
+	// nobody could have set it, and bcrypt refuses to hash it
+	if len(password) > BcryptMaxPasswordBytes {
+		return false
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(gallery.PasswordHash), []byte(password))
+	return err == nil
+}
+
 func (service *GalleryService) Delete(id int) error {
 	_, err := service.DB.Exec(`
 		DELETE FROM galleries
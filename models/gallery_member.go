@@ -0,0 +1,228 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Role is what a user is allowed to do with a gallery.
+type Role string
+
+const (
+	// RoleViewer members can view the gallery, whatever its visibility.
+	RoleViewer Role = "viewer"
+	// RoleContributor members can also upload images.
+	RoleContributor Role = "contributor"
+	// RoleEditor members can also rename the gallery and delete images.
+	RoleEditor Role = "editor"
+	// RoleOwner is the user the gallery belongs to. It is never stored as a
+	// membership, the owner is always Gallery.UserID.
+	RoleOwner Role = "owner"
+)
+
+// Permission is a single thing that can be done with a gallery.
+type Permission int
+
+const (
+	PermissionView Permission = iota
+	PermissionUpload
+	PermissionEdit
+	// PermissionManage covers deleting the gallery and changing who can
+	// access it, which only the owner can do.
+	PermissionManage
+)
+
+var rolePermissions = map[Role]Permission{
+	RoleViewer:      PermissionView,
+	RoleContributor: PermissionUpload,
+	RoleEditor:      PermissionEdit,
+	RoleOwner:       PermissionManage,
+}
+
+// Valid reports whether the role can be given to a gallery member.
+func (r Role) Valid() bool {
+	switch r {
+	case RoleViewer, RoleContributor, RoleEditor:
+		return true
+	}
+	return false
+}
+
+// Can reports whether the role includes perm. Every role includes all the
+// permissions of the roles below it.
+func (r Role) Can(perm Permission) bool {
+	granted, ok := rolePermissions[r]
+	return ok && perm <= granted
+}
+
+type GalleryMember struct {
+	ID        int
+	GalleryID int
+	UserID    int
+	Email     string
+	Role      Role
+}
+
+type GalleryMemberService struct {
+	DB *sql.DB
+}
+
+// Add gives the user with email the role in the gallery, replacing the role
+// they had before if they were a member already. If there is no user with
+// that email address yet, the membership waits for whoever signs up with it
+// and verifies the address. Either way the result looks the same, so owners
+// can't use it to find out who has an account.
+func (service *GalleryMemberService) Add(galleryID int, email string, role Role) (*GalleryMember, error) {
+	member := GalleryMember{
+		GalleryID: galleryID,
+		Email:     strings.ToLower(email),
+		Role:      role,
+	}
+	row := service.DB.QueryRow(`
+		SELECT id FROM users WHERE email = $1;`, member.Email)
+	err := row.Scan(&member.UserID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("add member: %w", err)
+		}
+		row = service.DB.QueryRow(`
+			INSERT INTO gallery_members (gallery_id, email, role)
+			VALUES ($1, $2, $3) ON CONFLICT (gallery_id, email) DO
+			UPDATE
+			SET role = $3
+			RETURNING id;`, member.GalleryID, member.Email, member.Role)
+		err = row.Scan(&member.ID)
+		if err != nil {
+			return nil, fmt.Errorf("add member: %w", err)
+		}
+		return &member, nil
+	}
+	row = service.DB.QueryRow(`
+		INSERT INTO gallery_members (gallery_id, user_id, role)
+		VALUES ($1, $2, $3) ON CONFLICT (gallery_id, user_id) DO
+		UPDATE
+		SET role = $3
+		RETURNING id;`, member.GalleryID, member.UserID, member.Role)
+	err = row.Scan(&member.ID)
+	if err != nil {
+		return nil, fmt.Errorf("add member: %w", err)
+	}
+	// the user may have signed up since they were invited
+	_, err = service.DB.Exec(`
+		DELETE FROM gallery_members
+		WHERE gallery_id = $1 AND user_id IS NULL AND email = $2;`,
+		member.GalleryID, member.Email)
+	if err != nil {
+		return nil, fmt.Errorf("add member: %w", err)
+	}
+	return &member, nil
+}
+
+// memberOf is a condition matching the gallery_members rows of the user
+// whose ID is the query parameter param, including the rows still waiting
+// for their email address. The address only counts once it is verified.
+func memberOf(param string) string {
+	return `(gallery_members.user_id = ` + param + ` OR
+		(gallery_members.user_id IS NULL AND gallery_members.email = (
+			SELECT email FROM users
+			WHERE id = ` + param + ` AND email_verified_at IS NOT NULL)))`
+}
+
+// Role returns the role the user has as a member of the gallery.
+// ErrNotFound is returned if the user isn't a member.
+func (service *GalleryMemberService) Role(galleryID, userID int) (Role, error) {
+	var role Role
+	row := service.DB.QueryRow(`
+		SELECT role
+		FROM gallery_members
+		WHERE gallery_id = $1 AND `+memberOf("$2")+`
+		ORDER BY user_id NULLS LAST
+		LIMIT 1;`, galleryID, userID)
+	err := row.Scan(&role)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrNotFound
+		}
+		return "", fmt.Errorf("query member role: %w", err)
+	}
+	return role, nil
+}
+
+// ByGalleryID returns the members of the gallery. Members who haven't signed
+// up yet are listed like everyone else, with a UserID of 0.
+func (service *GalleryMemberService) ByGalleryID(galleryID int) ([]GalleryMember, error) {
+	rows, err := service.DB.Query(`
+		SELECT gallery_members.id, COALESCE(gallery_members.user_id, 0),
+			COALESCE(users.email, gallery_members.email), gallery_members.role
+		FROM gallery_members
+			LEFT JOIN users ON users.id = gallery_members.user_id
+		WHERE gallery_members.gallery_id = $1
+		ORDER BY 3;`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("query members by gallery: %w", err)
+	}
+	defer rows.Close()
+	var members []GalleryMember
+	for rows.Next() {
+		member := GalleryMember{
+			GalleryID: galleryID,
+		}
+		err = rows.Scan(&member.ID, &member.UserID, &member.Email, &member.Role)
+		if err != nil {
+			return nil, fmt.Errorf("query members by gallery: %w", err)
+		}
+		members = append(members, member)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query members by gallery: %w", err)
+	}
+	return members, nil
+}
+
+// SharedGallery is a gallery the user is a member of, but doesn't own.
+type SharedGallery struct {
+	Gallery Gallery
+	Role    Role
+}
+
+// Galleries returns the galleries the user is a member of, along with the
+// role they have in each of them.
+func (service *GalleryMemberService) Galleries(userID int) ([]SharedGallery, error) {
+	rows, err := service.DB.Query(`
+		SELECT DISTINCT ON (galleries.id) galleries.id, galleries.user_id,
+			galleries.title, galleries.visibility, gallery_members.role
+		FROM gallery_members
+			JOIN galleries ON galleries.id = gallery_members.gallery_id
+		WHERE `+memberOf("$1")+`
+		ORDER BY galleries.id, gallery_members.user_id NULLS LAST;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query galleries by member: %w", err)
+	}
+	defer rows.Close()
+	var shared []SharedGallery
+	for rows.Next() {
+		var sg SharedGallery
+		err = rows.Scan(&sg.Gallery.ID, &sg.Gallery.UserID, &sg.Gallery.Title,
+			&sg.Gallery.Visibility, &sg.Role)
+		if err != nil {
+			return nil, fmt.Errorf("query galleries by member: %w", err)
+		}
+		shared = append(shared, sg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query galleries by member: %w", err)
+	}
+	return shared, nil
+}
+
+func (service *GalleryMemberService) Remove(galleryID, memberID int) error {
+	_, err := service.DB.Exec(`
+		DELETE FROM gallery_members
+		WHERE id = $1 AND gallery_id = $2;`, memberID, galleryID)
+	if err != nil {
+		return fmt.Errorf("remove member: %w", err)
+	}
+	return nil
+}
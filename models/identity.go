@@ -0,0 +1,127 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ErrIdentityLinked is returned when linking an identity that already
+// belongs to another user.
+var ErrIdentityLinked = errors.New("models: identity is linked to another user")
+
+// Identity links an account at an external identity provider to a user, so
+// they can sign in with it.
+type Identity struct {
+	ID     int
+	UserID int
+	// Provider is the issuer of the identity provider and Subject the ID of
+	// the account there, which never changes.
+	Provider string
+	Subject  string
+	// Email is the email address the provider had for the account when it
+	// was linked.
+	Email     string
+	CreatedAt time.Time
+}
+
+type IdentityService struct {
+	DB *sql.DB
+}
+
+// ByProviderSubject looks up the identity a user signed in with. ErrNotFound
+// is returned if it isn't linked to any user yet.
+func (service *IdentityService) ByProviderSubject(provider, subject string) (*Identity, error) {
+	identity := Identity{
+		Provider: provider,
+		Subject:  subject,
+	}
+	row := service.DB.QueryRow(`
+		SELECT id, user_id, email, created_at
+		FROM identities
+		WHERE provider = $1 AND subject = $2;`, provider, subject)
+	err := row.Scan(&identity.ID, &identity.UserID, &identity.Email, &identity.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query identity: %w", err)
+	}
+	return &identity, nil
+}
+
+// Link adds the identity to the user. Linking an identity the user already
+// has is not an error, but ErrIdentityLinked is returned if it belongs to
+// someone else.
+func (service *IdentityService) Link(userID int, provider, subject, email string) (*Identity, error) {
+	identity := Identity{
+		UserID:   userID,
+		Provider: provider,
+		Subject:  subject,
+		Email:    email,
+	}
+	row := service.DB.QueryRow(`
+		INSERT INTO identities (user_id, provider, subject, email)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at;`, userID, provider, subject, email)
+	err := row.Scan(&identity.ID, &identity.CreatedAt)
+	if err != nil {
+		var pgError *pgconn.PgError
+		if errors.As(err, &pgError) && pgError.Code == pgerrcode.UniqueViolation {
+			existing, err := service.ByProviderSubject(provider, subject)
+			if err != nil {
+				return nil, fmt.Errorf("link identity: %w", err)
+			}
+			if existing.UserID != userID {
+				return nil, ErrIdentityLinked
+			}
+			return existing, nil
+		}
+		return nil, fmt.Errorf("link identity: %w", err)
+	}
+	return &identity, nil
+}
+
+// ByUserID returns the identities linked to the user, oldest first.
+func (service *IdentityService) ByUserID(userID int) ([]Identity, error) {
+	rows, err := service.DB.Query(`
+		SELECT id, provider, subject, email, created_at
+		FROM identities
+		WHERE user_id = $1
+		ORDER BY id;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query identities by user: %w", err)
+	}
+	defer rows.Close()
+	var identities []Identity
+	for rows.Next() {
+		identity := Identity{
+			UserID: userID,
+		}
+		err = rows.Scan(&identity.ID, &identity.Provider, &identity.Subject,
+			&identity.Email, &identity.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("query identities by user: %w", err)
+		}
+		identities = append(identities, identity)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query identities by user: %w", err)
+	}
+	return identities, nil
+}
+
+// Unlink removes one of the user's identities.
+func (service *IdentityService) Unlink(userID, id int) error {
+	_, err := service.DB.Exec(`
+		DELETE FROM identities
+		WHERE id = $1 AND user_id = $2;`, id, userID)
+	if err != nil {
+		return fmt.Errorf("unlink identity: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+type Image struct {
+	GalleryID int
+	Key       string
+	Filename  string
+	ModTime   time.Time
+}
+
+type ImageService struct {
+	// Storage holds the bytes of every image. Each gallery gets its own
+	// "galleries/<id>/" prefix of keys.
+	Storage Storage
+	// VariantWidths are the widths, in pixels, of the resized copies made of
+	// every image. Defaults to DefaultVariantWidths.
+	VariantWidths []int
+	// ExifStripTags are the EXIF tags removed from images served publicly.
+	// Defaults to DefaultExifStripTags.
+	ExifStripTags []uint16
+}
+
+// these are the only image types we accept on upload. The extension is
+// checked first and then the content type is sniffed from the file itself.
+var (
+	imageExtensions   = []string{".png", ".jpg", ".jpeg", ".gif"}
+	imageContentTypes = []string{"image/png", "image/jpeg", "image/gif"}
+)
+
+func (service *ImageService) Images(galleryID int) ([]Image, error) {
+	prefix := service.galleryPrefix(galleryID)
+	keys, err := service.Storage.List(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving gallery %d images: %w", galleryID, err)
+	}
+	var images []Image
+	for _, key := range keys {
+		filename := strings.TrimPrefix(key, prefix)
+		// anything nested deeper than the gallery prefix isn't an upload
+		if strings.Contains(filename, "/") || !hasExtension(filename, imageExtensions) {
+			continue
+		}
+		images = append(images, Image{
+			GalleryID: galleryID,
+			Key:       key,
+			Filename:  filename,
+		})
+	}
+	return images, nil
+}
+
+func (service *ImageService) Image(galleryID int, filename string) (Image, error) {
+	filename = path.Base(filename)
+	if filename == "." || filename == ".." || filename == "/" {
+		return Image{}, ErrNotFound
+	}
+	key := service.galleryPrefix(galleryID) + filename
+	info, err := service.Storage.Stat(key)
+	if err != nil {
+		// no image can be stored under a key the storage rejects
+		if errors.Is(err, ErrNotFound) || errors.Is(err, ErrInvalidKey) {
+			return Image{}, ErrNotFound
+		}
+		return Image{}, fmt.Errorf("querying for image: %w", err)
+	}
+	return Image{
+		GalleryID: galleryID,
+		Key:       key,
+		Filename:  filename,
+		ModTime:   info.ModTime,
+	}, nil
+}
+
+// Open returns the contents of the image. The caller is responsible for
+// closing it.
+func (service *ImageService) Open(image Image) (io.ReadCloser, error) {
+	rc, err := service.Storage.Get(image.Key)
+	if err != nil {
+		return nil, fmt.Errorf("opening image: %w", err)
+	}
+	return rc, nil
+}
+
+// OpenPublic returns the contents of the image with the ExifStripTags
+// removed, for serving to anyone but the gallery owner.
+func (service *ImageService) OpenPublic(image Image) (io.ReadSeeker, error) {
+	rc, err := service.Open(image)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("opening image: %w", err)
+	}
+	tags := service.ExifStripTags
+	if len(tags) == 0 {
+		tags = DefaultExifStripTags
+	}
+	stripped, err := StripExif(data, tags)
+	if err != nil {
+		// metadata that can't be parsed may still hold what should have
+		// been stripped, so serve a copy without any instead
+		stripped, err = reencode(data, image.Filename)
+		if err != nil {
+			return nil, fmt.Errorf("opening image: %w", err)
+		}
+	}
+	return bytes.NewReader(stripped), nil
+}
+
+// Create stores the contents as a new image in the gallery, along with its
+// resized variants. The filename extension and the sniffed content type both
+// have to be an accepted image type, otherwise a FileError is returned.
+func (service *ImageService) Create(galleryID int, filename string, contents io.ReadSeeker) (Image, error) {
+	filename = path.Base(filename)
+	if !hasExtension(filename, imageExtensions) {
+		return Image{}, FileError{
+			Issue: fmt.Sprintf("invalid extension: %v", path.Ext(filename)),
+		}
+	}
+	err := checkContentType(contents, imageContentTypes)
+	if err != nil {
+		return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	src, err := decodeImage(contents)
+	if err != nil {
+		return Image{}, FileError{
+			Issue: fmt.Sprintf("could not decode image: %v", err),
+		}
+	}
+	key := service.galleryPrefix(galleryID) + filename
+	err = service.Storage.Put(key, contents)
+	if err != nil {
+		return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	err = service.createVariants(galleryID, filename, src)
+	if err != nil {
+		return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	return Image{
+		GalleryID: galleryID,
+		Key:       key,
+		Filename:  filename,
+	}, nil
+}
+
+func (service *ImageService) Delete(galleryID int, filename string) error {
+	image, err := service.Image(galleryID, filename)
+	if err != nil {
+		return fmt.Errorf("deleting image: %w", err)
+	}
+	err = service.Storage.Delete(image.Key)
+	if err != nil {
+		return fmt.Errorf("deleting image: %w", err)
+	}
+	err = service.deleteVariants(galleryID, image.Filename)
+	if err != nil {
+		return fmt.Errorf("deleting image: %w", err)
+	}
+	return nil
+}
+
+// DeleteAll removes every object stored for the gallery. It is used when the
+// gallery itself is deleted.
+func (service *ImageService) DeleteAll(galleryID int) error {
+	keys, err := service.Storage.List(service.galleryPrefix(galleryID))
+	if err != nil {
+		return fmt.Errorf("deleting gallery %d images: %w", galleryID, err)
+	}
+	for _, key := range keys {
+		err = service.Storage.Delete(key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("deleting gallery %d images: %w", galleryID, err)
+		}
+	}
+	return nil
+}
+
+func (service *ImageService) galleryPrefix(id int) string {
+	return fmt.Sprintf("galleries/%d/", id)
+}
+
+func hasExtension(file string, extensions []string) bool {
+	for _, ext := range extensions {
+		file = strings.ToLower(file)
+		ext = strings.ToLower(ext)
+		if path.Ext(file) == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// checkContentType sniffs the first 512 bytes of r and makes sure the
+// detected content type is one of the allowed types. r is seeked back to the
+// start afterwards so it can be read again.
+func checkContentType(r io.ReadSeeker, allowedTypes []string) error {
+	testBytes := make([]byte, 512)
+	n, err := r.Read(testBytes)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("checking content type: %w", err)
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("checking content type: %w", err)
+	}
+	contentType := http.DetectContentType(testBytes[:n])
+	for _, t := range allowedTypes {
+		if contentType == t {
+			return nil
+		}
+	}
+	return FileError{
+		Issue: fmt.Sprintf("invalid content type: %v", contentType),
+	}
+}
@@ -0,0 +1,86 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ImageMetadata is the EXIF information we keep about an uploaded image.
+// Fields the camera didn't record are left at their zero value.
+type ImageMetadata struct {
+	ID           int
+	GalleryID    int
+	Filename     string
+	CameraMake   string
+	CameraModel  string
+	LensModel    string
+	ExposureTime string
+	FNumber      float64
+	ISO          int
+	FocalLength  float64
+	TakenAt      *time.Time
+	// HasGPS reports whether the original file contains a location. The
+	// coordinates themselves are never stored.
+	HasGPS bool
+}
+
+type ImageMetadataService struct {
+	DB *sql.DB
+}
+
+// Create stores the metadata of an image, replacing whatever was stored for
+// an earlier upload with the same filename.
+func (service *ImageMetadataService) Create(meta *ImageMetadata) error {
+	row := service.DB.QueryRow(`
+		INSERT INTO image_metadata (gallery_id, filename, camera_make,
+			camera_model, lens_model, exposure_time, f_number, iso,
+			focal_length, taken_at, has_gps)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (gallery_id, filename) DO
+		UPDATE
+		SET camera_make = $3, camera_model = $4, lens_model = $5,
+			exposure_time = $6, f_number = $7, iso = $8, focal_length = $9,
+			taken_at = $10, has_gps = $11
+		RETURNING id;`, meta.GalleryID, meta.Filename, meta.CameraMake,
+		meta.CameraModel, meta.LensModel, meta.ExposureTime, meta.FNumber,
+		meta.ISO, meta.FocalLength, meta.TakenAt, meta.HasGPS)
+	err := row.Scan(&meta.ID)
+	if err != nil {
+		return fmt.Errorf("create image metadata: %w", err)
+	}
+	return nil
+}
+
+func (service *ImageMetadataService) ByImage(galleryID int, filename string) (*ImageMetadata, error) {
+	meta := ImageMetadata{
+		GalleryID: galleryID,
+		Filename:  filename,
+	}
+	row := service.DB.QueryRow(`
+		SELECT id, camera_make, camera_model, lens_model, exposure_time,
+			f_number, iso, focal_length, taken_at, has_gps
+		FROM image_metadata
+		WHERE gallery_id = $1 AND filename = $2;`, galleryID, filename)
+	err := row.Scan(&meta.ID, &meta.CameraMake, &meta.CameraModel,
+		&meta.LensModel, &meta.ExposureTime, &meta.FNumber, &meta.ISO,
+		&meta.FocalLength, &meta.TakenAt, &meta.HasGPS)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query image metadata: %w", err)
+	}
+	return &meta, nil
+}
+
+func (service *ImageMetadataService) Delete(galleryID int, filename string) error {
+	_, err := service.DB.Exec(`
+		DELETE FROM image_metadata
+		WHERE gallery_id = $1 AND filename = $2;`, galleryID, filename)
+	if err != nil {
+		return fmt.Errorf("delete image metadata: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// rejectingStorage is a LocalStorage that also rejects keys with spaces,
+// like a backend with stricter rules for keys would.
+type rejectingStorage struct {
+	LocalStorage
+}
+
+func (rs *rejectingStorage) Stat(key string) (ObjectInfo, error) {
+	if strings.Contains(key, " ") {
+		return ObjectInfo{}, fmt.Errorf("%w: %q", ErrInvalidKey, key)
+	}
+	return rs.LocalStorage.Stat(key)
+}
+
+func TestImageNotFound(t *testing.T) {
+	storage := &rejectingStorage{LocalStorage{Dir: t.TempDir()}}
+	service := ImageService{
+		Storage: storage,
+	}
+	putString(t, storage, "galleries/1/photo.jpg", "data")
+	if _, err := service.Image(1, "photo.jpg"); err != nil {
+		t.Fatalf("Image() err = %v", err)
+	}
+	for _, filename := range []string{"", ".", "..", "/", "../../1/photo.jpg/..", "missing.jpg", "my photo.jpg"} {
+		_, err := service.Image(1, filename)
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Image(%q) err = %v, want ErrNotFound", filename, err)
+		}
+	}
+	_, err := service.Image(2, "photo.jpg")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Image() of another gallery err = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,229 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"path"
+	"strings"
+)
+
+// DefaultVariantWidths are the widths, in pixels, of the resized copies
+// generated for every uploaded image when ImageService.VariantWidths is not
+// set.
+var DefaultVariantWidths = []int{320, 800, 1600}
+
+const variantJPEGQuality = 85
+
+// Widths returns the widths of the variants generated for each image.
+func (service *ImageService) Widths() []int {
+	if len(service.VariantWidths) == 0 {
+		return DefaultVariantWidths
+	}
+	return service.VariantWidths
+}
+
+// Variant returns the copy of image resized to width. Variants are created
+// when an image is uploaded, but images uploaded before variants existed get
+// theirs generated the first time they are requested. ErrNotFound is returned
+// if width isn't one of the configured variant widths.
+func (service *ImageService) Variant(img Image, width int) (Image, error) {
+	if !service.isVariantWidth(width) {
+		return Image{}, ErrNotFound
+	}
+	variant := Image{
+		GalleryID: img.GalleryID,
+		Key:       service.variantKey(img.GalleryID, img.Filename, width),
+		Filename:  img.Filename,
+	}
+	info, err := service.Storage.Stat(variant.Key)
+	if err == nil {
+		variant.ModTime = info.ModTime
+		return variant, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return Image{}, fmt.Errorf("variant: %w", err)
+	}
+
+	rc, err := service.Storage.Get(img.Key)
+	if err != nil {
+		return Image{}, fmt.Errorf("variant: %w", err)
+	}
+	defer rc.Close()
+	src, err := decodeLimited(rc)
+	if err != nil {
+		return Image{}, fmt.Errorf("variant: decoding %v: %w", img.Key, err)
+	}
+	err = service.createVariant(img.GalleryID, img.Filename, src, width)
+	if err != nil {
+		return Image{}, fmt.Errorf("variant: %w", err)
+	}
+	info, err = service.Storage.Stat(variant.Key)
+	if err != nil {
+		return Image{}, fmt.Errorf("variant: %w", err)
+	}
+	variant.ModTime = info.ModTime
+	return variant, nil
+}
+
+func (service *ImageService) createVariants(galleryID int, filename string, src image.Image) error {
+	for _, width := range service.Widths() {
+		err := service.createVariant(galleryID, filename, src, width)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (service *ImageService) createVariant(galleryID int, filename string, src image.Image, width int) error {
+	var buf bytes.Buffer
+	err := encodeImage(&buf, resize(src, width), filename)
+	if err != nil {
+		return fmt.Errorf("encoding %dpx variant of %v: %w", width, filename, err)
+	}
+	err = service.Storage.Put(service.variantKey(galleryID, filename, width), &buf)
+	if err != nil {
+		return fmt.Errorf("storing %dpx variant of %v: %w", width, filename, err)
+	}
+	return nil
+}
+
+// encodeImage encodes img in the format the extension of filename stands
+// for.
+func encodeImage(w io.Writer, img image.Image, filename string) error {
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".png":
+		return png.Encode(w, img)
+	case ".gif":
+		return gif.Encode(w, img, nil)
+	default:
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: variantJPEGQuality})
+	}
+}
+
+// reencode decodes data and encodes it again, which leaves all of its
+// metadata behind.
+func reencode(data []byte, filename string) ([]byte, error) {
+	img, err := decodeLimited(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("reencode %v: %w", filename, err)
+	}
+	var buf bytes.Buffer
+	err = encodeImage(&buf, img, filename)
+	if err != nil {
+		return nil, fmt.Errorf("reencode %v: %w", filename, err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (service *ImageService) deleteVariants(galleryID int, filename string) error {
+	for _, width := range service.Widths() {
+		err := service.Storage.Delete(service.variantKey(galleryID, filename, width))
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("deleting %dpx variant of %v: %w", width, filename, err)
+		}
+	}
+	return nil
+}
+
+func (service *ImageService) isVariantWidth(width int) bool {
+	for _, w := range service.Widths() {
+		if w == width {
+			return true
+		}
+	}
+	return false
+}
+
+// variantKey places the variants in a sub-directory of the gallery, which
+// keeps them out of the gallery's image listing.
+func (service *ImageService) variantKey(galleryID int, filename string, width int) string {
+	return fmt.Sprintf("%svariants/%d/%s", service.galleryPrefix(galleryID), width, filename)
+}
+
+// resize scales src down to width pixels wide, keeping the aspect ratio.
+// Every destination pixel is the average of the source pixels it covers,
+// which gives smooth results when shrinking large photos. Images that are
+// already narrower than width are copied as is, they are never scaled up.
+func resize(src image.Image, width int) image.Image {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	if srcW <= width || srcW == 0 {
+		width = srcW
+	}
+	height := srcH * width / max(srcW, 1)
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA64(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*srcH/height
+		y1 := bounds.Min.Y + max((y+1)*srcH/height, y*srcH/height+1)
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*srcW/width
+			x1 := bounds.Min.X + max((x+1)*srcW/width, x*srcW/width+1)
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					sr, sg, sb, sa := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(sr), g+uint64(sg), b+uint64(sb), a+uint64(sa)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(b / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
+
+// MaxImagePixels is the largest width times height of an image that gets
+// decoded. A small file can claim to be a huge image, which would take
+// gigabytes of memory to decode.
+const MaxImagePixels = 50_000_000
+
+// decodeImage decodes contents and seeks back to the start so the original
+// bytes can still be stored afterwards.
+func decodeImage(contents io.ReadSeeker) (image.Image, error) {
+	img, err := decodeLimited(contents)
+	if err != nil {
+		return nil, err
+	}
+	_, err = contents.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// decodeLimited reads the size of the image from its header first, and only
+// decodes it if it has at most MaxImagePixels.
+func decodeLimited(r io.Reader) (image.Image, error) {
+	// the header is read again by Decode
+	var header bytes.Buffer
+	config, _, err := image.DecodeConfig(io.TeeReader(r, &header))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width <= 0 || config.Height <= 0 ||
+		config.Width > MaxImagePixels/config.Height {
+		return nil, fmt.Errorf("image of %dx%d pixels is larger than %d pixels",
+			config.Width, config.Height, MaxImagePixels)
+	}
+	img, _, err := image.Decode(io.MultiReader(&header, r))
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
@@ -0,0 +1,100 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const DefaultImpersonationDuration = time.Hour
+
+// Impersonate makes the session with the token act as the user, until
+// StopImpersonating is called or the ImpersonationDuration is over. The
+// session has to belong to an admin, and admins can't be impersonated.
+func (ss *SessionService) Impersonate(token string, userID int) error {
+	res, err := ss.DB.Exec(`
+		UPDATE sessions
+		SET impersonated_user_id = $2, impersonation_started_at = NOW()
+		FROM users AS admins, users AS targets
+		WHERE sessions.token_hash = $1
+			AND admins.id = sessions.user_id AND admins.is_admin
+			AND targets.id = $2 AND NOT targets.is_admin;`, ss.Hash(token), userID)
+	if err != nil {
+		return fmt.Errorf("impersonate: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("impersonate: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("impersonate: %w", ErrNotFound)
+	}
+	return nil
+}
+
+// StopImpersonating turns the session with the token back into the admin's
+// own.
+func (ss *SessionService) StopImpersonating(token string) error {
+	_, err := ss.DB.Exec(`
+		UPDATE sessions
+		SET impersonated_user_id = NULL, impersonation_started_at = NULL
+		WHERE token_hash = $1;`, ss.Hash(token))
+	if err != nil {
+		return fmt.Errorf("stop impersonating: %w", err)
+	}
+	return nil
+}
+
+// impersonatedUser looks up the user the admin's session impersonates. It
+// returns nil, and ends the impersonation, once it is over or the admin
+// isn't an admin anymore.
+func (ss *SessionService) impersonatedUser(session *Session, admin *User, userID int, startedAt time.Time) (*User, error) {
+	duration := ss.ImpersonationDuration
+	if duration == 0 {
+		duration = DefaultImpersonationDuration
+	}
+	user := User{
+		ID: userID,
+	}
+	row := ss.DB.QueryRow(`
+		SELECT email, password_hash, email_verified_at, is_admin, suspended_at
+		FROM users
+		WHERE id = $1;`, userID)
+	err := row.Scan(&user.Email, &user.PasswordHash, &user.EmailVerifiedAt,
+		&user.IsAdmin, &user.SuspendedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	switch {
+	case !admin.IsAdmin:
+		return nil, ss.endImpersonation(session, admin, &user, "admin role revoked")
+	case time.Since(startedAt) > duration:
+		return nil, ss.endImpersonation(session, admin, &user, "expired")
+	}
+	return &user, nil
+}
+
+// endImpersonation turns the session back into the admin's own when the
+// impersonation ends by itself, and records that in the audit log. Of
+// concurrent requests, only the first one to end it records it.
+func (ss *SessionService) endImpersonation(session *Session, admin, user *User, reason string) error {
+	res, err := ss.DB.Exec(`
+		UPDATE sessions
+		SET impersonated_user_id = NULL, impersonation_started_at = NULL
+		WHERE id = $1 AND impersonated_user_id = $2;`, session.ID, user.ID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 || ss.AuditLogService == nil {
+		return nil
+	}
+	return ss.AuditLogService.Record(admin, AuditStopImpersonation, user, reason)
+}
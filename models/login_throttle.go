@@ -0,0 +1,364 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"lenslocked/rand"
+	"strings"
+	"time"
+)
+
+// LoginThrottleService slows down password guessing. It counts sign in
+// attempts per account and per IP address before the password is checked,
+// and takes them back when it was right. Once there are too many it makes
+// the next attempt wait, twice as long after every further failure.
+// Accounts are locked for a while when the failures keep coming. The
+// counters are kept in the database, so the limits hold across app
+// instances.
+type LoginThrottleService struct {
+	DB *sql.DB
+	// Threshold is how many failures an account gets before attempts are
+	// held back. Defaults to DefaultLoginThreshold.
+	Threshold int
+	// IPThreshold does the same for an IP address, which may be shared by
+	// many users. Defaults to DefaultLoginIPThreshold.
+	IPThreshold int
+	// LockThreshold is how many failures lock an account. Defaults to
+	// DefaultLoginLockThreshold.
+	LockThreshold int
+	// BaseDelay is the wait after the first failure past the threshold,
+	// growing up to MaxDelay. They default to DefaultLoginBaseDelay and
+	// DefaultLoginMaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// LockDuration is how long a locked account stays locked unless it is
+	// unlocked by email. Defaults to DefaultLoginLockDuration.
+	LockDuration time.Duration
+	// Window is how long failures are remembered after the last one.
+	// Defaults to DefaultLoginWindow.
+	Window time.Duration
+}
+
+const (
+	DefaultLoginThreshold     = 5
+	DefaultLoginIPThreshold   = 20
+	DefaultLoginLockThreshold = 10
+	DefaultLoginBaseDelay     = time.Second
+	DefaultLoginMaxDelay      = 15 * time.Minute
+	DefaultLoginLockDuration  = time.Hour
+	DefaultLoginWindow        = time.Hour
+)
+
+func (service *LoginThrottleService) emailKey(email string) string {
+	return "email:" + strings.ToLower(email)
+}
+
+func (service *LoginThrottleService) twoFactorKey(userID int) string {
+	return fmt.Sprintf("2fa:%d", userID)
+}
+
+func (service *LoginThrottleService) galleryKey(galleryID int, ip string) string {
+	return fmt.Sprintf("gallery:%d:%s", galleryID, ip)
+}
+
+func (service *LoginThrottleService) ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+func (service *LoginThrottleService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+// Attempt counts a sign in for the email address from the IP address before
+// the password is checked, and reports whether it may be attempted now. If
+// not, it returns how long to wait together with ErrTooManyAttempts, or
+// ErrAccountLocked if the account is locked. Counting first means a burst of
+// concurrent guesses can't all get in before any of them is counted.
+func (service *LoginThrottleService) Attempt(email, ip string) (time.Duration, error) {
+	wait, err := service.attempt(service.emailKey(email), service.threshold(), service.lockThreshold(), ip)
+	if err != nil {
+		return wait, fmt.Errorf("login attempt: %w", err)
+	}
+	return 0, nil
+}
+
+// attempt does the work of Attempt, AttemptTwoFactor and
+// AttemptGalleryUnlock. The attempt is counted for the IP address first and
+// then for the account's key, a lockThreshold of 0 never holds the account
+// back for good. An attempt that isn't allowed isn't counted.
+func (service *LoginThrottleService) attempt(accountKey string, threshold, lockThreshold int, ip string) (time.Duration, error) {
+	ipKey := service.ipKey(ip)
+	wait, err := service.count(ipKey, service.ipThreshold(), 0)
+	if err != nil {
+		return wait, err
+	}
+	wait, err = service.count(accountKey, threshold, lockThreshold)
+	if err != nil {
+		if errors.Is(err, ErrTooManyAttempts) || errors.Is(err, ErrAccountLocked) {
+			if err2 := service.uncount(ipKey); err2 != nil {
+				return 0, err2
+			}
+		}
+		return wait, err
+	}
+	return 0, nil
+}
+
+// count adds an attempt to the key in a single statement, unless the key is
+// locked or has to wait. The earlier attempts are forgotten if they are
+// older than the window or the lock they led to expired.
+func (service *LoginThrottleService) count(key string, threshold, lockThreshold int) (time.Duration, error) {
+	var failures int
+	row := service.DB.QueryRow(`
+		INSERT INTO login_throttles (key, failures, last_failed_at)
+		VALUES ($1, 1, NOW()) ON CONFLICT (key) DO
+		UPDATE
+		SET failures = CASE
+				WHEN login_throttles.last_failed_at < $2
+					OR login_throttles.locked_until <= NOW() THEN 1
+				ELSE login_throttles.failures + 1
+			END,
+			locked_until = CASE
+				WHEN login_throttles.locked_until <= NOW() THEN NULL
+				ELSE login_throttles.locked_until
+			END,
+			unlock_token_hash = CASE
+				WHEN login_throttles.locked_until <= NOW() THEN NULL
+				ELSE login_throttles.unlock_token_hash
+			END,
+			last_failed_at = NOW()
+		WHERE (login_throttles.locked_until IS NULL OR login_throttles.locked_until <= NOW())
+			AND (login_throttles.last_failed_at < $2
+				OR login_throttles.locked_until <= NOW()
+				OR (($4::int = 0 OR login_throttles.failures < $4::int)
+					AND (login_throttles.failures < $3::int
+						OR login_throttles.last_failed_at + LEAST(
+							$5::float8 * POWER(2, LEAST(login_throttles.failures - $3::int, 30)), $6::float8
+						) * INTERVAL '1 second' <= NOW())))
+		RETURNING failures;`, key, time.Now().Add(-service.window()), threshold, lockThreshold,
+		service.baseDelay().Seconds(), service.maxDelay().Seconds())
+	err := row.Scan(&failures)
+	if err == nil {
+		return 0, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("count attempt: %w", err)
+	}
+	// held back, read the row again to tell how long for
+	var lastFailedAt time.Time
+	var lockedUntil *time.Time
+	row = service.DB.QueryRow(`
+		SELECT failures, last_failed_at, locked_until
+		FROM login_throttles
+		WHERE key = $1;`, key)
+	err = row.Scan(&failures, &lastFailedAt, &lockedUntil)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("count attempt: %w", err)
+	}
+	if lockedUntil != nil && time.Now().Before(*lockedUntil) {
+		return time.Until(*lockedUntil), ErrAccountLocked
+	}
+	wait := time.Until(lastFailedAt.Add(service.delay(failures, threshold)))
+	if lockThreshold != 0 && failures >= lockThreshold {
+		// the attempts that got the account here are still being checked,
+		// it will be locked in a moment if they were wrong and is held
+		// back until they are forgotten if that never happens
+		wait = time.Until(lastFailedAt.Add(service.window()))
+	}
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return wait, ErrTooManyAttempts
+}
+
+// uncount takes back an attempt counted for the key.
+func (service *LoginThrottleService) uncount(key string) error {
+	_, err := service.DB.Exec(`
+		UPDATE login_throttles
+		SET failures = failures - 1
+		WHERE key = $1 AND failures > 0;`, key)
+	if err != nil {
+		return fmt.Errorf("uncount attempt: %w", err)
+	}
+	return nil
+}
+
+// Fail records that an attempt counted by Attempt had the wrong password.
+// If that locked the account, the token to unlock it early is returned.
+func (service *LoginThrottleService) Fail(email string) (string, error) {
+	token, err := rand.String(MinBytesPerToken)
+	if err != nil {
+		return "", fmt.Errorf("login failed: %w", err)
+	}
+	res, err := service.DB.Exec(`
+		UPDATE login_throttles
+		SET locked_until = $3, unlock_token_hash = $4
+		WHERE key = $1 AND failures >= $2 AND locked_until IS NULL;`,
+		service.emailKey(email), service.lockThreshold(),
+		time.Now().Add(service.lockDuration()), service.hash(token))
+	if err != nil {
+		return "", fmt.Errorf("login failed: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return "", fmt.Errorf("login failed: %w", err)
+	}
+	if n == 0 {
+		// not enough failures yet, or another request locked the account
+		// first
+		return "", nil
+	}
+	return token, nil
+}
+
+// Succeed forgets the attempts on the account after the right password. The
+// attempts from the IP address are kept, only this one is taken back, or
+// signing in to an account of their own would let attackers keep guessing
+// the passwords of others.
+func (service *LoginThrottleService) Succeed(email, ip string) error {
+	err := service.succeed(service.emailKey(email), ip)
+	if err != nil {
+		return fmt.Errorf("login succeeded: %w", err)
+	}
+	return nil
+}
+
+func (service *LoginThrottleService) succeed(accountKey, ip string) error {
+	_, err := service.DB.Exec(`
+		DELETE FROM login_throttles
+		WHERE key = $1;`, accountKey)
+	if err != nil {
+		return err
+	}
+	return service.uncount(service.ipKey(ip))
+}
+
+// AttemptTwoFactor is Attempt for the codes users enter after their
+// password. Codes are counted apart from passwords, so signing in with the
+// password again doesn't reset them. Accounts aren't locked over them, the
+// growing wait is enough to make guessing codes hopeless.
+func (service *LoginThrottleService) AttemptTwoFactor(userID int, ip string) (time.Duration, error) {
+	wait, err := service.attempt(service.twoFactorKey(userID), service.threshold(), 0, ip)
+	if err != nil {
+		return wait, fmt.Errorf("two factor attempt: %w", err)
+	}
+	return 0, nil
+}
+
+// SucceedTwoFactor forgets the two factor attempts of the user after a
+// valid code.
+func (service *LoginThrottleService) SucceedTwoFactor(userID int, ip string) error {
+	err := service.succeed(service.twoFactorKey(userID), ip)
+	if err != nil {
+		return fmt.Errorf("two factor succeeded: %w", err)
+	}
+	return nil
+}
+
+// AttemptGalleryUnlock is Attempt for the passwords of protected galleries,
+// counted per gallery and IP address.
+func (service *LoginThrottleService) AttemptGalleryUnlock(galleryID int, ip string) (time.Duration, error) {
+	wait, err := service.attempt(service.galleryKey(galleryID, ip), service.threshold(), 0, ip)
+	if err != nil {
+		return wait, fmt.Errorf("gallery unlock attempt: %w", err)
+	}
+	return 0, nil
+}
+
+// SucceedGalleryUnlock forgets the attempts on the gallery from the IP
+// address after the right password.
+func (service *LoginThrottleService) SucceedGalleryUnlock(galleryID int, ip string) error {
+	err := service.succeed(service.galleryKey(galleryID, ip), ip)
+	if err != nil {
+		return fmt.Errorf("gallery unlock succeeded: %w", err)
+	}
+	return nil
+}
+
+// Unlock lifts the lock the token was issued for, and returns the email
+// address of the account. ErrNotFound is returned if the token is invalid or
+// the lock has expired anyway.
+func (service *LoginThrottleService) Unlock(token string) (string, error) {
+	var key string
+	row := service.DB.QueryRow(`
+		DELETE FROM login_throttles
+		WHERE unlock_token_hash = $1 AND locked_until > NOW()
+		RETURNING key;`, service.hash(token))
+	err := row.Scan(&key)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrNotFound
+		}
+		return "", fmt.Errorf("unlock login: %w", err)
+	}
+	return strings.TrimPrefix(key, "email:"), nil
+}
+
+// delay is how long to wait after the last of the failures, doubling with
+// every failure past the threshold.
+func (service *LoginThrottleService) delay(failures, threshold int) time.Duration {
+	if failures < threshold {
+		return 0
+	}
+	delay, max := service.baseDelay(), service.maxDelay()
+	for i := threshold; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+func (service *LoginThrottleService) baseDelay() time.Duration {
+	if service.BaseDelay == 0 {
+		return DefaultLoginBaseDelay
+	}
+	return service.BaseDelay
+}
+
+func (service *LoginThrottleService) maxDelay() time.Duration {
+	if service.MaxDelay == 0 {
+		return DefaultLoginMaxDelay
+	}
+	return service.MaxDelay
+}
+
+func (service *LoginThrottleService) threshold() int {
+	if service.Threshold == 0 {
+		return DefaultLoginThreshold
+	}
+	return service.Threshold
+}
+
+func (service *LoginThrottleService) ipThreshold() int {
+	if service.IPThreshold == 0 {
+		return DefaultLoginIPThreshold
+	}
+	return service.IPThreshold
+}
+
+func (service *LoginThrottleService) lockThreshold() int {
+	if service.LockThreshold == 0 {
+		return DefaultLoginLockThreshold
+	}
+	return service.LockThreshold
+}
+
+func (service *LoginThrottleService) lockDuration() time.Duration {
+	if service.LockDuration == 0 {
+		return DefaultLoginLockDuration
+	}
+	return service.LockDuration
+}
+
+func (service *LoginThrottleService) window() time.Duration {
+	if service.Window == 0 {
+		return DefaultLoginWindow
+	}
+	return service.Window
+}
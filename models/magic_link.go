@@ -0,0 +1,124 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"lenslocked/rand"
+	"strings"
+	"time"
+)
+
+type MagicLink struct {
+	ID     int
+	UserID int
+	// Token is only set when a MagicLink is being created
+	Token     string
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+// MagicLinkService issues the single use links users can sign in with
+// instead of their password.
+type MagicLinkService struct {
+	DB *sql.DB
+	// BytesPerToken is used to determine how many bytes to use when generating
+	// each magic link token. Defaults to MinBytesPerToken.
+	BytesPerToken int
+	// Duration for MagicLink. Defaults to DefaultMagicLinkDuration
+	Duration time.Duration
+}
+
+const (
+	DefaultMagicLinkDuration = 15 * time.Minute
+)
+
+func (service *MagicLinkService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+// Create issues a magic link for the user with the email address, replacing
+// any earlier link of theirs. ErrNotFound is returned if no user has that
+// email address.
+func (service *MagicLinkService) Create(email string) (*MagicLink, error) {
+	email = strings.ToLower(email)
+	var userID int
+	row := service.DB.QueryRow(`
+		SELECT id FROM users WHERE email = $1;`, email)
+	err := row.Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("create magic link: %w", err)
+	}
+
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken == 0 {
+		bytesPerToken = MinBytesPerToken
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create magic link: %w", err)
+	}
+	duration := service.Duration
+	if duration == 0 {
+		duration = DefaultMagicLinkDuration
+	}
+	link := MagicLink{
+		UserID:    userID,
+		Token:     token,
+		TokenHash: service.hash(token),
+		ExpiresAt: time.Now().Add(duration),
+	}
+	row = service.DB.QueryRow(`
+		INSERT INTO magic_links (user_id, token_hash, expires_at)
+		VALUES ($1, $2, $3) ON CONFLICT (user_id) DO
+		UPDATE
+		SET token_hash = $2, expires_at = $3
+		RETURNING id;`, link.UserID, link.TokenHash, link.ExpiresAt)
+	err = row.Scan(&link.ID)
+	if err != nil {
+		return nil, fmt.Errorf("create magic link: %w", err)
+	}
+	return &link, nil
+}
+
+// Consume uses up the magic link and returns the user it was issued to.
+// Following the link proves the user owns their email address, so it is
+// marked as verified as well. ErrNotFound is returned for unknown, used and
+// expired links.
+func (service *MagicLinkService) Consume(token string) (*User, error) {
+	tokenHash := service.hash(token)
+	var user User
+	var expiresAt time.Time
+	// deleting the link right away makes sure it only works once, even
+	// when it is followed twice at the same time
+	row := service.DB.QueryRow(`
+		DELETE FROM magic_links
+		WHERE token_hash = $1
+		RETURNING user_id, expires_at;`, tokenHash)
+	err := row.Scan(&user.ID, &expiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("consume magic link: %w", err)
+	}
+	if time.Now().After(expiresAt) {
+		return nil, ErrNotFound
+	}
+	row = service.DB.QueryRow(`
+		UPDATE users
+		SET email_verified_at = COALESCE(email_verified_at, NOW())
+		WHERE id = $1
+		RETURNING email, email_verified_at;`, user.ID)
+	err = row.Scan(&user.Email, &user.EmailVerifiedAt)
+	if err != nil {
+		return nil, fmt.Errorf("consume magic link: %w", err)
+	}
+	return &user, nil
+}
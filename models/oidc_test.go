@@ -0,0 +1,256 @@
+package models
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID = "lenslocked-test"
+	testNonce    = "test-nonce"
+	testVerifier = "test-verifier"
+)
+
+// testIssuer is a mock OpenID Connect provider. Its token endpoint hands out
+// whatever IDToken is set to.
+type testIssuer struct {
+	*httptest.Server
+	key     *rsa.PrivateKey
+	IDToken string
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &testIssuer{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                issuer.URL,
+			AuthorizationEndpoint: issuer.URL + "/authorize",
+			TokenEndpoint:         issuer.URL + "/token",
+			JWKSURI:               issuer.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test-key",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		clientID, _, _ := r.BasicAuth()
+		if r.FormValue("code") != "test-code" || r.FormValue("code_verifier") != testVerifier ||
+			clientID != testClientID {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"id_token": issuer.IDToken,
+		})
+	})
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+// claims returns valid ID token claims for the test client.
+func (issuer *testIssuer) claims() map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":            issuer.URL,
+		"sub":            "user-123",
+		"aud":            testClientID,
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          testNonce,
+		"email":          "Jon@Example.com",
+		"email_verified": true,
+	}
+}
+
+// sign returns claims as an RS256 ID token signed with key.
+func (issuer *testIssuer) sign(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test-key"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	hashed := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (issuer *testIssuer) provider() *OIDCProvider {
+	return &OIDCProvider{
+		Name:        "Test",
+		Issuer:      issuer.URL,
+		ClientID:    testClientID,
+		RedirectURL: "https://lenslocked.test/oauth/test/callback",
+		Client:      issuer.Client(),
+	}
+}
+
+func TestOIDCAuthCodeURL(t *testing.T) {
+	issuer := newTestIssuer(t)
+	authURL, err := issuer.provider().AuthCodeURL("test-state", testNonce, testVerifier)
+	if err != nil {
+		t.Fatalf("AuthCodeURL() err = %v", err)
+	}
+	if !strings.HasPrefix(authURL, issuer.URL+"/authorize?") {
+		t.Fatalf("AuthCodeURL() = %q, want the authorization endpoint", authURL)
+	}
+	u, _ := url.Parse(authURL)
+	challenge := sha256.Sum256([]byte(testVerifier))
+	want := map[string]string{
+		"client_id":             testClientID,
+		"state":                 "test-state",
+		"nonce":                 testNonce,
+		"code_challenge":        base64.RawURLEncoding.EncodeToString(challenge[:]),
+		"code_challenge_method": "S256",
+	}
+	for param, value := range want {
+		if got := u.Query().Get(param); got != value {
+			t.Errorf("%s = %q, want %q", param, got, value)
+		}
+	}
+}
+
+func TestOIDCExchange(t *testing.T) {
+	issuer := newTestIssuer(t)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]struct {
+		// change modifies the valid claims
+		change func(claims map[string]interface{})
+		key    *rsa.PrivateKey
+		nonce  string
+		ok     bool
+	}{
+		"valid": {
+			ok: true,
+		},
+		"audience list": {
+			change: func(claims map[string]interface{}) {
+				claims["aud"] = []string{"someone-else", testClientID}
+			},
+			ok: true,
+		},
+		"bad nonce": {
+			nonce: "another-nonce",
+		},
+		"missing nonce": {
+			change: func(claims map[string]interface{}) {
+				delete(claims, "nonce")
+			},
+		},
+		"wrong audience": {
+			change: func(claims map[string]interface{}) {
+				claims["aud"] = "someone-else"
+			},
+		},
+		"wrong issuer": {
+			change: func(claims map[string]interface{}) {
+				claims["iss"] = "https://evil.test"
+			},
+		},
+		"expired": {
+			change: func(claims map[string]interface{}) {
+				claims["exp"] = time.Now().Add(-time.Hour).Unix()
+			},
+		},
+		"issued in the future": {
+			change: func(claims map[string]interface{}) {
+				claims["iat"] = time.Now().Add(time.Hour).Unix()
+			},
+		},
+		"wrong signature": {
+			key: otherKey,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			claims := issuer.claims()
+			if tc.change != nil {
+				tc.change(claims)
+			}
+			key := issuer.key
+			if tc.key != nil {
+				key = tc.key
+			}
+			nonce := testNonce
+			if tc.nonce != "" {
+				nonce = tc.nonce
+			}
+			issuer.IDToken = issuer.sign(t, key, claims)
+			got, err := issuer.provider().Exchange("test-code", testVerifier, nonce)
+			if !tc.ok {
+				if !errors.Is(err, ErrInvalidIDToken) {
+					t.Fatalf("Exchange() err = %v, want ErrInvalidIDToken", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Exchange() err = %v", err)
+			}
+			want := OIDCClaims{
+				Subject:       "user-123",
+				Email:         "jon@example.com",
+				EmailVerified: true,
+			}
+			if *got != want {
+				t.Errorf("Exchange() = %+v, want %+v", *got, want)
+			}
+		})
+	}
+
+	t.Run("tampered claims", func(t *testing.T) {
+		token := issuer.sign(t, issuer.key, issuer.claims())
+		parts := strings.Split(token, ".")
+		claims := issuer.claims()
+		claims["sub"] = "someone-else"
+		payload, _ := json.Marshal(claims)
+		parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+		issuer.IDToken = strings.Join(parts, ".")
+		_, err := issuer.provider().Exchange("test-code", testVerifier, testNonce)
+		if !errors.Is(err, ErrInvalidIDToken) {
+			t.Fatalf("Exchange() err = %v, want ErrInvalidIDToken", err)
+		}
+	})
+
+	t.Run("wrong verifier", func(t *testing.T) {
+		issuer.IDToken = issuer.sign(t, issuer.key, issuer.claims())
+		_, err := issuer.provider().Exchange("test-code", "another-verifier", testNonce)
+		if err == nil {
+			t.Fatalf("Exchange() err = nil, want the token endpoint to refuse")
+		}
+	})
+}
@@ -0,0 +1,191 @@
+package models
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"lenslocked/rand"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher turns passwords into the hashes stored for users.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	// NeedsRehash reports whether a hash that was verified should be
+	// replaced, because it was made with another algorithm or weaker
+	// settings than the hasher uses now.
+	NeedsRehash(hash string) bool
+}
+
+// ComparePassword checks the password against a hash made by any of the
+// PasswordHashers, so users can keep signing in while hashes are migrated.
+// ErrInvalidLogin is returned if they don't match.
+func ComparePassword(hash, password string) error {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return compareArgon2id(hash, password)
+	case hash == "":
+		// users without a password
+		return ErrInvalidLogin
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err != nil {
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return ErrInvalidLogin
+		}
+		return fmt.Errorf("compare password: %w", err)
+	}
+	return nil
+}
+
+// BcryptMaxPasswordBytes is the longest password bcrypt hashes, anything
+// longer is refused with bcrypt.ErrPasswordTooLong.
+const BcryptMaxPasswordBytes = 72
+
+// BcryptHasher hashes passwords with bcrypt.
+type BcryptHasher struct {
+	// Cost defaults to bcrypt.DefaultCost.
+	Cost int
+}
+
+func (h BcryptHasher) cost() int {
+	if h.Cost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return h.Cost
+}
+
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), h.cost())
+	if err != nil {
+		return "", fmt.Errorf("bcrypt hash: %w", err)
+	}
+	return string(hashedBytes), nil
+}
+
+// NeedsRehash is true for hashes that aren't bcrypt or have a lower cost.
+func (h BcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return true
+	}
+	return cost < h.cost()
+}
+
+// Argon2idHasher hashes passwords with Argon2id. Hashes are stored in the
+// PHC string format, eg "$argon2id$v=19$m=19456,t=2,p=1$salt$key".
+type Argon2idHasher struct {
+	// Memory is in KiB. The settings default to the DefaultArgon2 ones.
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+}
+
+// The defaults follow the OWASP recommendation for Argon2id.
+const (
+	DefaultArgon2Memory  = 19 * 1024
+	DefaultArgon2Time    = 2
+	DefaultArgon2Threads = 1
+
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+func (h Argon2idHasher) params() argon2Params {
+	p := argon2Params{
+		Memory:  h.Memory,
+		Time:    h.Time,
+		Threads: h.Threads,
+	}
+	if p.Memory == 0 {
+		p.Memory = DefaultArgon2Memory
+	}
+	if p.Time == 0 {
+		p.Time = DefaultArgon2Time
+	}
+	if p.Threads == 0 {
+		p.Threads = DefaultArgon2Threads
+	}
+	return p
+}
+
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	p := h.params()
+	salt, err := rand.Bytes(argon2SaltLength)
+	if err != nil {
+		return "", fmt.Errorf("argon2id hash: %w", err)
+	}
+	key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, argon2KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		p.Memory, p.Time, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// NeedsRehash is true for hashes that aren't Argon2id or were made with
+// other settings.
+func (h Argon2idHasher) NeedsRehash(hash string) bool {
+	p, _, key, err := parseArgon2id(hash)
+	if err != nil {
+		return true
+	}
+	return p != h.params() || len(key) != argon2KeyLength
+}
+
+type argon2Params struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+}
+
+func parseArgon2id(hash string) (p argon2Params, salt, key []byte, err error) {
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, nil, nil, fmt.Errorf("parse argon2id: invalid hash")
+	}
+	var version int
+	_, err = fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("parse argon2id: %w", err)
+	}
+	if version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("parse argon2id: unsupported version %d", version)
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads)
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("parse argon2id: %w", err)
+	}
+	// argon2.IDKey panics on these
+	if p.Time == 0 || p.Threads == 0 {
+		return p, nil, nil, fmt.Errorf("parse argon2id: invalid parameters %q", parts[3])
+	}
+	salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("parse argon2id: %w", err)
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("parse argon2id: %w", err)
+	}
+	// an empty key would match every password
+	if len(salt) == 0 || len(key) == 0 {
+		return p, nil, nil, fmt.Errorf("parse argon2id: missing salt or key")
+	}
+	return p, salt, key, nil
+}
+
+func compareArgon2id(hash, password string) error {
+	p, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return fmt.Errorf("compare password: %w", err)
+	}
+	other := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return ErrInvalidLogin
+	}
+	return nil
+}
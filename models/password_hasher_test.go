@@ -0,0 +1,156 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testArgon2Hasher uses cheap settings so the tests stay fast.
+var testArgon2Hasher = Argon2idHasher{
+	Memory:  64,
+	Time:    1,
+	Threads: 1,
+}
+
+func TestComparePassword(t *testing.T) {
+	argon2Hash, err := testArgon2Hasher.Hash("correct horse")
+	if err != nil {
+		t.Fatalf("Argon2idHasher.Hash() err = %v", err)
+	}
+	bcryptHash, err := BcryptHasher{Cost: bcrypt.MinCost}.Hash("correct horse")
+	if err != nil {
+		t.Fatalf("BcryptHasher.Hash() err = %v", err)
+	}
+	tests := map[string]struct {
+		hash     string
+		password string
+		ok       bool
+	}{
+		"argon2id":                {argon2Hash, "correct horse", true},
+		"argon2id wrong password": {argon2Hash, "correct horse battery", false},
+		"bcrypt":                  {bcryptHash, "correct horse", true},
+		"bcrypt wrong password":   {bcryptHash, "Correct horse", false},
+		"no password":             {"", "", false},
+		"no password, any input":  {"", "correct horse", false},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := ComparePassword(tc.hash, tc.password)
+			if tc.ok {
+				if err != nil {
+					t.Errorf("ComparePassword() err = %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidLogin) {
+				t.Errorf("ComparePassword() err = %v, want ErrInvalidLogin", err)
+			}
+		})
+	}
+}
+
+func TestArgon2idHash(t *testing.T) {
+	hash, err := testArgon2Hasher.Hash("correct horse")
+	if err != nil {
+		t.Fatalf("Hash() err = %v", err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("Hash() = %q, want the PHC format with the hasher's settings", hash)
+	}
+	other, err := testArgon2Hasher.Hash("correct horse")
+	if err != nil {
+		t.Fatalf("Hash() err = %v", err)
+	}
+	if hash == other {
+		t.Errorf("Hash() returned the same hash twice, want a new salt every time")
+	}
+	p, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		t.Fatalf("parseArgon2id() err = %v", err)
+	}
+	if p != testArgon2Hasher.params() || len(salt) != argon2SaltLength || len(key) != argon2KeyLength {
+		t.Errorf("parseArgon2id() = %+v with %d byte salt and %d byte key", p, len(salt), len(key))
+	}
+}
+
+func TestParseArgon2idMalformed(t *testing.T) {
+	// salt "saltsaltsaltsalt" and a 32 byte key
+	const salt = "c2FsdHNhbHRzYWx0c2FsdA"
+	const key = "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+	tests := map[string]string{
+		"empty":            "",
+		"bcrypt":           "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy",
+		"argon2i":          "$argon2i$v=19$m=64,t=1,p=1$" + salt + "$" + key,
+		"missing key":      "$argon2id$v=19$m=64,t=1,p=1$" + salt,
+		"extra part":       "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$" + key + "$",
+		"old version":      "$argon2id$v=16$m=64,t=1,p=1$" + salt + "$" + key,
+		"no version":       "$argon2id$19$m=64,t=1,p=1$" + salt + "$" + key,
+		"bad parameters":   "$argon2id$v=19$m=64;t=1;p=1$" + salt + "$" + key,
+		"zero time":        "$argon2id$v=19$m=64,t=0,p=1$" + salt + "$" + key,
+		"zero threads":     "$argon2id$v=19$m=64,t=1,p=0$" + salt + "$" + key,
+		"too many threads": "$argon2id$v=19$m=64,t=1,p=256$" + salt + "$" + key,
+		"bad salt":         "$argon2id$v=19$m=64,t=1,p=1$not*base64$" + key,
+		"padded key":       "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$" + key + "=",
+		"empty salt":       "$argon2id$v=19$m=64,t=1,p=1$$" + key,
+		"empty key":        "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$",
+	}
+	for name, hash := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, _, _, err := parseArgon2id(hash)
+			if err == nil {
+				t.Fatalf("parseArgon2id(%q) err = nil, want an error", hash)
+			}
+			if !strings.HasPrefix(hash, "$argon2id$") {
+				return
+			}
+			// ComparePassword must fail on them rather than panic or, for
+			// an empty key, match any password
+			err = ComparePassword(hash, "")
+			if err == nil || errors.Is(err, ErrInvalidLogin) {
+				t.Errorf("ComparePassword() err = %v, want a parse error", err)
+			}
+		})
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	hash := func(hasher PasswordHasher) string {
+		t.Helper()
+		h, err := hasher.Hash("correct horse")
+		if err != nil {
+			t.Fatalf("Hash() err = %v", err)
+		}
+		return h
+	}
+	minBcrypt := hash(BcryptHasher{Cost: bcrypt.MinCost})
+	argon2Hash := hash(testArgon2Hasher)
+	tests := map[string]struct {
+		hasher PasswordHasher
+		hash   string
+		want   bool
+	}{
+		"bcrypt, same cost":      {BcryptHasher{Cost: bcrypt.MinCost}, minBcrypt, false},
+		"bcrypt, higher cost":    {BcryptHasher{Cost: bcrypt.MinCost - 1}, minBcrypt, false},
+		"bcrypt, lower cost":     {BcryptHasher{Cost: bcrypt.MinCost + 1}, minBcrypt, true},
+		"bcrypt, default cost":   {BcryptHasher{}, minBcrypt, true},
+		"bcrypt to argon2id":     {testArgon2Hasher, minBcrypt, true},
+		"argon2id to bcrypt":     {BcryptHasher{Cost: bcrypt.MinCost}, argon2Hash, true},
+		"argon2id, same params":  {testArgon2Hasher, argon2Hash, false},
+		"argon2id, more memory":  {Argon2idHasher{Memory: 128, Time: 1, Threads: 1}, argon2Hash, true},
+		"argon2id, more time":    {Argon2idHasher{Memory: 64, Time: 2, Threads: 1}, argon2Hash, true},
+		"argon2id, more threads": {Argon2idHasher{Memory: 64, Time: 1, Threads: 2}, argon2Hash, true},
+		"argon2id, defaults":     {Argon2idHasher{}, argon2Hash, true},
+		"bcrypt, no password":    {BcryptHasher{}, "", true},
+		"argon2id, no password":  {Argon2idHasher{}, "", true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := tc.hasher.NeedsRehash(tc.hash); got != tc.want {
+				t.Errorf("NeedsRehash() = %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
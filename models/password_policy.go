@@ -0,0 +1,238 @@
+package models
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"lenslocked/errors"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PasswordPolicy decides which passwords users may choose. The zero value
+// enforces the default length and strength and skips the breach check.
+type PasswordPolicy struct {
+	// MinLength and MaxLength are in characters. They default to
+	// DefaultPasswordMinLength and DefaultPasswordMaxLength.
+	MinLength int
+	MaxLength int
+	// MaxBytes limits the length in bytes as well, for hashers that only
+	// look at so many bytes. 0 means no limit. UserService sets it for
+	// bcrypt.
+	MaxBytes int
+	// MinScore is the lowest strength score accepted, from 0 (too guessable)
+	// to 4 (very unguessable) like zxcvbn. Defaults to
+	// DefaultPasswordMinScore, a negative score turns the check off.
+	MinScore int
+	// BreachedDir holds breached password hashes in the format of the Have
+	// I Been Pwned range API: a file per 5 character SHA-1 prefix, eg
+	// "21BD1.txt", with a "SUFFIX:COUNT" line per hash. Passwords found in
+	// there are rejected. Empty turns the check off.
+	BreachedDir string
+}
+
+const (
+	DefaultPasswordMinLength = 8
+	// DefaultPasswordMaxLength keeps passwords within the 72 bytes bcrypt
+	// looks at for most alphabets.
+	DefaultPasswordMaxLength = 64
+	DefaultPasswordMinScore  = 2
+)
+
+// Check returns an errors.Public error explaining what is wrong with the
+// password, if anything. UserInputs are things like the user's email
+// address, which make a password easy to guess.
+func (p PasswordPolicy) Check(password string, userInputs ...string) error {
+	minLength, maxLength, minScore := p.MinLength, p.MaxLength, p.MinScore
+	if minLength == 0 {
+		minLength = DefaultPasswordMinLength
+	}
+	if maxLength == 0 {
+		maxLength = DefaultPasswordMaxLength
+	}
+	if minScore == 0 {
+		minScore = DefaultPasswordMinScore
+	}
+	length := utf8.RuneCountInString(password)
+	if length < minLength {
+		return errors.Public(fmt.Errorf("%w: shorter than %d characters", ErrWeakPassword, minLength),
+			fmt.Sprintf("Your password needs to be at least %d characters long.", minLength))
+	}
+	// characters outside ASCII take up to 4 bytes each
+	if length > maxLength || (p.MaxBytes > 0 && len(password) > p.MaxBytes) {
+		return errors.Public(fmt.Errorf("%w: longer than %d characters", ErrWeakPassword, maxLength),
+			fmt.Sprintf("Your password can't be longer than %d characters.", maxLength))
+	}
+	if minScore > 0 {
+		if score := PasswordScore(password, userInputs...); score < minScore {
+			return errors.Public(fmt.Errorf("%w: score %d", ErrWeakPassword, score),
+				"Your password is too easy to guess. Try a longer one, for example a few unrelated words.")
+		}
+	}
+	if p.BreachedDir != "" {
+		breached, err := p.breached(password)
+		if err != nil {
+			return fmt.Errorf("check password: %w", err)
+		}
+		if breached {
+			return errors.Public(ErrBreachedPassword,
+				"This password has appeared in a data breach, so attackers are likely to try it. Please choose a different one.")
+		}
+	}
+	return nil
+}
+
+// breached looks the password up in the range file for its hash prefix. A
+// missing file means none of the breached passwords have that prefix.
+func (p PasswordPolicy) breached(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+	f, err := os.Open(filepath.Join(p.BreachedDir, prefix+".txt"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("breached: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		s, count, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		// padded responses list made up hashes with a count of 0
+		if strings.EqualFold(s, suffix) && count != "0" {
+			return true, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("breached: %w", err)
+	}
+	return false, nil
+}
+
+// commonPasswords are given a score of 0 outright.
+var commonPasswords = map[string]bool{
+	"password": true, "password1": true, "password123": true, "12345678": true,
+	"123456789": true, "1234567890": true, "qwertyuiop": true, "iloveyou": true,
+	"sunshine": true, "princess": true, "football": true, "baseball": true,
+	"welcome1": true, "letmein1": true, "trustno1": true, "superman": true,
+	"11111111": true, "00000000": true, "abcd1234": true, "qwerty123": true,
+	"1q2w3e4r": true, "passw0rd": true, "starwars": true, "whatever": true,
+}
+
+// passwordFragments are parts of passwords people pick so often that each
+// counts as a single character when estimating the strength.
+var passwordFragments = []string{
+	"password", "qwerty", "asdf", "zxcv", "1qaz", "letmein", "welcome",
+	"admin", "login", "love", "monkey", "dragon", "master", "secret",
+	"summer", "winter", "spring", "autumn", "lenslocked", "photo",
+}
+
+// leetReplacer undoes common letter substitutions before looking for
+// fragments.
+var leetReplacer = strings.NewReplacer("@", "a", "4", "a", "0", "o", "1", "i",
+	"!", "i", "3", "e", "5", "s", "$", "s", "7", "t")
+
+// PasswordScore estimates how hard the password is to guess, from 0 to 4 on
+// the scale zxcvbn uses. Like zxcvbn it estimates the number of guesses an
+// attacker needs, but with a much smaller model: the size of the alphabet
+// used, discounted for repeated characters, sequences like "abc" or "123",
+// years, common words and the user's own details.
+func PasswordScore(password string, userInputs ...string) int {
+	lower := strings.ToLower(password)
+	if commonPasswords[lower] {
+		return 0
+	}
+
+	var lowers, uppers, digits, symbols bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lowers = true
+		case unicode.IsUpper(r):
+			uppers = true
+		case unicode.IsDigit(r):
+			digits = true
+		default:
+			symbols = true
+		}
+	}
+	alphabet := 0
+	if lowers {
+		alphabet += 26
+	}
+	if uppers {
+		alphabet += 26
+	}
+	if digits {
+		alphabet += 10
+	}
+	if symbols {
+		alphabet += 33
+	}
+
+	// repeats and sequences add little to what an attacker has to guess
+	runes := []rune(lower)
+	length := 1.0
+	for i := 1; i < len(runes); i++ {
+		diff := runes[i] - runes[i-1]
+		if diff >= -1 && diff <= 1 {
+			length += 0.25
+		} else {
+			length++
+		}
+	}
+	// as do words everyone uses, the user's details and years
+	normalized := leetReplacer.Replace(lower)
+	fragments := passwordFragments
+	for _, input := range userInputs {
+		input = strings.ToLower(input)
+		local, _, _ := strings.Cut(input, "@")
+		fragments = append(fragments, input, local)
+	}
+	for _, fragment := range fragments {
+		if len(fragment) < 3 {
+			continue
+		}
+		if strings.Contains(lower, fragment) || strings.Contains(normalized, fragment) {
+			length -= float64(utf8.RuneCountInString(fragment)) - 1
+		}
+	}
+	for i := 0; i+4 <= len(lower); i++ {
+		if (strings.HasPrefix(lower[i:], "19") || strings.HasPrefix(lower[i:], "20")) &&
+			isDigits(lower[i:i+4]) {
+			length -= 2
+			i += 3
+		}
+	}
+	if length < 1 {
+		length = 1
+	}
+
+	guesses := length * math.Log10(float64(alphabet))
+	switch {
+	case guesses < 3:
+		return 0
+	case guesses < 6:
+		return 1
+	case guesses < 8:
+		return 2
+	case guesses < 10:
+		return 3
+	}
+	return 4
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
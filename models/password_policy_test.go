@@ -0,0 +1,209 @@
+package models
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testBreachedDir writes range files in the Have I Been Pwned format for the
+// breached passwords. The padded ones are listed with a count of 0, the way
+// padded API responses list made up hashes.
+func testBreachedDir(t *testing.T, breached, padded []string) string {
+	t.Helper()
+	dir := t.TempDir()
+	files := make(map[string][]string)
+	add := func(password, count string) {
+		sum := sha1.Sum([]byte(password))
+		hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+		files[hash[:5]] = append(files[hash[:5]], hash[5:]+":"+count)
+	}
+	for _, password := range breached {
+		add(password, "42")
+	}
+	for _, password := range padded {
+		add(password, "0")
+	}
+	for prefix, lines := range files {
+		// the API answers with CRLF line endings
+		data := strings.Join(lines, "\r\n") + "\r\n"
+		err := os.WriteFile(filepath.Join(dir, prefix+".txt"), []byte(data), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	breachedDir := testBreachedDir(t,
+		[]string{"Tr0ub4dor&3"},
+		[]string{"zq8#Lp2!vR"})
+	tests := map[string]struct {
+		policy     PasswordPolicy
+		password   string
+		userInputs []string
+		want       error
+	}{
+		"strong": {
+			password: "correct horse battery staple",
+		},
+		"too short": {
+			password: "hJ7kq2L",
+			want:     ErrWeakPassword,
+		},
+		"min length": {
+			password: "hJ7kq2Lm",
+		},
+		"custom min length": {
+			policy:   PasswordPolicy{MinLength: 12},
+			password: "hJ7kq2Lm",
+			want:     ErrWeakPassword,
+		},
+		"too long": {
+			password: strings.Repeat("hJ7kq2Lm", 8) + "x",
+			want:     ErrWeakPassword,
+		},
+		"max length": {
+			password: strings.Repeat("hJ7kq2Lm", 8),
+		},
+		"max length counts characters": {
+			// 64 characters, but 192 bytes
+			policy:   PasswordPolicy{MinScore: -1},
+			password: strings.Repeat("日本語パスワード", 8),
+		},
+		"over max bytes": {
+			// 25 characters, but 75 bytes
+			policy:   PasswordPolicy{MinScore: -1, MaxBytes: BcryptMaxPasswordBytes},
+			password: strings.Repeat("日本語パ", 6) + "ス",
+			want:     ErrWeakPassword,
+		},
+		"max bytes": {
+			policy:   PasswordPolicy{MinScore: -1, MaxBytes: BcryptMaxPasswordBytes},
+			password: strings.Repeat("日本語パ", 6),
+		},
+		"common": {
+			password: "password123",
+			want:     ErrWeakPassword,
+		},
+		"score check turned off": {
+			policy:   PasswordPolicy{MinScore: -1},
+			password: "password123",
+		},
+		"contains the email address": {
+			password:   "jonsmith1984",
+			userInputs: []string{"jon.smith@example.com", "jonsmith"},
+			want:       ErrWeakPassword,
+		},
+		"without the user inputs": {
+			password: "jonsmith1984",
+		},
+		"breached": {
+			policy:   PasswordPolicy{BreachedDir: breachedDir},
+			password: "Tr0ub4dor&3",
+			want:     ErrBreachedPassword,
+		},
+		"breach check turned off": {
+			password: "Tr0ub4dor&3",
+		},
+		"padding entry": {
+			policy:   PasswordPolicy{BreachedDir: breachedDir},
+			password: "zq8#Lp2!vR",
+		},
+		"no range file": {
+			policy:   PasswordPolicy{BreachedDir: breachedDir},
+			password: "kq7vz2mw9t",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := tc.policy.Check(tc.password, tc.userInputs...)
+			if tc.want == nil {
+				if err != nil {
+					t.Fatalf("Check() err = %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("Check() err = %v, want %v", err, tc.want)
+			}
+			var pubErr interface{ Public() string }
+			if !errors.As(err, &pubErr) {
+				t.Errorf("Check() err = %v, want an error users can be shown", err)
+			}
+		})
+	}
+}
+
+func TestPasswordPolicyBreachedDirUnreadable(t *testing.T) {
+	dir := t.TempDir()
+	sum := sha1.Sum([]byte("kq7vz2mw9t"))
+	prefix := strings.ToUpper(hex.EncodeToString(sum[:]))[:5]
+	// a directory where the range file should be can't be read
+	err := os.Mkdir(filepath.Join(dir, prefix+".txt"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := PasswordPolicy{BreachedDir: dir}
+	err = policy.Check("kq7vz2mw9t")
+	if err == nil {
+		t.Fatalf("Check() err = nil, want the read error")
+	}
+	var pubErr interface{ Public() string }
+	if errors.As(err, &pubErr) {
+		t.Errorf("Check() err = %v, want an internal error", err)
+	}
+}
+
+func TestBreachedCaseInsensitive(t *testing.T) {
+	dir := t.TempDir()
+	sum := sha1.Sum([]byte("kq7vz2mw9t"))
+	hash := hex.EncodeToString(sum[:])
+	// the suffix in lower case, without a trailing newline
+	err := os.WriteFile(filepath.Join(dir, strings.ToUpper(hash[:5])+".txt"),
+		[]byte("0000000000000000000000000000000000A:3\n"+hash[5:]+":7"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	breached, err := PasswordPolicy{BreachedDir: dir}.breached("kq7vz2mw9t")
+	if err != nil {
+		t.Fatalf("breached() err = %v", err)
+	}
+	if !breached {
+		t.Errorf("breached() = false, want true")
+	}
+}
+
+func TestPasswordScore(t *testing.T) {
+	userInputs := []string{"jon.smith@example.com", "jonsmith"}
+	tests := []struct {
+		password   string
+		userInputs []string
+		want       int
+	}{
+		{"password", nil, 0},
+		{"12345678", nil, 0},
+		{"P@ssw0rd99", nil, 0},
+		{"monkeydragon", nil, 0},
+		{"abcdefgh", nil, 1},
+		{"aaaaaaaaaaaa", nil, 1},
+		{"lenslocked2024", nil, 1},
+		{"jonsmith1984", nil, 4},
+		{"jonsmith1984", userInputs, 0},
+		{"jonsmith1", userInputs, 0},
+		{"xkqzvbmw", nil, 4},
+		{"hJ7kq2Lm", nil, 4},
+		{"Tr0ub4dor&3", userInputs, 4},
+		{"correct horse battery staple", userInputs, 4},
+	}
+	for _, tc := range tests {
+		got := PasswordScore(tc.password, tc.userInputs...)
+		if got != tc.want {
+			t.Errorf("PasswordScore(%q, %q) = %d, want %d", tc.password, tc.userInputs, got, tc.want)
+		}
+	}
+}
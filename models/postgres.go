@@ -44,11 +44,11 @@ func Open(config PostgresConfig) (*sql.DB, error) {
 func Migrate(db *sql.DB, dir string) error {
 	err := goose.SetDialect("postgres")
 	if err != nil {
-		fmt.Errorf("migrate: %w", err)
+		return fmt.Errorf("migrate: %w", err)
 	}
 	err = goose.Up(db, dir)
 	if err != nil {
-		fmt.Errorf("migrate: %w", err)
+		return fmt.Errorf("migrate: %w", err)
 	}
 	return nil
 }
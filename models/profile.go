@@ -0,0 +1,266 @@
+package models
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"lenslocked/errors"
+	"lenslocked/rand"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Profile is what other people get to see about a user on their public
+// profile page.
+type Profile struct {
+	UserID int
+	// Username is the user's unique handle in profile URLs. Users don't have
+	// a public profile until they pick one.
+	Username    string
+	DisplayName string
+	Bio         string
+	// AvatarKey is the storage key of the avatar image, or empty if the user
+	// hasn't uploaded one.
+	AvatarKey string
+}
+
+// Name is how the user is shown to others: their display name if they set
+// one, or else their username.
+func (p Profile) Name() string {
+	if p.DisplayName != "" {
+		return p.DisplayName
+	}
+	return p.Username
+}
+
+type ProfileService struct {
+	DB *sql.DB
+	// Storage holds the avatar images under the "avatars/<user id>/" prefix.
+	Storage Storage
+	// AvatarSize is the width and height, in pixels, avatars are cropped and
+	// scaled to. Defaults to DefaultAvatarSize.
+	AvatarSize int
+}
+
+const (
+	DefaultAvatarSize = 256
+
+	MaxDisplayNameLength = 50
+	MaxBioLength         = 500
+)
+
+// usernameRegexp accepts 3 to 30 lowercase letters, digits, underscores and
+// dashes, starting with a letter or digit so usernames read well in URLs.
+var usernameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{2,29}$`)
+
+func (service *ProfileService) ByUserID(userID int) (*Profile, error) {
+	profile := Profile{
+		UserID: userID,
+	}
+	row := service.DB.QueryRow(`
+		SELECT COALESCE(username, ''), display_name, bio, avatar_key
+		FROM users
+		WHERE id = $1;`, userID)
+	err := row.Scan(&profile.Username, &profile.DisplayName, &profile.Bio,
+		&profile.AvatarKey)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("profile by user: %w", err)
+	}
+	return &profile, nil
+}
+
+// ByUsername looks up a public profile. ErrNotFound is returned if nobody
+// has the username.
+func (service *ProfileService) ByUsername(username string) (*Profile, error) {
+	profile := Profile{
+		Username: strings.ToLower(username),
+	}
+	row := service.DB.QueryRow(`
+		SELECT id, display_name, bio, avatar_key
+		FROM users
+		WHERE username = $1;`, profile.Username)
+	err := row.Scan(&profile.UserID, &profile.DisplayName, &profile.Bio,
+		&profile.AvatarKey)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("profile by username: %w", err)
+	}
+	return &profile, nil
+}
+
+// Update saves the username, display name and bio of the profile. Usernames
+// are stored in lowercase, and an empty username takes the profile down.
+// Errors about what users entered are errors.Public.
+func (service *ProfileService) Update(profile *Profile) error {
+	profile.Username = strings.ToLower(strings.TrimSpace(profile.Username))
+	profile.DisplayName = strings.TrimSpace(profile.DisplayName)
+	profile.Bio = strings.TrimSpace(profile.Bio)
+	if profile.Username != "" && !usernameRegexp.MatchString(profile.Username) {
+		return errors.Public(ErrInvalidUsername,
+			"Usernames are 3 to 30 lowercase letters, digits, dashes or underscores, starting with a letter or digit.")
+	}
+	if utf8.RuneCountInString(profile.DisplayName) > MaxDisplayNameLength {
+		return errors.Public(fmt.Errorf("update profile: display name too long"),
+			fmt.Sprintf("Display names can't be longer than %d characters.", MaxDisplayNameLength))
+	}
+	if utf8.RuneCountInString(profile.Bio) > MaxBioLength {
+		return errors.Public(fmt.Errorf("update profile: bio too long"),
+			fmt.Sprintf("Your bio can't be longer than %d characters.", MaxBioLength))
+	}
+	_, err := service.DB.Exec(`
+		UPDATE users
+		SET username = NULLIF($2, ''), display_name = $3, bio = $4
+		WHERE id = $1;`, profile.UserID, profile.Username, profile.DisplayName,
+		profile.Bio)
+	if err != nil {
+		if uniqueViolation(err) {
+			return errors.Public(ErrUsernameTaken, "That username is taken already.")
+		}
+		return fmt.Errorf("update profile: %w", err)
+	}
+	return nil
+}
+
+// SetAvatar crops the image to a square, scales it down to AvatarSize and
+// stores it as the user's avatar in place of the previous one. Re-encoding
+// the image also drops any metadata it came with. A FileError is returned
+// for anything but an accepted image type.
+func (service *ProfileService) SetAvatar(profile *Profile, filename string, contents io.ReadSeeker) error {
+	if !hasExtension(filename, imageExtensions) {
+		return FileError{
+			Issue: fmt.Sprintf("invalid extension: %v", path.Ext(filename)),
+		}
+	}
+	err := checkContentType(contents, imageContentTypes)
+	if err != nil {
+		return fmt.Errorf("set avatar: %w", err)
+	}
+	src, err := decodeImage(contents)
+	if err != nil {
+		return FileError{
+			Issue: fmt.Sprintf("could not decode image: %v", err),
+		}
+	}
+	size := service.AvatarSize
+	if size <= 0 {
+		size = DefaultAvatarSize
+	}
+	avatar := resize(cropSquare(src), size)
+	var buf bytes.Buffer
+	ext := ".jpg"
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".png", ".gif":
+		// keep transparency
+		ext = ".png"
+		err = png.Encode(&buf, avatar)
+	default:
+		err = jpeg.Encode(&buf, avatar, &jpeg.Options{Quality: variantJPEGQuality})
+	}
+	if err != nil {
+		return fmt.Errorf("set avatar: %w", err)
+	}
+	// a new name for every upload, so browsers don't hold on to the old one
+	name, err := rand.Bytes(8)
+	if err != nil {
+		return fmt.Errorf("set avatar: %w", err)
+	}
+	key := fmt.Sprintf("%s%x%s", service.avatarPrefix(profile.UserID), name, ext)
+	err = service.Storage.Put(key, &buf)
+	if err != nil {
+		return fmt.Errorf("set avatar: %w", err)
+	}
+	_, err = service.DB.Exec(`
+		UPDATE users
+		SET avatar_key = $2
+		WHERE id = $1;`, profile.UserID, key)
+	if err != nil {
+		return fmt.Errorf("set avatar: %w", err)
+	}
+	oldKey := profile.AvatarKey
+	profile.AvatarKey = key
+	if oldKey != "" {
+		err = service.Storage.Delete(oldKey)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("set avatar: %w", err)
+		}
+	}
+	return nil
+}
+
+// OpenAvatar returns the avatar image of the profile and when it was
+// uploaded. ErrNotFound is returned if the user doesn't have one. The
+// caller is responsible for closing it.
+func (service *ProfileService) OpenAvatar(profile *Profile) (io.ReadCloser, time.Time, error) {
+	if profile.AvatarKey == "" {
+		return nil, time.Time{}, ErrNotFound
+	}
+	info, err := service.Storage.Stat(profile.AvatarKey)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("open avatar: %w", err)
+	}
+	rc, err := service.Storage.Get(profile.AvatarKey)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("open avatar: %w", err)
+	}
+	return rc, info.ModTime, nil
+}
+
+// DeleteAvatar removes the user's avatar, and any leftovers of earlier
+// uploads.
+func (service *ProfileService) DeleteAvatar(userID int) error {
+	_, err := service.DB.Exec(`
+		UPDATE users
+		SET avatar_key = ''
+		WHERE id = $1;`, userID)
+	if err != nil {
+		return fmt.Errorf("delete avatar: %w", err)
+	}
+	keys, err := service.Storage.List(service.avatarPrefix(userID))
+	if err != nil {
+		return fmt.Errorf("delete avatar: %w", err)
+	}
+	for _, key := range keys {
+		err = service.Storage.Delete(key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("delete avatar: %w", err)
+		}
+	}
+	return nil
+}
+
+func (service *ProfileService) avatarPrefix(userID int) string {
+	return fmt.Sprintf("avatars/%d/", userID)
+}
+
+// cropSquare cuts the largest square out of the middle of src.
+func cropSquare(src image.Image) image.Image {
+	bounds := src.Bounds()
+	size := min(bounds.Dx(), bounds.Dy())
+	x0 := bounds.Min.X + (bounds.Dx()-size)/2
+	y0 := bounds.Min.Y + (bounds.Dy()-size)/2
+	rect := image.Rect(x0, y0, x0+size, y0+size)
+	if sub, ok := src.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(rect)
+	}
+	dst := image.NewRGBA64(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			dst.Set(x, y, src.At(x0+x, y0+y))
+		}
+	}
+	return dst
+}
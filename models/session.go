@@ -4,8 +4,10 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"lenslocked/rand"
+	"time"
 )
 
 type Session struct {
@@ -16,22 +18,70 @@ type Session struct {
 	// in our database and we cannot reverse it into a raw token.
 	Token     string
 	TokenHash string
+	// UserAgent and IPAddress describe the device the session was created
+	// on, so users can tell their sessions apart.
+	UserAgent  string
+	IPAddress  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	// Remember sessions were created with "remember me" checked and use the
+	// longer RememberDuration and RememberIdleTimeout.
+	Remember bool
+	// ExpiresAt is when the session stops working unless it is used again
+	// before then.
+	ExpiresAt time.Time
+	// Renewed is set by Use when the session's expiry was pushed back, in
+	// which case the cookie holding the token should be renewed as well.
+	Renewed bool
+	// Impersonating is set by Use while the admin the session belongs to is
+	// impersonating another user.
+	Impersonating *User
 }
 
 type SessionService struct {
 	DB            *sql.DB
 	BytesPerToken int
+	// Duration is how long a session lasts at most, however often it is
+	// used. Defaults to DefaultSessionDuration.
+	Duration time.Duration
+	// IdleTimeout expires sessions that haven't been used for that long.
+	// Defaults to DefaultSessionIdleTimeout.
+	IdleTimeout time.Duration
+	// RememberDuration and RememberIdleTimeout replace Duration and
+	// IdleTimeout for "remember me" sessions. They default to
+	// DefaultRememberDuration and DefaultRememberIdleTimeout.
+	RememberDuration    time.Duration
+	RememberIdleTimeout time.Duration
+	// ImpersonationDuration is how long admins impersonate a user before
+	// they are back to themselves. Defaults to
+	// DefaultImpersonationDuration.
+	ImpersonationDuration time.Duration
+	// AuditLogService records when an impersonation ends by itself. It is
+	// optional.
+	AuditLogService *AuditLogService
 }
 
 // initialize our token size as constant
 const (
 	MinBytesPerToken = 32
+	// lastSeenInterval limits how often a session's last seen time is
+	// written, so not every request ends up updating the sessions table.
+	lastSeenInterval = time.Minute
+
+	DefaultSessionDuration     = 24 * time.Hour
+	DefaultSessionIdleTimeout  = 2 * time.Hour
+	DefaultRememberDuration    = 30 * 24 * time.Hour
+	DefaultRememberIdleTimeout = 7 * 24 * time.Hour
 )
 
 // Create will create a new session for the user provided. The session token
 // will be returned as the Token field on the Session type, but only the hashed
-// session token is stored in the database.
-func (ss *SessionService) Create(userID int) (*Session, error) {
+// session token is stored in the database. Users can have any number of
+// sessions, one for every device they signed in on. Remember picks the longer
+// lifetime of "remember me" sessions. ErrAccountSuspended is returned for
+// suspended users, and ErrPasswordResetRequired for users who have to
+// choose a new password first.
+func (ss *SessionService) Create(userID int, userAgent, ipAddress string, remember bool) (*Session, error) {
 	bytesPerToken := ss.BytesPerToken
 	if bytesPerToken < MinBytesPerToken {
 		bytesPerToken = MinBytesPerToken
@@ -45,47 +95,182 @@ func (ss *SessionService) Create(userID int) (*Session, error) {
 		UserID:    userID,
 		Token:     token,
 		TokenHash: ss.Hash(token),
+		UserAgent: userAgent,
+		IPAddress: ipAddress,
+		Remember:  remember,
 	}
-	// insert a new session into the database, but if there is a conflict with the user_id
-	// meaning that user already has a session, we instead update the user’s existing session
-	// and set its token_hash to the new value.
+	// suspended users and those who have to reset their password can't
+	// sign in, however they try
 	row := ss.DB.QueryRow(`
-	INSERT INTO sessions (user_id, token_hash)
-	VALUES ($1, $2) ON CONFLICT (user_id) DO
-	UPDATE
-	SET token_hash = $2
-	RETURNING id;`, session.UserID, session.TokenHash)
-	err = row.Scan(&session.ID)
+	INSERT INTO sessions (user_id, token_hash, user_agent, ip_address, remember)
+	SELECT id, $2, $3, $4, $5
+	FROM users
+	WHERE id = $1 AND suspended_at IS NULL AND NOT password_reset_required
+	RETURNING id, created_at, last_seen_at;`, session.UserID, session.TokenHash,
+		session.UserAgent, session.IPAddress, session.Remember)
+	err = row.Scan(&session.ID, &session.CreatedAt, &session.LastSeenAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("create: %w", ss.refused(userID))
+		}
+		return nil, fmt.Errorf("create: %w", err)
+	}
+	session.ExpiresAt = ss.expiresAt(session)
+	// a good moment to clean up the sessions of this user nobody can use
+	// anymore
+	err = ss.deleteExpired(userID)
 	if err != nil {
 		return nil, fmt.Errorf("create: %w", err)
 	}
 	return &session, nil
 }
 
+// refused tells why no session could be created for the user.
+func (ss *SessionService) refused(userID int) error {
+	var resetRequired bool
+	row := ss.DB.QueryRow(`
+		SELECT password_reset_required
+		FROM users
+		WHERE id = $1;`, userID)
+	err := row.Scan(&resetRequired)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if resetRequired {
+		return ErrPasswordResetRequired
+	}
+	return ErrAccountSuspended
+}
+
 func (ss *SessionService) Hash(token string) string {
 	tokenHash := sha256.Sum256([]byte(token))
 	// encode the resulting hash into a string
 	return base64.URLEncoding.EncodeToString(tokenHash[:])
 }
 
+// User returns the user the session token belongs to and records that the
+// session was just used.
 func (ss *SessionService) User(token string) (*User, error) {
+	_, user, err := ss.Use(token)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// Use looks up the session and its user by token, and renews the session
+// since it is being used. Expired sessions are deleted and reported as
+// ErrNotFound, and so are the sessions of suspended users.
+func (ss *SessionService) Use(token string) (*Session, *User, error) {
 	var user User
+	var session Session
 	// 1. Hash the session token
 	tokenHash := ss.Hash(token)
 	// 2. Query for the session with that hash
 	row := ss.DB.QueryRow(`
-	SELECT users.id,
+	SELECT sessions.id,
+    sessions.created_at,
+    sessions.last_seen_at,
+    sessions.remember,
+    users.id,
     users.email,
-    users.password_hash
+    users.password_hash,
+    users.email_verified_at,
+    users.is_admin,
+    users.suspended_at,
+    sessions.impersonated_user_id,
+    sessions.impersonation_started_at
     FROM sessions
     JOIN users ON users.id = sessions.user_id
     WHERE sessions.token_hash = $1;`, tokenHash)
-	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash)
+	var impersonatedUserID *int
+	var impersonationStartedAt *time.Time
+	err := row.Scan(&session.ID, &session.CreatedAt, &session.LastSeenAt,
+		&session.Remember, &user.ID, &user.Email, &user.PasswordHash,
+		&user.EmailVerifiedAt, &user.IsAdmin, &user.SuspendedAt,
+		&impersonatedUserID, &impersonationStartedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, fmt.Errorf("use session: %w", err)
+	}
+	if user.Suspended() {
+		return nil, nil, ErrNotFound
+	}
+	session.UserID = user.ID
+	session.TokenHash = tokenHash
+	// 3. Make sure the session hasn't expired
+	if !time.Now().Before(ss.expiresAt(session)) {
+		_, err = ss.DB.Exec(`
+		DELETE FROM sessions
+		WHERE id = $1;`, session.ID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("use session: %w", err)
+		}
+		return nil, nil, ErrNotFound
+	}
+	// 4. Slide the idle timeout along, which also keeps track of when the
+	// session was last used
+	if time.Since(session.LastSeenAt) > lastSeenInterval {
+		row = ss.DB.QueryRow(`
+		UPDATE sessions
+		SET last_seen_at = NOW()
+		WHERE id = $1
+		RETURNING last_seen_at;`, session.ID)
+		err = row.Scan(&session.LastSeenAt)
+		if err != nil {
+			return nil, nil, fmt.Errorf("use session: %w", err)
+		}
+		session.Renewed = true
+	}
+	session.ExpiresAt = ss.expiresAt(session)
+	// 5. Look up who the admin is impersonating, if anyone
+	if impersonatedUserID != nil {
+		session.Impersonating, err = ss.impersonatedUser(&session, &user,
+			*impersonatedUserID, *impersonationStartedAt)
+		if err != nil {
+			return nil, nil, fmt.Errorf("use session: %w", err)
+		}
+	}
+	// 6. Return the session and its user
+	return &session, &user, nil
+}
+
+// ByUserID returns the sessions of the user that haven't expired, most
+// recently used first.
+func (ss *SessionService) ByUserID(userID int) ([]Session, error) {
+	rows, err := ss.DB.Query(`
+	SELECT id, token_hash, user_agent, ip_address, created_at, last_seen_at,
+		remember
+	FROM sessions
+	WHERE user_id = $1
+	ORDER BY last_seen_at DESC;`, userID)
 	if err != nil {
-		return nil, fmt.Errorf("user: %w", err)
+		return nil, fmt.Errorf("query sessions by user: %w", err)
+	}
+	defer rows.Close()
+	var sessions []Session
+	for rows.Next() {
+		session := Session{
+			UserID: userID,
+		}
+		err = rows.Scan(&session.ID, &session.TokenHash, &session.UserAgent,
+			&session.IPAddress, &session.CreatedAt, &session.LastSeenAt,
+			&session.Remember)
+		if err != nil {
+			return nil, fmt.Errorf("query sessions by user: %w", err)
+		}
+		session.ExpiresAt = ss.expiresAt(session)
+		if !time.Now().Before(session.ExpiresAt) {
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query sessions by user: %w", err)
 	}
-	// 3. Return the user
-	return &user, nil
+	return sessions, nil
 }
 
 func (ss *SessionService) Delete(token string) error {
@@ -98,3 +283,87 @@ func (ss *SessionService) Delete(token string) error {
 	}
 	return nil
 }
+
+// Revoke deletes a single session of the user, signing out that device.
+func (ss *SessionService) Revoke(userID, sessionID int) error {
+	_, err := ss.DB.Exec(`
+	DELETE FROM sessions
+	WHERE id = $1 AND user_id = $2;`, sessionID, userID)
+	if err != nil {
+		return fmt.Errorf("revoke session: %w", err)
+	}
+	return nil
+}
+
+// DeleteAll signs the user out on every device.
+func (ss *SessionService) DeleteAll(userID int) error {
+	_, err := ss.DB.Exec(`
+	DELETE FROM sessions
+	WHERE user_id = $1;`, userID)
+	if err != nil {
+		return fmt.Errorf("delete all sessions: %w", err)
+	}
+	return nil
+}
+
+// DeleteOthers signs the user out on every device but the one the session
+// token belongs to.
+func (ss *SessionService) DeleteOthers(userID int, token string) error {
+	_, err := ss.DB.Exec(`
+	DELETE FROM sessions
+	WHERE user_id = $1 AND token_hash <> $2;`, userID, ss.Hash(token))
+	if err != nil {
+		return fmt.Errorf("delete other sessions: %w", err)
+	}
+	return nil
+}
+
+// expiresAt is when the session expires: after the idle timeout since it was
+// last used, but never later than the session's maximum duration.
+func (ss *SessionService) expiresAt(session Session) time.Time {
+	duration, idle := ss.lifetime(session.Remember)
+	expiresAt := session.LastSeenAt.Add(idle)
+	if limit := session.CreatedAt.Add(duration); limit.Before(expiresAt) {
+		expiresAt = limit
+	}
+	return expiresAt
+}
+
+func (ss *SessionService) lifetime(remember bool) (duration, idle time.Duration) {
+	if remember {
+		duration, idle = ss.RememberDuration, ss.RememberIdleTimeout
+		if duration == 0 {
+			duration = DefaultRememberDuration
+		}
+		if idle == 0 {
+			idle = DefaultRememberIdleTimeout
+		}
+		return duration, idle
+	}
+	duration, idle = ss.Duration, ss.IdleTimeout
+	if duration == 0 {
+		duration = DefaultSessionDuration
+	}
+	if idle == 0 {
+		idle = DefaultSessionIdleTimeout
+	}
+	return duration, idle
+}
+
+// deleteExpired removes the sessions of the user that have expired.
+func (ss *SessionService) deleteExpired(userID int) error {
+	duration, idle := ss.lifetime(false)
+	rememberDuration, rememberIdle := ss.lifetime(true)
+	now := time.Now()
+	_, err := ss.DB.Exec(`
+	DELETE FROM sessions
+	WHERE user_id = $1 AND (
+		(NOT remember AND (created_at < $2 OR last_seen_at < $3)) OR
+		(remember AND (created_at < $4 OR last_seen_at < $5)));`, userID,
+		now.Add(-duration), now.Add(-idle),
+		now.Add(-rememberDuration), now.Add(-rememberIdle))
+	if err != nil {
+		return fmt.Errorf("delete expired sessions: %w", err)
+	}
+	return nil
+}
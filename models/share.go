@@ -0,0 +1,187 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"lenslocked/rand"
+	"time"
+)
+
+// Share is a link that gives anyone holding it access to a gallery,
+// regardless of the gallery's visibility, until it expires, runs out of
+// views or is revoked.
+type Share struct {
+	ID        int
+	GalleryID int
+	// Token is only set when a Share is being created. Only the hash is stored
+	// in the database, so the link can't be shown again later.
+	Token     string
+	TokenHash string
+	// ExpiresAt is nil for links that don't expire.
+	ExpiresAt *time.Time
+	// MaxViews is 0 for links that can be viewed any number of times.
+	MaxViews  int
+	Views     int
+	CreatedAt time.Time
+}
+
+type ShareService struct {
+	DB *sql.DB
+	// BytesPerToken is used to determine how many bytes to use when generating
+	// each share token. If this value is not set or is less than the
+	// MinBytesPerToken const it will be ignored and MinBytesPerToken will be
+	// used.
+	BytesPerToken int
+}
+
+// activeShare is the condition every usable share link has to meet.
+const activeShare = `
+	revoked_at IS NULL
+	AND (expires_at IS NULL OR expires_at > NOW())`
+
+func (service *ShareService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+// Create makes a new share link for the gallery. expiresAt can be nil and
+// maxViews 0 for links without a limit.
+func (service *ShareService) Create(galleryID int, expiresAt *time.Time, maxViews int) (*Share, error) {
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create share: %w", err)
+	}
+	share := Share{
+		GalleryID: galleryID,
+		Token:     token,
+		TokenHash: service.hash(token),
+		ExpiresAt: expiresAt,
+		MaxViews:  maxViews,
+	}
+	row := service.DB.QueryRow(`
+		INSERT INTO gallery_shares (gallery_id, token_hash, expires_at, max_views)
+		VALUES ($1, $2, $3, NULLIF($4, 0))
+		RETURNING id, created_at;`, share.GalleryID, share.TokenHash, share.ExpiresAt, share.MaxViews)
+	err = row.Scan(&share.ID, &share.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("create share: %w", err)
+	}
+	return &share, nil
+}
+
+// Active returns every share link of the gallery that can still be used.
+func (service *ShareService) Active(galleryID int) ([]Share, error) {
+	rows, err := service.DB.Query(`
+		SELECT id, token_hash, expires_at, COALESCE(max_views, 0), views, created_at
+		FROM gallery_shares
+		WHERE gallery_id = $1 AND`+activeShare+`
+			AND (max_views IS NULL OR views < max_views)
+		ORDER BY created_at;`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("query shares by gallery: %w", err)
+	}
+	defer rows.Close()
+	var shares []Share
+	for rows.Next() {
+		share := Share{
+			GalleryID: galleryID,
+		}
+		err = rows.Scan(&share.ID, &share.TokenHash, &share.ExpiresAt,
+			&share.MaxViews, &share.Views, &share.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("query shares by gallery: %w", err)
+		}
+		shares = append(shares, share)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query shares by gallery: %w", err)
+	}
+	return shares, nil
+}
+
+// Check returns the share link for token if it can still be used, without
+// counting it as a view. ErrNotFound is returned for unknown, expired and
+// revoked links, and for links that were viewed MaxViews times already.
+func (service *ShareService) Check(token string) (*Share, error) {
+	return service.check(token, `
+		AND (max_views IS NULL OR views < max_views)`)
+}
+
+// CheckViewed is Check for a visitor whose page view was counted already,
+// which may have been the last one the link allows. It lets that view load
+// its images, so it doesn't mind links that have run out of views.
+func (service *ShareService) CheckViewed(token string) (*Share, error) {
+	return service.check(token, "")
+}
+
+func (service *ShareService) check(token, condition string) (*Share, error) {
+	share := Share{
+		TokenHash: service.hash(token),
+	}
+	row := service.DB.QueryRow(`
+		SELECT id, gallery_id, expires_at, COALESCE(max_views, 0), views, created_at
+		FROM gallery_shares
+		WHERE token_hash = $1 AND`+activeShare+condition+`;`, share.TokenHash)
+	err := row.Scan(&share.ID, &share.GalleryID, &share.ExpiresAt,
+		&share.MaxViews, &share.Views, &share.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("check share: %w", err)
+	}
+	return &share, nil
+}
+
+// View counts a view of the gallery through the share link for token.
+// ErrNotFound is returned if the link can't be used anymore, including when
+// it has already been viewed MaxViews times.
+func (service *ShareService) View(token string) (*Share, error) {
+	share := Share{
+		TokenHash: service.hash(token),
+	}
+	// checking and counting the view in a single statement makes sure
+	// concurrent visitors can't go over the limit.
+	row := service.DB.QueryRow(`
+		UPDATE gallery_shares
+		SET views = views + 1
+		WHERE token_hash = $1 AND`+activeShare+`
+			AND (max_views IS NULL OR views < max_views)
+		RETURNING id, gallery_id, expires_at, COALESCE(max_views, 0), views, created_at;`,
+		share.TokenHash)
+	err := row.Scan(&share.ID, &share.GalleryID, &share.ExpiresAt,
+		&share.MaxViews, &share.Views, &share.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("view share: %w", err)
+	}
+	return &share, nil
+}
+
+// Revoke kills a share link of the gallery right away.
+func (service *ShareService) Revoke(galleryID, id int) error {
+	result, err := service.DB.Exec(`
+		UPDATE gallery_shares
+		SET revoked_at = NOW()
+		WHERE id = $1 AND gallery_id = $2 AND revoked_at IS NULL;`, id, galleryID)
+	if err != nil {
+		return fmt.Errorf("revoke share: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("revoke share: %w", err)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"io"
+	"time"
+)
+
+// Storage is where the bytes of uploaded files live. Keys are slash separated
+// paths like "galleries/1/photo.jpg", so every backend can lay them out the
+// way it prefers (directories, object keys, map keys, ...).
+type Storage interface {
+	// Put stores everything read from r under key, replacing any existing
+	// object with the same key.
+	Put(key string, r io.Reader) error
+	// Get opens the object stored under key. ErrNotFound is returned if there
+	// is no such object. The caller is responsible for closing it.
+	Get(key string) (io.ReadCloser, error)
+	// Delete removes the object stored under key. ErrNotFound is returned if
+	// there is no such object.
+	Delete(key string) error
+	// List returns the keys of every object that starts with prefix, sorted
+	// alphabetically.
+	List(prefix string) ([]string, error)
+	// Stat returns information about the object stored under key without
+	// reading it. ErrNotFound is returned if there is no such object.
+	Stat(key string) (ObjectInfo, error)
+}
+
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
@@ -0,0 +1,155 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LocalStorage stores objects as files inside Dir, using the key as the
+// relative path of the file.
+type LocalStorage struct {
+	// Dir is the root directory of the storage. Defaults to "images" if not
+	// set.
+	Dir string
+}
+
+func (ls *LocalStorage) Put(key string, r io.Reader) error {
+	p, err := ls.path(key)
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	dst, err := os.Create(p)
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	defer dst.Close()
+	_, err = io.Copy(dst, r)
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	return nil
+}
+
+func (ls *LocalStorage) Get(key string) (io.ReadCloser, error) {
+	p, err := ls.path(key)
+	if err != nil {
+		return nil, fmt.Errorf("get: %w", err)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("get: %w", err)
+	}
+	return f, nil
+}
+
+func (ls *LocalStorage) Delete(key string) error {
+	p, err := ls.path(key)
+	if err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	err = os.Remove(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("delete: %w", err)
+	}
+	// clean up directories that are empty now, so deleting the last image of
+	// a gallery doesn't leave the gallery directory behind. os.Remove refuses
+	// to delete directories that still have files in them.
+	root := filepath.Clean(ls.dir())
+	for dir := filepath.Dir(p); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (ls *LocalStorage) List(prefix string) ([]string, error) {
+	// only walk the directory the prefix points into, the rest of the tree
+	// can't contain any matching keys.
+	walkDir := ls.dir()
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		walkDir = filepath.Join(walkDir, filepath.FromSlash(prefix[:i]))
+	}
+	var keys []string
+	err := filepath.WalkDir(walkDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(ls.dir(), p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list: %w", err)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (ls *LocalStorage) Stat(key string) (ObjectInfo, error) {
+	p, err := ls.path(key)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("stat: %w", err)
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ObjectInfo{}, ErrNotFound
+		}
+		return ObjectInfo{}, fmt.Errorf("stat: %w", err)
+	}
+	if fi.IsDir() {
+		return ObjectInfo{}, ErrNotFound
+	}
+	return ObjectInfo{
+		Key:     key,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}, nil
+}
+
+func (ls *LocalStorage) dir() string {
+	if ls.Dir == "" {
+		return "images"
+	}
+	return ls.Dir
+}
+
+// path turns a key into a file path inside the storage directory. Keys that
+// would escape the directory are rejected with ErrInvalidKey.
+func (ls *LocalStorage) path(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if cleaned == "/" || cleaned != "/"+key {
+		return "", fmt.Errorf("%w: %q", ErrInvalidKey, key)
+	}
+	return filepath.Join(ls.dir(), filepath.FromSlash(cleaned)), nil
+}
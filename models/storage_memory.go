@@ -0,0 +1,99 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStorage keeps every object in memory. It is meant for tests and
+// local experiments, everything is lost when the process exits.
+type MemoryStorage struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+// memoryReader lets callers seek through an object, just like they can with
+// the *os.File returned by LocalStorage.
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (memoryReader) Close() error {
+	return nil
+}
+
+func (ms *MemoryStorage) Put(key string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.objects == nil {
+		ms.objects = make(map[string]memoryObject)
+	}
+	ms.objects[key] = memoryObject{
+		data:    data,
+		modTime: time.Now(),
+	}
+	return nil
+}
+
+func (ms *MemoryStorage) Get(key string) (io.ReadCloser, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	obj, ok := ms.objects[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	// objects are never modified in place, Put always swaps in a new slice,
+	// so the reader can safely share the data.
+	return memoryReader{bytes.NewReader(obj.data)}, nil
+}
+
+func (ms *MemoryStorage) Delete(key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.objects[key]; !ok {
+		return ErrNotFound
+	}
+	delete(ms.objects, key)
+	return nil
+}
+
+func (ms *MemoryStorage) List(prefix string) ([]string, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	var keys []string
+	for key := range ms.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (ms *MemoryStorage) Stat(key string) (ObjectInfo, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	obj, ok := ms.objects[key]
+	if !ok {
+		return ObjectInfo{}, ErrNotFound
+	}
+	return ObjectInfo{
+		Key:     key,
+		Size:    int64(len(obj.data)),
+		ModTime: obj.modTime,
+	}, nil
+}
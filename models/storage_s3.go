@@ -0,0 +1,298 @@
+package models
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Storage stores objects in a bucket of an S3 compatible service. Requests
+// are signed with AWS Signature Version 4 and always use path-style URLs
+// (http://endpoint/bucket/key), which is what MinIO and most other self
+// hosted S3 stand-ins expect.
+type S3Storage struct {
+	// Endpoint is the base URL of the service, eg "http://localhost:9000".
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// Client is used to send the requests. Defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+const (
+	DefaultS3Region = "us-east-1"
+
+	s3Algorithm   = "AWS4-HMAC-SHA256"
+	s3TimeFormat  = "20060102T150405Z"
+	s3DateFormat  = "20060102"
+	s3EmptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+func (s *S3Storage) Put(key string, r io.Reader) error {
+	// S3 needs the content length and a hash of the payload up front, so the
+	// object is buffered before it is sent.
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	resp, err := s.do(http.MethodPut, key, nil, body)
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("put: %w", s3ResponseError(resp))
+	}
+	return nil
+}
+
+func (s *S3Storage) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("get: %w", err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotFound
+	default:
+		defer resp.Body.Close()
+		return nil, fmt.Errorf("get: %w", s3ResponseError(resp))
+	}
+}
+
+func (s *S3Storage) Delete(key string) error {
+	// S3 happily deletes keys that don't exist, so we have to check first to
+	// behave like the other backends.
+	_, err := s.Stat(key)
+	if err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	resp, err := s.do(http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("delete: %w", s3ResponseError(resp))
+	}
+	return nil
+}
+
+func (s *S3Storage) List(prefix string) ([]string, error) {
+	var keys []string
+	continuationToken := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+		}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		resp, err := s.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, fmt.Errorf("list: %w", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = s3ResponseError(resp)
+			resp.Body.Close()
+			return nil, fmt.Errorf("list: %w", err)
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("list: %w", err)
+		}
+		for _, obj := range result.Contents {
+			keys = append(keys, obj.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		continuationToken = result.NextContinuationToken
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *S3Storage) Stat(key string) (ObjectInfo, error) {
+	resp, err := s.do(http.MethodHead, key, nil, nil)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("stat: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return ObjectInfo{}, ErrNotFound
+	default:
+		return ObjectInfo{}, fmt.Errorf("stat: %w", s3ResponseError(resp))
+	}
+	info := ObjectInfo{
+		Key: key,
+	}
+	info.Size, _ = strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return info, nil
+}
+
+// do builds, signs and sends a request for key in the bucket. An empty key
+// targets the bucket itself.
+func (s *S3Storage) do(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parsing s3 endpoint: %w", err)
+	}
+	objectPath := strings.TrimSuffix(endpoint.Path, "/") + "/" + s.Bucket
+	if key != "" {
+		objectPath += "/" + key
+	}
+	endpoint.Path = objectPath
+	endpoint.RawPath = s3Escape(objectPath, false)
+	endpoint.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequest(method, endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		// no body at all, not even an empty one, for GET/HEAD/DELETE
+		req.Body = nil
+		req.ContentLength = 0
+	}
+	s.sign(req, body, time.Now().UTC())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// sign adds the AWS Signature Version 4 Authorization header to req.
+// https://docs.aws.amazon.com/IAM/latest/UserGuide/create-signed-request.html
+func (s *S3Storage) sign(req *http.Request, body []byte, now time.Time) {
+	region := s.Region
+	if region == "" {
+		region = DefaultS3Region
+	}
+	payloadHash := s3EmptySHA256
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	amzDate := now.Format(s3TimeFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// we only sign the headers we set ourselves plus the host
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := now.Format(s3DateFormat) + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	signingKey := s3HMAC([]byte("AWS4"+s.SecretKey), now.Format(s3DateFormat))
+	signingKey = s3HMAC(signingKey, region)
+	signingKey = s3HMAC(signingKey, "s3")
+	signingKey = s3HMAC(signingKey, "aws4_request")
+	signature := hex.EncodeToString(s3HMAC(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.AccessKey, scope, signedHeaders, signature))
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but the unreserved characters, as
+// required by SigV4. Slashes are kept unless escapeSlash is true.
+func s3Escape(s string, escapeSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			sb.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+// s3CanonicalQuery encodes the query sorted by key, which is both a valid
+// query string and the canonical form SigV4 signs.
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func s3ResponseError(resp *http.Response) error {
+	var s3Err struct {
+		Code    string
+		Message string
+	}
+	// HEAD responses and some proxies don't send an XML body, in which case
+	// the status code is all we have.
+	err := xml.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&s3Err)
+	if err != nil || s3Err.Code == "" {
+		return fmt.Errorf("s3: unexpected status %s", resp.Status)
+	}
+	return fmt.Errorf("s3: %s: %s", s3Err.Code, s3Err.Message)
+}
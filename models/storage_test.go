@@ -0,0 +1,204 @@
+package models
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	newStorage := func(t *testing.T) Storage {
+		return &MemoryStorage{}
+	}
+	testStorage(t, newStorage)
+	testStorageSeek(t, newStorage)
+}
+
+func TestLocalStorage(t *testing.T) {
+	newStorage := func(t *testing.T) Storage {
+		return &LocalStorage{
+			Dir: t.TempDir(),
+		}
+	}
+	testStorage(t, newStorage)
+	testStorageSeek(t, newStorage)
+
+	t.Run("keys can't escape the directory", func(t *testing.T) {
+		storage := &LocalStorage{
+			Dir: t.TempDir(),
+		}
+		for _, key := range []string{"../escape.jpg", "a/../../escape.jpg", "/absolute.jpg", ""} {
+			err := storage.Put(key, strings.NewReader("data"))
+			if !errors.Is(err, ErrInvalidKey) {
+				t.Errorf("Put(%q) err = %v, want ErrInvalidKey", key, err)
+			}
+		}
+	})
+}
+
+// testStorage checks a Storage behaves the way the interface documents.
+// newStorage returns an empty storage for every subtest.
+func testStorage(t *testing.T, newStorage func(t *testing.T) Storage) {
+	t.Run("put and get", func(t *testing.T) {
+		storage := newStorage(t)
+		putString(t, storage, "galleries/1/photo.jpg", "first")
+		if got := getString(t, storage, "galleries/1/photo.jpg"); got != "first" {
+			t.Errorf("Get() = %q, want %q", got, "first")
+		}
+		putString(t, storage, "galleries/1/photo.jpg", "second")
+		if got := getString(t, storage, "galleries/1/photo.jpg"); got != "second" {
+			t.Errorf("Get() after replacing = %q, want %q", got, "second")
+		}
+	})
+
+	t.Run("stat", func(t *testing.T) {
+		storage := newStorage(t)
+		before := time.Now().Add(-time.Second)
+		putString(t, storage, "galleries/1/photo.jpg", "12345")
+		info, err := storage.Stat("galleries/1/photo.jpg")
+		if err != nil {
+			t.Fatalf("Stat() err = %v", err)
+		}
+		if info.Key != "galleries/1/photo.jpg" || info.Size != 5 {
+			t.Errorf("Stat() = %+v, want key galleries/1/photo.jpg and size 5", info)
+		}
+		if info.ModTime.Before(before) {
+			t.Errorf("Stat().ModTime = %v, want after %v", info.ModTime, before)
+		}
+	})
+
+	t.Run("missing objects", func(t *testing.T) {
+		storage := newStorage(t)
+		putString(t, storage, "galleries/1/photo.jpg", "data")
+		if _, err := storage.Get("galleries/1/other.jpg"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get() err = %v, want ErrNotFound", err)
+		}
+		if _, err := storage.Stat("galleries/1/other.jpg"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Stat() err = %v, want ErrNotFound", err)
+		}
+		if err := storage.Delete("galleries/1/other.jpg"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Delete() err = %v, want ErrNotFound", err)
+		}
+		// a prefix of a key isn't an object
+		if _, err := storage.Stat("galleries/1"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Stat() of a prefix err = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		storage := newStorage(t)
+		putString(t, storage, "galleries/1/photo.jpg", "data")
+		putString(t, storage, "galleries/1/other.jpg", "data")
+		err := storage.Delete("galleries/1/photo.jpg")
+		if err != nil {
+			t.Fatalf("Delete() err = %v", err)
+		}
+		if _, err := storage.Get("galleries/1/photo.jpg"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get() after Delete() err = %v, want ErrNotFound", err)
+		}
+		if got := getString(t, storage, "galleries/1/other.jpg"); got != "data" {
+			t.Errorf("Get() of another object = %q, want %q", got, "data")
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		storage := newStorage(t)
+		for _, key := range []string{
+			"galleries/2/b.jpg",
+			"galleries/1/b.jpg",
+			"galleries/1/a.jpg",
+			"galleries/1/variants/320/a.jpg",
+			"galleries/10/a.jpg",
+			"avatars/1/a.jpg",
+		} {
+			putString(t, storage, key, "data")
+		}
+		tests := map[string][]string{
+			"galleries/1/": {
+				"galleries/1/a.jpg",
+				"galleries/1/b.jpg",
+				"galleries/1/variants/320/a.jpg",
+			},
+			"galleries/1": {
+				"galleries/1/a.jpg",
+				"galleries/1/b.jpg",
+				"galleries/1/variants/320/a.jpg",
+				"galleries/10/a.jpg",
+			},
+			"galleries/1/a": {
+				"galleries/1/a.jpg",
+			},
+			"avatars/": {
+				"avatars/1/a.jpg",
+			},
+			"missing/": nil,
+		}
+		for prefix, want := range tests {
+			got, err := storage.List(prefix)
+			if err != nil {
+				t.Fatalf("List(%q) err = %v", prefix, err)
+			}
+			if len(got) == 0 && len(want) == 0 {
+				continue
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("List(%q) = %v, want %v", prefix, got, want)
+			}
+		}
+	})
+}
+
+// testStorageSeek checks Get returns an io.ReadSeeker. Storage doesn't
+// require it, but the backends that promise it get images served with
+// range requests.
+func testStorageSeek(t *testing.T, newStorage func(t *testing.T) Storage) {
+	t.Run("get can seek", func(t *testing.T) {
+		storage := newStorage(t)
+		putString(t, storage, "galleries/1/photo.jpg", "0123456789")
+		rc, err := storage.Get("galleries/1/photo.jpg")
+		if err != nil {
+			t.Fatalf("Get() err = %v", err)
+		}
+		defer rc.Close()
+		seeker, ok := rc.(io.ReadSeeker)
+		if !ok {
+			t.Fatalf("Get() returned a %T, want an io.ReadSeeker", rc)
+		}
+		_, err = seeker.Seek(5, io.SeekStart)
+		if err != nil {
+			t.Fatalf("Seek() err = %v", err)
+		}
+		rest, err := io.ReadAll(seeker)
+		if err != nil {
+			t.Fatalf("ReadAll() err = %v", err)
+		}
+		if string(rest) != "56789" {
+			t.Errorf("read after Seek() = %q, want %q", rest, "56789")
+		}
+	})
+}
+
+func putString(t *testing.T, storage Storage, key, data string) {
+	t.Helper()
+	err := storage.Put(key, strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("Put(%q) err = %v", key, err)
+	}
+}
+
+func getString(t *testing.T, storage Storage, key string) string {
+	t.Helper()
+	rc, err := storage.Get(key)
+	if err != nil {
+		t.Fatalf("Get(%q) err = %v", key, err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("reading %q: %v", key, err)
+	}
+	return string(data)
+}
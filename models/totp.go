@@ -0,0 +1,319 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"lenslocked/rand"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP is a user's authenticator app enrollment, see RFC 6238. It only
+// protects sign in once it is confirmed with a first code.
+type TOTP struct {
+	UserID int
+	// Secret is the base32 encoded key shared with the authenticator app.
+	Secret      string
+	ConfirmedAt *time.Time
+}
+
+type TOTPService struct {
+	DB *sql.DB
+	// Issuer is the name authenticator apps show next to the code. Defaults
+	// to DefaultTOTPIssuer.
+	Issuer string
+}
+
+const (
+	DefaultTOTPIssuer = "Lenslocked"
+	// these are the parameters every authenticator app supports
+	totpDigits       = 6
+	totpPeriod       = 30
+	totpSecretBytes  = 20
+	totpSkewSteps    = 1
+	recoveryCodes    = 10
+	recoveryCodeSize = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Enroll starts setting up TOTP for the user with a new secret, replacing
+// any enrollment that wasn't confirmed. Users that already have TOTP enabled
+// have to disable it first.
+func (service *TOTPService) Enroll(userID int) (*TOTP, error) {
+	key, err := rand.Bytes(totpSecretBytes)
+	if err != nil {
+		return nil, fmt.Errorf("enroll totp: %w", err)
+	}
+	totp := TOTP{
+		UserID: userID,
+		Secret: totpEncoding.EncodeToString(key),
+	}
+	result, err := service.DB.Exec(`
+		INSERT INTO totp_secrets (user_id, secret)
+		VALUES ($1, $2) ON CONFLICT (user_id) DO
+		UPDATE
+		SET secret = $2, last_used_step = 0
+		WHERE totp_secrets.confirmed_at IS NULL;`, totp.UserID, totp.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("enroll totp: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("enroll totp: %w", err)
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("enroll totp: already enabled for user %d", userID)
+	}
+	return &totp, nil
+}
+
+// URI is the otpauth:// URI authenticator apps use to add the account,
+// usually by scanning it as a QR code.
+func (service *TOTPService) URI(totp *TOTP, email string) string {
+	issuer := service.Issuer
+	if issuer == "" {
+		issuer = DefaultTOTPIssuer
+	}
+	vals := url.Values{
+		"secret": {totp.Secret},
+		"issuer": {issuer},
+		"digits": {fmt.Sprint(totpDigits)},
+		"period": {fmt.Sprint(totpPeriod)},
+	}
+	label := url.PathEscape(issuer + ":" + email)
+	return "otpauth://totp/" + label + "?" + vals.Encode()
+}
+
+// Confirm checks the first code from the user's authenticator app and turns
+// on TOTP for their account. ErrInvalidCode is returned for a wrong code.
+func (service *TOTPService) Confirm(userID int, code string) error {
+	totp, lastStep, err := service.byUserID(userID)
+	if err != nil {
+		return fmt.Errorf("confirm totp: %w", err)
+	}
+	if totp.ConfirmedAt != nil {
+		return fmt.Errorf("confirm totp: already enabled for user %d", userID)
+	}
+	step, err := totpCheck(totp.Secret, code, lastStep)
+	if err != nil {
+		return fmt.Errorf("confirm totp: %w", err)
+	}
+	_, err = service.DB.Exec(`
+		UPDATE totp_secrets
+		SET confirmed_at = NOW(), last_used_step = $2
+		WHERE user_id = $1;`, userID, step)
+	if err != nil {
+		return fmt.Errorf("confirm totp: %w", err)
+	}
+	return nil
+}
+
+// Enabled reports whether the user has to enter a code to sign in.
+func (service *TOTPService) Enabled(userID int) (bool, error) {
+	totp, _, err := service.byUserID(userID)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return false, nil
+		}
+		return false, fmt.Errorf("totp enabled: %w", err)
+	}
+	return totp.ConfirmedAt != nil, nil
+}
+
+// Verify checks a code from the user's authenticator app. Every code is only
+// accepted once. ErrInvalidCode is returned for wrong or reused codes.
+func (service *TOTPService) Verify(userID int, code string) error {
+	totp, lastStep, err := service.byUserID(userID)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return ErrInvalidCode
+		}
+		return fmt.Errorf("verify totp: %w", err)
+	}
+	if totp.ConfirmedAt == nil {
+		return ErrInvalidCode
+	}
+	step, err := totpCheck(totp.Secret, code, lastStep)
+	if err != nil {
+		return err
+	}
+	// the condition on last_used_step makes sure two requests can't both
+	// use the same code
+	result, err := service.DB.Exec(`
+		UPDATE totp_secrets
+		SET last_used_step = $2
+		WHERE user_id = $1 AND last_used_step < $2;`, userID, step)
+	if err != nil {
+		return fmt.Errorf("verify totp: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("verify totp: %w", err)
+	}
+	if n == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// Disable turns off TOTP for the user and deletes their recovery codes.
+func (service *TOTPService) Disable(userID int) error {
+	_, err := service.DB.Exec(`
+		DELETE FROM totp_secrets
+		WHERE user_id = $1;`, userID)
+	if err != nil {
+		return fmt.Errorf("disable totp: %w", err)
+	}
+	_, err = service.DB.Exec(`
+		DELETE FROM recovery_codes
+		WHERE user_id = $1;`, userID)
+	if err != nil {
+		return fmt.Errorf("disable totp: %w", err)
+	}
+	return nil
+}
+
+// GenerateRecoveryCodes replaces the recovery codes of the user with new
+// ones. The codes are returned so they can be shown to the user once, only
+// their hashes are stored.
+func (service *TOTPService) GenerateRecoveryCodes(userID int) ([]string, error) {
+	_, err := service.DB.Exec(`
+		DELETE FROM recovery_codes
+		WHERE user_id = $1;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("generate recovery codes: %w", err)
+	}
+	codes := make([]string, 0, recoveryCodes)
+	for i := 0; i < recoveryCodes; i++ {
+		b, err := rand.Bytes(recoveryCodeSize)
+		if err != nil {
+			return nil, fmt.Errorf("generate recovery codes: %w", err)
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))[:recoveryCodeSize]
+		code = code[:recoveryCodeSize/2] + "-" + code[recoveryCodeSize/2:]
+		_, err = service.DB.Exec(`
+			INSERT INTO recovery_codes (user_id, code_hash)
+			VALUES ($1, $2);`, userID, service.hash(code))
+		if err != nil {
+			return nil, fmt.Errorf("generate recovery codes: %w", err)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// UseRecoveryCode signs off on a sign in with a recovery code instead of a
+// TOTP code. Each recovery code works once. ErrInvalidCode is returned for
+// unknown and used codes.
+func (service *TOTPService) UseRecoveryCode(userID int, code string) error {
+	code = strings.ToLower(strings.TrimSpace(code))
+	result, err := service.DB.Exec(`
+		UPDATE recovery_codes
+		SET used_at = NOW()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL;`,
+		userID, service.hash(code))
+	if err != nil {
+		return fmt.Errorf("use recovery code: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("use recovery code: %w", err)
+	}
+	if n == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// RecoveryCodesLeft counts the recovery codes the user hasn't used yet.
+func (service *TOTPService) RecoveryCodesLeft(userID int) (int, error) {
+	var n int
+	row := service.DB.QueryRow(`
+		SELECT COUNT(*)
+		FROM recovery_codes
+		WHERE user_id = $1 AND used_at IS NULL;`, userID)
+	err := row.Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("count recovery codes: %w", err)
+	}
+	return n, nil
+}
+
+// ByUserID returns the TOTP enrollment of the user, confirmed or not.
+func (service *TOTPService) ByUserID(userID int) (*TOTP, error) {
+	totp, _, err := service.byUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	return totp, nil
+}
+
+func (service *TOTPService) byUserID(userID int) (*TOTP, int64, error) {
+	totp := TOTP{
+		UserID: userID,
+	}
+	var lastStep int64
+	row := service.DB.QueryRow(`
+		SELECT secret, confirmed_at, last_used_step
+		FROM totp_secrets
+		WHERE user_id = $1;`, userID)
+	err := row.Scan(&totp.Secret, &totp.ConfirmedAt, &lastStep)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, 0, ErrNotFound
+		}
+		return nil, 0, fmt.Errorf("query totp: %w", err)
+	}
+	return &totp, lastStep, nil
+}
+
+func (service *TOTPService) hash(code string) string {
+	codeHash := sha256.Sum256([]byte(code))
+	return base64.URLEncoding.EncodeToString(codeHash[:])
+}
+
+// totpCheck looks for code among the codes of the current time step and the
+// steps right next to it, to allow for clocks that are a little off. It
+// returns the matching step, which has to be after lastStep.
+func totpCheck(secret, code string, lastStep int64) (int64, error) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		return 0, fmt.Errorf("decoding totp secret: %w", err)
+	}
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	now := time.Now().Unix() / totpPeriod
+	for step := now - totpSkewSteps; step <= now+totpSkewSteps; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, nil
+		}
+	}
+	return 0, ErrInvalidCode
+}
+
+// totpCode computes the code for a time step as described in RFC 4226.
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
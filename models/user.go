@@ -5,29 +5,74 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5/pgconn"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type User struct {
 	ID           int
 	Email        string
 	PasswordHash string
+	// EmailVerifiedAt is nil until the user follows the link in the
+	// verification email.
+	EmailVerifiedAt *time.Time
+	// IsAdmin users can manage other accounts in the admin area.
+	IsAdmin bool
+	// SuspendedAt is set while an admin suspended the account, which keeps
+	// the user from signing in.
+	SuspendedAt *time.Time
+}
+
+// EmailVerified reports whether the user confirmed they own their email
+// address.
+func (u User) EmailVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+// Suspended reports whether an admin suspended the account.
+func (u User) Suspended() bool {
+	return u.SuspendedAt != nil
 }
 
 type UserService struct {
 	DB *sql.DB
+	// PasswordPolicy is checked for every password users choose.
+	PasswordPolicy PasswordPolicy
+	// Hasher hashes new passwords, and old hashes when users sign in.
+	// Defaults to a BcryptHasher with the default cost.
+	Hasher PasswordHasher
+}
+
+func (us UserService) hasher() PasswordHasher {
+	if us.Hasher == nil {
+		return BcryptHasher{}
+	}
+	return us.Hasher
+}
+
+// CheckPassword returns an errors.Public error if the password isn't
+// allowed by the PasswordPolicy. UserInputs are the user's details, like
+// their email address.
+func (us UserService) CheckPassword(password string, userInputs ...string) error {
+	policy := us.PasswordPolicy
+	if _, ok := us.hasher().(BcryptHasher); ok {
+		policy.MaxBytes = BcryptMaxPasswordBytes
+	}
+	return policy.Check(password, userInputs...)
 }
 
 func (us UserService) Create(email, password string) (*User, error) {
 	email = strings.ToLower(email)
-	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	err := us.CheckPassword(password, email)
+	if err != nil {
+		return nil, fmt.Errorf("create user: %w", err)
+	}
+	passwordHash, err := us.hasher().Hash(password)
 	if err != nil {
 		return nil, fmt.Errorf("create user: %w", err)
 	}
-	passwordHash := string(hashedBytes)
 
 	user := User{
 		Email:        email,
@@ -38,51 +83,148 @@ func (us UserService) Create(email, password string) (*User, error) {
 	VALUES ($1, $2) RETURNING id`, email, passwordHash)
 	err = row.Scan(&user.ID)
 	if err != nil {
-		// see if we can use this error as a PgError
-		var pgError *pgconn.PgError
-		if errors.As(err, &pgError) {
-			// this is a PgError, see if it matches a unique violation
-			if pgError.Code == pgerrcode.UniqueViolation {
-				// if this is true, it has to be an email violation
-				return nil, ErrEmailTaken
-			}
+		if uniqueViolation(err) {
+			return nil, ErrEmailTaken
 		}
 		return nil, fmt.Errorf("create user: %w", err)
 	}
 	return &user, nil
 }
 
+// CreateWithoutPassword creates a user who signs in with an external
+// identity provider. They can't sign in with a password until they set one
+// by resetting it. EmailVerified is whether the provider verified the email
+// address.
+func (us UserService) CreateWithoutPassword(email string, emailVerified bool) (*User, error) {
+	email = strings.ToLower(email)
+	user := User{
+		Email: email,
+	}
+	row := us.DB.QueryRow(`
+	INSERT INTO users (email, password_hash, email_verified_at)
+	VALUES ($1, '', CASE WHEN $2 THEN NOW() END)
+	RETURNING id, email_verified_at`, email, emailVerified)
+	err := row.Scan(&user.ID, &user.EmailVerifiedAt)
+	if err != nil {
+		if uniqueViolation(err) {
+			return nil, ErrEmailTaken
+		}
+		return nil, fmt.Errorf("create user without password: %w", err)
+	}
+	return &user, nil
+}
+
+// ByEmail looks up the user with the email address. ErrNotFound is returned
+// if there is none.
+func (us UserService) ByEmail(email string) (*User, error) {
+	email = strings.ToLower(email)
+	user := User{
+		Email: email,
+	}
+	row := us.DB.QueryRow(`
+	SELECT id, password_hash, email_verified_at
+	FROM users WHERE email=$1`, email)
+	err := row.Scan(&user.ID, &user.PasswordHash, &user.EmailVerifiedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query user by email: %w", err)
+	}
+	return &user, nil
+}
+
 func (us UserService) Authenticate(email, password string) (*User, error) {
 	email = strings.ToLower(email)
 	user := User{
 		Email: email,
 	}
 	row := us.DB.QueryRow(`
-	SELECT id, password_hash
+	SELECT id, password_hash, email_verified_at, is_admin, suspended_at
 	FROM users WHERE email=$1`, email)
-	err := row.Scan(&user.ID, &user.PasswordHash)
+	err := row.Scan(&user.ID, &user.PasswordHash, &user.EmailVerifiedAt,
+		&user.IsAdmin, &user.SuspendedAt)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("authenticate: %w", ErrInvalidLogin)
+		}
 		return nil, fmt.Errorf("authenticate: %w", err)
 	}
-	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
+	err = ComparePassword(user.PasswordHash, password)
 	if err != nil {
 		return nil, fmt.Errorf("authenticate: %w", err)
 	}
+	// now that we have the password, hashes made with an older algorithm or
+	// weaker settings can be upgraded
+	if us.hasher().NeedsRehash(user.PasswordHash) {
+		passwordHash, err := us.hasher().Hash(password)
+		if err != nil {
+			return nil, fmt.Errorf("authenticate: %w", err)
+		}
+		_, err = us.DB.Exec(`
+		UPDATE users
+		SET password_hash = $2
+		WHERE id = $1 AND password_hash = $3;`, user.ID, passwordHash, user.PasswordHash)
+		if err != nil {
+			return nil, fmt.Errorf("authenticate: %w", err)
+		}
+		user.PasswordHash = passwordHash
+	}
 	return &user, nil
 }
 
 func (us *UserService) UpdatePassword(userID int, password string) error {
-	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	var email string
+	row := us.DB.QueryRow(`
+		SELECT email FROM users WHERE id = $1;`, userID)
+	err := row.Scan(&email)
+	if err != nil {
+		return fmt.Errorf("update password: %w", err)
+	}
+	err = us.CheckPassword(password, email)
+	if err != nil {
+		return fmt.Errorf("update password: %w", err)
+	}
+	passwordHash, err := us.hasher().Hash(password)
 	if err != nil {
 		return fmt.Errorf("update password: %w", err)
 	}
-	passwordHash := string(hashedBytes)
 	_, err = us.DB.Exec(`
 		UPDATE users
-		SET password_hash = $2
+		SET password_hash = $2, password_reset_required = FALSE
 		WHERE id = $1;`, userID, passwordHash)
 	if err != nil {
 		return fmt.Errorf("update password: %w", err)
 	}
 	return nil
 }
+
+// UpdateEmail changes the user's email address, which counts as verified
+// as the user followed a link sent to it. ErrEmailTaken is returned if
+// another user has the address.
+func (us *UserService) UpdateEmail(userID int, email string) error {
+	email = strings.ToLower(email)
+	_, err := us.DB.Exec(`
+		UPDATE users
+		SET email = $2, email_verified_at = NOW()
+		WHERE id = $1;`, userID, email)
+	if err != nil {
+		if uniqueViolation(err) {
+			return ErrEmailTaken
+		}
+		return fmt.Errorf("update email: %w", err)
+	}
+	return nil
+}
+
+// uniqueViolation reports whether err is Postgres refusing a duplicate
+// value, which for users is the email address or the username.
+func uniqueViolation(err error) bool {
+	// see if we can use this error as a PgError
+	var pgError *pgconn.PgError
+	if errors.As(err, &pgError) {
+		// this is a PgError, see if it matches a unique violation
+		return pgError.Code == pgerrcode.UniqueViolation
+	}
+	return false
+}
@@ -0,0 +1,347 @@
+package models
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"lenslocked/rand"
+	"time"
+)
+
+// WebAuthnCredential is a passkey a user registered to sign in with.
+type WebAuthnCredential struct {
+	ID           int
+	UserID       int
+	CredentialID []byte
+	// PublicKey is the PKIX encoded key signatures are checked against.
+	PublicKey  []byte
+	SignCount  uint32
+	Name       string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+	// UserVerified is set by Authenticate when the authenticator checked
+	// the user's fingerprint, face or PIN for this sign in.
+	UserVerified bool
+}
+
+// WebAuthnService implements just enough of the WebAuthn spec to register
+// and sign in with passkeys: ES256 keys and "none" attestation, which is what
+// platform authenticators use when no attestation is asked for.
+type WebAuthnService struct {
+	DB *sql.DB
+	// RPID is the domain the passkeys are bound to, eg "lenslocked.com".
+	RPID string
+	// RPName is shown to users when they create a passkey.
+	RPName string
+	// Origin is the scheme, host and port the browser has to report, eg
+	// "https://lenslocked.com".
+	Origin string
+}
+
+const (
+	// WebAuthnAlgES256 is the COSE identifier of ECDSA with P-256 and SHA-256.
+	WebAuthnAlgES256  = -7
+	webAuthnChallenge = 32
+
+	authDataUserPresent  = 0x01
+	authDataUserVerified = 0x04
+	authDataAttested     = 0x40
+)
+
+// NewChallenge returns the random challenge for a registration or sign in.
+// The caller has to keep it around to check the response against.
+func (service *WebAuthnService) NewChallenge() ([]byte, error) {
+	challenge, err := rand.Bytes(webAuthnChallenge)
+	if err != nil {
+		return nil, fmt.Errorf("webauthn challenge: %w", err)
+	}
+	return challenge, nil
+}
+
+// Register checks the response of navigator.credentials.create() against the
+// challenge it was created with and stores the new passkey for the user.
+// ErrInvalidCredential is returned if the response doesn't check out.
+func (service *WebAuthnService) Register(userID int, name string, challenge, clientDataJSON, attestationObject []byte) (*WebAuthnCredential, error) {
+	credential, err := service.parseRegistration(challenge, clientDataJSON, attestationObject)
+	if err != nil {
+		return nil, err
+	}
+	credential.UserID = userID
+	credential.Name = name
+
+	row := service.DB.QueryRow(`
+		INSERT INTO webauthn_credentials (user_id, credential_id, public_key,
+			sign_count, name)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at;`, credential.UserID, credential.CredentialID,
+		credential.PublicKey, int64(credential.SignCount), credential.Name)
+	err = row.Scan(&credential.ID, &credential.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("register webauthn credential: %w", err)
+	}
+	return credential, nil
+}
+
+// parseRegistration checks a registration response and returns the passkey
+// it creates, without the user and name.
+func (service *WebAuthnService) parseRegistration(challenge, clientDataJSON, attestationObject []byte) (*WebAuthnCredential, error) {
+	err := service.checkClientData(clientDataJSON, "webauthn.create", challenge)
+	if err != nil {
+		return nil, err
+	}
+	decoded, _, err := cborDecode(attestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("%w: attestation object: %v", ErrInvalidCredential, err)
+	}
+	attestation, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: attestation object is not a map", ErrInvalidCredential)
+	}
+	authData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("%w: missing authenticator data", ErrInvalidCredential)
+	}
+	flags, signCount, rest, err := service.checkAuthData(authData)
+	if err != nil {
+		return nil, err
+	}
+	if flags&authDataAttested == 0 {
+		return nil, fmt.Errorf("%w: no attested credential data", ErrInvalidCredential)
+	}
+	// rest is the attested credential data: a 16 byte AAGUID, the length
+	// of the credential ID, the ID and the public key as a COSE key.
+	if len(rest) < 18 {
+		return nil, fmt.Errorf("%w: short attested credential data", ErrInvalidCredential)
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLen {
+		return nil, fmt.Errorf("%w: short credential ID", ErrInvalidCredential)
+	}
+	credential := WebAuthnCredential{
+		CredentialID: append([]byte(nil), rest[:idLen]...),
+		SignCount:    signCount,
+	}
+	credential.PublicKey, err = coseES256Key(rest[idLen:])
+	if err != nil {
+		return nil, err
+	}
+	return &credential, nil
+}
+
+// Authenticate checks the response of navigator.credentials.get() against
+// the challenge it was created with, and returns the passkey that signed it.
+// ErrInvalidCredential is returned for unknown passkeys, bad signatures and
+// signature counters that went backwards, which hints at a cloned key.
+func (service *WebAuthnService) Authenticate(challenge, credentialID, clientDataJSON, authData, signature []byte) (*WebAuthnCredential, error) {
+	credential, err := service.byCredentialID(credentialID)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("%w: unknown credential", ErrInvalidCredential)
+		}
+		return nil, err
+	}
+	err = service.verifyAssertion(credential, challenge, clientDataJSON, authData, signature)
+	if err != nil {
+		return nil, err
+	}
+
+	// the counter is checked again as it is written, or two sign ins with
+	// the same counter could both get past verifyAssertion
+	row := service.DB.QueryRow(`
+		UPDATE webauthn_credentials
+		SET sign_count = $2, last_used_at = NOW()
+		WHERE id = $1 AND (sign_count < $2 OR $2 = 0)
+		RETURNING last_used_at;`, credential.ID, int64(credential.SignCount))
+	err = row.Scan(&credential.LastUsedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w: signature counter already used", ErrInvalidCredential)
+		}
+		return nil, fmt.Errorf("authenticate webauthn: %w", err)
+	}
+	return credential, nil
+}
+
+// verifyAssertion checks a sign in response was signed by the credential and
+// updates its signature counter and UserVerified to match.
+func (service *WebAuthnService) verifyAssertion(credential *WebAuthnCredential, challenge, clientDataJSON, authData, signature []byte) error {
+	err := service.checkClientData(clientDataJSON, "webauthn.get", challenge)
+	if err != nil {
+		return err
+	}
+	flags, signCount, _, err := service.checkAuthData(authData)
+	if err != nil {
+		return err
+	}
+	key, err := x509.ParsePKIXPublicKey(credential.PublicKey)
+	if err != nil {
+		return fmt.Errorf("authenticate webauthn: %w", err)
+	}
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("authenticate webauthn: unexpected key type %T", key)
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	if !ecdsa.VerifyASN1(ecKey, signed[:], signature) {
+		return fmt.Errorf("%w: bad signature", ErrInvalidCredential)
+	}
+	// authenticators that don't count signatures always send zero
+	if (signCount != 0 || credential.SignCount != 0) && signCount <= credential.SignCount {
+		return fmt.Errorf("%w: signature counter went backwards", ErrInvalidCredential)
+	}
+	credential.SignCount = signCount
+	credential.UserVerified = flags&authDataUserVerified != 0
+	return nil
+}
+
+// ByUserID returns the passkeys of the user, oldest first.
+func (service *WebAuthnService) ByUserID(userID int) ([]WebAuthnCredential, error) {
+	rows, err := service.DB.Query(`
+		SELECT id, credential_id, public_key, sign_count, name, created_at,
+			last_used_at
+		FROM webauthn_credentials
+		WHERE user_id = $1
+		ORDER BY id;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query webauthn credentials by user: %w", err)
+	}
+	defer rows.Close()
+	var credentials []WebAuthnCredential
+	for rows.Next() {
+		credential := WebAuthnCredential{
+			UserID: userID,
+		}
+		var signCount int64
+		err = rows.Scan(&credential.ID, &credential.CredentialID,
+			&credential.PublicKey, &signCount, &credential.Name,
+			&credential.CreatedAt, &credential.LastUsedAt)
+		if err != nil {
+			return nil, fmt.Errorf("query webauthn credentials by user: %w", err)
+		}
+		credential.SignCount = uint32(signCount)
+		credentials = append(credentials, credential)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query webauthn credentials by user: %w", err)
+	}
+	return credentials, nil
+}
+
+func (service *WebAuthnService) Delete(userID, id int) error {
+	_, err := service.DB.Exec(`
+		DELETE FROM webauthn_credentials
+		WHERE id = $1 AND user_id = $2;`, id, userID)
+	if err != nil {
+		return fmt.Errorf("delete webauthn credential: %w", err)
+	}
+	return nil
+}
+
+func (service *WebAuthnService) byCredentialID(credentialID []byte) (*WebAuthnCredential, error) {
+	credential := WebAuthnCredential{
+		CredentialID: credentialID,
+	}
+	var signCount int64
+	row := service.DB.QueryRow(`
+		SELECT id, user_id, public_key, sign_count, name, created_at,
+			last_used_at
+		FROM webauthn_credentials
+		WHERE credential_id = $1;`, credentialID)
+	err := row.Scan(&credential.ID, &credential.UserID, &credential.PublicKey,
+		&signCount, &credential.Name, &credential.CreatedAt,
+		&credential.LastUsedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query webauthn credential: %w", err)
+	}
+	credential.SignCount = uint32(signCount)
+	return &credential, nil
+}
+
+// checkClientData makes sure the browser signed off on the right ceremony,
+// challenge and origin.
+func (service *WebAuthnService) checkClientData(clientDataJSON []byte, ceremony string, challenge []byte) error {
+	var clientData struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}
+	err := json.Unmarshal(clientDataJSON, &clientData)
+	if err != nil {
+		return fmt.Errorf("%w: client data: %v", ErrInvalidCredential, err)
+	}
+	if clientData.Type != ceremony {
+		return fmt.Errorf("%w: client data type %q", ErrInvalidCredential, clientData.Type)
+	}
+	got, err := base64.RawURLEncoding.DecodeString(clientData.Challenge)
+	if err != nil || len(challenge) == 0 || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return fmt.Errorf("%w: challenge mismatch", ErrInvalidCredential)
+	}
+	if clientData.Origin != service.Origin {
+		return fmt.Errorf("%w: origin %q", ErrInvalidCredential, clientData.Origin)
+	}
+	return nil
+}
+
+// checkAuthData checks the fixed part of the authenticator data and returns
+// its flags, the signature counter and whatever follows.
+func (service *WebAuthnService) checkAuthData(authData []byte) (flags byte, signCount uint32, rest []byte, err error) {
+	if len(authData) < 37 {
+		return 0, 0, nil, fmt.Errorf("%w: short authenticator data", ErrInvalidCredential)
+	}
+	rpIDHash := sha256.Sum256([]byte(service.RPID))
+	if !bytes.Equal(authData[:32], rpIDHash[:]) {
+		return 0, 0, nil, fmt.Errorf("%w: relying party mismatch", ErrInvalidCredential)
+	}
+	flags = authData[32]
+	if flags&authDataUserPresent == 0 {
+		return 0, 0, nil, fmt.Errorf("%w: user not present", ErrInvalidCredential)
+	}
+	signCount = binary.BigEndian.Uint32(authData[33:37])
+	return flags, signCount, authData[37:], nil
+}
+
+// coseES256Key converts a COSE encoded EC2 P-256 key into PKIX form.
+func coseES256Key(data []byte) ([]byte, error) {
+	decoded, _, err := cborDecode(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: public key: %v", ErrInvalidCredential, err)
+	}
+	key, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: public key is not a map", ErrInvalidCredential)
+	}
+	// the labels are kty (1), alg (3), crv (-1), x (-2) and y (-3)
+	kty, _ := key[int64(1)].(int64)
+	alg, _ := key[int64(3)].(int64)
+	crv, _ := key[int64(-1)].(int64)
+	x, _ := key[int64(-2)].([]byte)
+	y, _ := key[int64(-3)].([]byte)
+	if kty != 2 || alg != WebAuthnAlgES256 || crv != 1 || len(x) != 32 || len(y) != 32 {
+		return nil, fmt.Errorf("%w: only ES256 passkeys are supported", ErrInvalidCredential)
+	}
+	// an uncompressed point, which NewPublicKey checks is on the curve
+	point := append(append([]byte{4}, x...), y...)
+	pub, err := ecdh.P256().NewPublicKey(point)
+	if err != nil {
+		return nil, fmt.Errorf("%w: public key: %v", ErrInvalidCredential, err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("%w: public key: %v", ErrInvalidCredential, err)
+	}
+	return der, nil
+}
@@ -0,0 +1,276 @@
+package models
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+const (
+	testRPID   = "lenslocked.test"
+	testOrigin = "https://lenslocked.test"
+)
+
+// testAuthenticator is a software passkey that answers registrations and
+// sign ins the way a browser and platform authenticator would.
+type testAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+}
+
+func newTestAuthenticator(t *testing.T) *testAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testAuthenticator{
+		key:          key,
+		credentialID: []byte("test-credential-id"),
+	}
+}
+
+func testClientData(ceremony string, challenge []byte, origin string) []byte {
+	data, _ := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    origin,
+	})
+	return data
+}
+
+// authData builds the authenticator data for rpID with the given flags,
+// followed by extra.
+func (a *testAuthenticator) authData(rpID string, flags byte, extra []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append([]byte(nil), rpIDHash[:]...)
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	return append(data, extra...)
+}
+
+// attestationObject returns a "none" attestation of the key for rpID.
+func (a *testAuthenticator) attestationObject(rpID string) []byte {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	a.key.X.FillBytes(x)
+	a.key.Y.FillBytes(y)
+	// kty: EC2, alg: ES256, crv: P-256, x, y
+	coseKey := cborMap(
+		cborInt(1), cborInt(2),
+		cborInt(3), cborInt(WebAuthnAlgES256),
+		cborInt(-1), cborInt(1),
+		cborInt(-2), cborBytes(x),
+		cborInt(-3), cborBytes(y),
+	)
+	attested := make([]byte, 16) // AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialID)))
+	attested = append(attested, a.credentialID...)
+	attested = append(attested, coseKey...)
+	authData := a.authData(rpID, authDataUserPresent|authDataAttested, attested)
+	return cborMap(
+		cborText("fmt"), cborText("none"),
+		cborText("attStmt"), cborMap(),
+		cborText("authData"), cborBytes(authData),
+	)
+}
+
+// assert signs authData and clientDataJSON like navigator.credentials.get().
+func (a *testAuthenticator) assert(t *testing.T, authData, clientDataJSON []byte) []byte {
+	t.Helper()
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, signed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature
+}
+
+func cborHead(major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return []byte{major<<5 | byte(arg)}
+	case arg <= 0xff:
+		return []byte{major<<5 | 24, byte(arg)}
+	default:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(arg))
+	}
+}
+
+func cborInt(n int64) []byte {
+	if n < 0 {
+		return cborHead(1, uint64(-1-n))
+	}
+	return cborHead(0, uint64(n))
+}
+
+func cborBytes(b []byte) []byte {
+	return append(cborHead(2, uint64(len(b))), b...)
+}
+
+func cborText(s string) []byte {
+	return append(cborHead(3, uint64(len(s))), s...)
+}
+
+func cborMap(pairs ...[]byte) []byte {
+	data := cborHead(5, uint64(len(pairs)/2))
+	for _, item := range pairs {
+		data = append(data, item...)
+	}
+	return data
+}
+
+func testWebAuthnService() *WebAuthnService {
+	return &WebAuthnService{
+		RPID:   testRPID,
+		Origin: testOrigin,
+	}
+}
+
+func TestWebAuthnRegistration(t *testing.T) {
+	service := testWebAuthnService()
+	challenge := []byte("registration-challenge-32-bytes!")
+	tests := map[string]struct {
+		challenge []byte
+		origin    string
+		rpID      string
+		ok        bool
+	}{
+		"valid":           {challenge, testOrigin, testRPID, true},
+		"wrong origin":    {challenge, "https://evil.test", testRPID, false},
+		"wrong challenge": {[]byte("another-challenge"), testOrigin, testRPID, false},
+		"wrong rp id":     {challenge, testOrigin, "evil.test", false},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			authenticator := newTestAuthenticator(t)
+			clientData := testClientData("webauthn.create", tc.challenge, tc.origin)
+			credential, err := service.parseRegistration(challenge, clientData,
+				authenticator.attestationObject(tc.rpID))
+			if !tc.ok {
+				if !errors.Is(err, ErrInvalidCredential) {
+					t.Fatalf("parseRegistration() err = %v, want ErrInvalidCredential", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRegistration() err = %v", err)
+			}
+			if string(credential.CredentialID) != string(authenticator.credentialID) {
+				t.Errorf("CredentialID = %q, want %q", credential.CredentialID, authenticator.credentialID)
+			}
+		})
+	}
+
+	t.Run("sign in ceremony", func(t *testing.T) {
+		authenticator := newTestAuthenticator(t)
+		clientData := testClientData("webauthn.get", challenge, testOrigin)
+		_, err := service.parseRegistration(challenge, clientData,
+			authenticator.attestationObject(testRPID))
+		if !errors.Is(err, ErrInvalidCredential) {
+			t.Fatalf("parseRegistration() err = %v, want ErrInvalidCredential", err)
+		}
+	})
+}
+
+func TestWebAuthnAssertion(t *testing.T) {
+	service := testWebAuthnService()
+	registration := []byte("registration-challenge-32-bytes!")
+	challenge := []byte("sign-in-challenge-32-bytes-long!")
+
+	// register returns a fresh authenticator and its stored credential,
+	// having signed in once already so the counter is at 1.
+	register := func(t *testing.T) (*testAuthenticator, *WebAuthnCredential) {
+		t.Helper()
+		authenticator := newTestAuthenticator(t)
+		credential, err := service.parseRegistration(registration,
+			testClientData("webauthn.create", registration, testOrigin),
+			authenticator.attestationObject(testRPID))
+		if err != nil {
+			t.Fatalf("parseRegistration() err = %v", err)
+		}
+		authenticator.signCount = 1
+		credential.SignCount = 1
+		return authenticator, credential
+	}
+
+	tests := map[string]struct {
+		challenge []byte
+		origin    string
+		rpID      string
+		signCount uint32
+		tamper    bool
+		ok        bool
+	}{
+		"valid":             {challenge, testOrigin, testRPID, 2, false, true},
+		"wrong origin":      {challenge, "https://evil.test", testRPID, 2, false, false},
+		"wrong challenge":   {registration, testOrigin, testRPID, 2, false, false},
+		"wrong rp id":       {challenge, testOrigin, "evil.test", 2, false, false},
+		"replayed counter":  {challenge, testOrigin, testRPID, 1, false, false},
+		"counter went back": {challenge, testOrigin, testRPID, 0, false, false},
+		"bad signature":     {challenge, testOrigin, testRPID, 2, true, false},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			authenticator, credential := register(t)
+			authenticator.signCount = tc.signCount
+			authData := authenticator.authData(tc.rpID, authDataUserPresent|authDataUserVerified, nil)
+			clientData := testClientData("webauthn.get", tc.challenge, tc.origin)
+			signature := authenticator.assert(t, authData, clientData)
+			if tc.tamper {
+				// signed with the right key, but not over this client data
+				signature = authenticator.assert(t, authData,
+					testClientData("webauthn.get", registration, testOrigin))
+			}
+			err := service.verifyAssertion(credential, challenge, clientData, authData, signature)
+			if !tc.ok {
+				if !errors.Is(err, ErrInvalidCredential) {
+					t.Fatalf("verifyAssertion() err = %v, want ErrInvalidCredential", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verifyAssertion() err = %v", err)
+			}
+			if credential.SignCount != tc.signCount {
+				t.Errorf("SignCount = %d, want %d", credential.SignCount, tc.signCount)
+			}
+			if !credential.UserVerified {
+				t.Errorf("UserVerified = false, want true")
+			}
+		})
+	}
+
+	t.Run("other key", func(t *testing.T) {
+		_, credential := register(t)
+		other := newTestAuthenticator(t)
+		other.signCount = 2
+		authData := other.authData(testRPID, authDataUserPresent, nil)
+		clientData := testClientData("webauthn.get", challenge, testOrigin)
+		err := service.verifyAssertion(credential, challenge, clientData, authData,
+			other.assert(t, authData, clientData))
+		if !errors.Is(err, ErrInvalidCredential) {
+			t.Fatalf("verifyAssertion() err = %v, want ErrInvalidCredential", err)
+		}
+	})
+
+	t.Run("user not present", func(t *testing.T) {
+		authenticator, credential := register(t)
+		authenticator.signCount = 2
+		authData := authenticator.authData(testRPID, 0, nil)
+		clientData := testClientData("webauthn.get", challenge, testOrigin)
+		err := service.verifyAssertion(credential, challenge, clientData, authData,
+			authenticator.assert(t, authData, clientData))
+		if !errors.Is(err, ErrInvalidCredential) {
+			t.Fatalf("verifyAssertion() err = %v, want ErrInvalidCredential", err)
+		}
+	})
+}
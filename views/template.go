@@ -34,6 +34,9 @@ func ParseFS(fs fs.FS, patterns ...string) (Template, error) {
 			"currentUser": func() (*models.User, error) {
 				return nil, fmt.Errorf("currentUser not implemented")
 			},
+			"impersonator": func() (*models.User, error) {
+				return nil, fmt.Errorf("impersonator not implemented")
+			},
 			"errors": func() []string {
 				return nil
 			},
@@ -65,6 +68,9 @@ func (t Template) Execute(w http.ResponseWriter, r *http.Request, data interface
 			"currentUser": func() *models.User {
 				return context.User(r.Context())
 			},
+			"impersonator": func() *models.User {
+				return context.Impersonator(r.Context())
+			},
 			"errors": func() []string {
 				return errMsgs
 			},